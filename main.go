@@ -97,7 +97,7 @@ func GCSBucketInteractions(ctx context.Context, bucket, folder, key, prefix stri
 	logger.Printf("Keys: %+v", keys)
 
 	//----------TempToken Download Functionality--------------
-	tempToken, err := client.GetTempTokenForDownload(&storage.DownloadOptions{
+	tempToken, err := client.GetTempTokenForDownload(ctx, &storage.DownloadOptions{
 		Folder: folder,
 		Key:    key,
 	})
@@ -140,22 +140,11 @@ func GSMInterations(ctx context.Context, projectID string) {
 		return
 	}
 
-	payload := map[string]string{}
-	payload["username"] = "pranjalmohansaxena10asas"
-	payload["secretKey"] = "secondSecret"
-	payload["secretValue"] = "dhfkjadhflkjq"
+	user := "pranjalmohansaxena10"
 
-	// ----------SetSecret--------------
-	err = client.SetSecret(payload)
-	if err != nil {
-		logger.Printf("couldn't set secret data since: %+v", err)
-		return
-	}
-
-	//----------SetSecrets--------------
-	err = client.SetSecrets(&secrets.SecretsPayloadReq{
-		OrgID: "",
-		User:  "pranjalmohansaxena10",
+	//----------Set--------------
+	err = client.Set(ctx, secrets.SetRequest{
+		User: user,
 		Secrets: []secrets.Secret{{
 			Key:   "firstSecret",
 			Value: "3128301",
@@ -169,17 +158,26 @@ func GSMInterations(ctx context.Context, projectID string) {
 		return
 	}
 
-	//----------Secret Get-----------------
-	secretData, err := client.GetSecret(payload)
+	//----------Get-----------------
+	secretData, err := client.Get(ctx, secrets.UserRef{User: user})
 	if err != nil {
 		logger.Printf("couldn't get secret data since: %+v", err)
 		return
 	}
-
 	logger.Printf("Secret Data: %+v", secretData)
 
-	//----------Secret Delete-----------------
-	err = client.DeleteSecret(payload)
+	secretValue, err := client.GetValue(ctx, secrets.KeyRef{User: user, Key: "secondSecret"})
+	if err != nil {
+		logger.Printf("couldn't get secret value since: %+v", err)
+		return
+	}
+	logger.Printf("Secret Value: %+v", secretValue)
+
+	//----------Delete-----------------
+	err = client.Delete(ctx, secrets.DeleteRequest{
+		User: user,
+		Keys: []string{"firstSecret", "secondSecret"},
+	})
 	if err != nil {
 		logger.Printf("couldn't delete secret data since: %+v", err)
 		return
@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+const awsCurrentStage = "AWSCURRENT"
+
+type AWSSecretsParams struct {
+	// Region of the secrets, defaults to AWS_REGION or the shared config
+	Region string
+	// Endpoint overrides the Secrets Manager endpoint, e.g. for LocalStack
+	Endpoint string
+	// NamePrefix is prepended to the secret names, e.g. "hyperexecute/"
+	NamePrefix string
+	// VersionStage is the stage read by GetSecret. Defaults to AWSCURRENT.
+	VersionStage string
+	// WriteStages are attached to the versions written by updates. They must
+	// include VersionStage since updates read it and would otherwise drop the
+	// changes of the previous ones, e.g. reading and writing AWSPENDING stages
+	// updates before promotion. Defaults to VersionStage. Created secrets
+	// get AWSCURRENT as well as the write stages.
+	WriteStages []string
+	// KMSKeyID encrypts created secrets, defaults to the aws/secretsmanager key
+	KMSKeyID string
+	Logger   *log.Logger
+	Ctx      context.Context
+	// HTTPClient sends the Secrets Manager requests, optional
+	HTTPClient *http.Client
+}
+
+// awsSecretsAPI is the part of the Secrets Manager client used by awsStore
+type awsSecretsAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	UpdateSecretVersionStage(ctx context.Context, params *secretsmanager.UpdateSecretVersionStageInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretVersionStageOutput, error)
+	DeleteSecret(ctx context.Context, params *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error)
+}
+
+// awsStore keeps the secrets of every user as the string of an AWS secret
+type awsStore struct {
+	client       awsSecretsAPI
+	namePrefix   string
+	versionStage string
+	writeStages  []string
+	kmsKeyID     string
+}
+
+func newAWSSecretsClient(params AWSSecretsParams) (SecretManager, error) {
+	if params.Ctx == nil {
+		params.Ctx = context.Background()
+	}
+	if params.VersionStage == "" {
+		params.VersionStage = awsCurrentStage
+	}
+	if len(params.WriteStages) == 0 {
+		params.WriteStages = []string{params.VersionStage}
+	}
+	readsWrites := false
+	for _, stage := range params.WriteStages {
+		readsWrites = readsWrites || stage == params.VersionStage
+	}
+	if !readsWrites {
+		return nil, fmt.Errorf("write stages: %+v don't include version stage: %+v", params.WriteStages, params.VersionStage)
+	}
+	var options []func(*config.LoadOptions) error
+	if params.Region != "" {
+		options = append(options, config.WithRegion(params.Region))
+	}
+	if params.HTTPClient != nil {
+		options = append(options, config.WithHTTPClient(params.HTTPClient))
+	}
+	cfg, err := config.LoadDefaultConfig(params.Ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load AWS config since: %+v", err)
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("missing AWS region")
+	}
+	client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if params.Endpoint != "" {
+			o.BaseEndpoint = aws.String(params.Endpoint)
+		}
+	})
+
+	store := &awsStore{
+		client:       client,
+		namePrefix:   params.NamePrefix,
+		versionStage: params.VersionStage,
+		writeStages:  params.WriteStages,
+		kmsKeyID:     params.KMSKeyID,
+	}
+	return newStoreClient(params.Ctx, store, params.Logger), nil
+}
+
+// NewAWSSecretsClient returns a SecretManager keeping the secrets in AWS Secrets Manager
+func NewAWSSecretsClient(params AWSSecretsParams) (SecretManager, error) {
+	return newAWSSecretsClient(params)
+}
+
+func (a *awsStore) get(ctx context.Context, name string) ([]byte, error) {
+	output, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(a.namePrefix + name),
+		VersionStage: aws.String(a.versionStage),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil, ErrSecretNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if output.SecretString != nil {
+		return []byte(*output.SecretString), nil
+	}
+	return output.SecretBinary, nil
+}
+
+// put adds a version to the secret, creating it if it doesn't exist yet.
+// CreateSecret always labels the first version AWSCURRENT, so the other write
+// stages are moved onto it afterwards.
+func (a *awsStore) put(ctx context.Context, name string, data []byte) error {
+	_, err := a.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:      aws.String(a.namePrefix + name),
+		SecretString:  aws.String(string(data)),
+		VersionStages: a.writeStages,
+	})
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return err
+	}
+
+	input := &secretsmanager.CreateSecretInput{
+		Name:         aws.String(a.namePrefix + name),
+		SecretString: aws.String(string(data)),
+	}
+	if a.kmsKeyID != "" {
+		input.KmsKeyId = aws.String(a.kmsKeyID)
+	}
+	output, err := a.client.CreateSecret(ctx, input)
+	if err != nil {
+		return err
+	}
+	for _, stage := range a.writeStages {
+		if stage == awsCurrentStage {
+			continue
+		}
+		_, err = a.client.UpdateSecretVersionStage(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+			SecretId:        aws.String(a.namePrefix + name),
+			VersionStage:    aws.String(stage),
+			MoveToVersionId: output.VersionId,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't move stage: %+v to the created secret since: %+v", stage, err)
+		}
+	}
+	return nil
+}
+
+// remove deletes the secret without a recovery window, like the GSM client
+func (a *awsStore) remove(ctx context.Context, name string) error {
+	_, err := a.client.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(a.namePrefix + name),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return ErrSecretNotFound
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+func TestAWSWriteStagesIncludeVersionStage(t *testing.T) {
+	_, err := NewAWSSecretsClient(AWSSecretsParams{
+		Region:      "us-east-1",
+		WriteStages: []string{"AWSPENDING"},
+		Logger:      discardLogger(),
+	})
+	if err == nil {
+		t.Fatal("created client writing versions it doesn't read")
+	}
+}
+
+func TestAWSWriteStagesDefaultToVersionStage(t *testing.T) {
+	client, err := newAWSSecretsClient(AWSSecretsParams{
+		Region:       "us-east-1",
+		VersionStage: "AWSPENDING",
+		Logger:       discardLogger(),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create client: %+v", err)
+	}
+	store := client.(storeClient).store.(*awsStore)
+	if len(store.writeStages) != 1 || store.writeStages[0] != "AWSPENDING" {
+		t.Fatalf("got write stages %v, want [AWSPENDING]", store.writeStages)
+	}
+}
+
+// fakeAWS keeps the versions of every secret with their staging labels
+type fakeAWS struct {
+	mutex    sync.Mutex
+	secrets  map[string]map[string]*fakeAWSVersion
+	versions int
+}
+
+type fakeAWSVersion struct {
+	value  string
+	stages map[string]bool
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{secrets: map[string]map[string]*fakeAWSVersion{}}
+}
+
+func (f *fakeAWS) notFound(name string) error {
+	return &types.ResourceNotFoundException{Message: aws.String("secret " + name + " not found")}
+}
+
+// moveStage attaches the stage to the version, detaching it from the others
+func (f *fakeAWS) moveStage(name, stage, id string) {
+	for versionID, version := range f.secrets[name] {
+		version.stages[stage] = versionID == id
+	}
+}
+
+func (f *fakeAWS) addVersion(name, value string, stages []string) string {
+	f.versions++
+	id := fmt.Sprintf("v%d", f.versions)
+	f.secrets[name][id] = &fakeAWSVersion{value: value, stages: map[string]bool{}}
+	for _, stage := range stages {
+		f.moveStage(name, stage, id)
+	}
+	return id
+}
+
+func (f *fakeAWS) GetSecretValue(_ context.Context, params *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.SecretId)
+	for id, version := range f.secrets[name] {
+		if version.stages[aws.ToString(params.VersionStage)] {
+			return &secretsmanager.GetSecretValueOutput{VersionId: aws.String(id), SecretString: aws.String(version.value)}, nil
+		}
+	}
+	return nil, f.notFound(name)
+}
+
+func (f *fakeAWS) PutSecretValue(_ context.Context, params *secretsmanager.PutSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.SecretId)
+	if f.secrets[name] == nil {
+		return nil, f.notFound(name)
+	}
+	stages := params.VersionStages
+	if len(stages) == 0 {
+		stages = []string{awsCurrentStage}
+	}
+	id := f.addVersion(name, aws.ToString(params.SecretString), stages)
+	return &secretsmanager.PutSecretValueOutput{VersionId: aws.String(id)}, nil
+}
+
+func (f *fakeAWS) CreateSecret(_ context.Context, params *secretsmanager.CreateSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.Name)
+	if f.secrets[name] != nil {
+		return nil, &types.ResourceExistsException{Message: aws.String("secret " + name + " exists")}
+	}
+	f.secrets[name] = map[string]*fakeAWSVersion{}
+	id := f.addVersion(name, aws.ToString(params.SecretString), []string{awsCurrentStage})
+	return &secretsmanager.CreateSecretOutput{VersionId: aws.String(id)}, nil
+}
+
+func (f *fakeAWS) UpdateSecretVersionStage(_ context.Context, params *secretsmanager.UpdateSecretVersionStageInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretVersionStageOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.SecretId)
+	if f.secrets[name][aws.ToString(params.MoveToVersionId)] == nil {
+		return nil, f.notFound(name)
+	}
+	f.moveStage(name, aws.ToString(params.VersionStage), aws.ToString(params.MoveToVersionId))
+	return &secretsmanager.UpdateSecretVersionStageOutput{}, nil
+}
+
+func (f *fakeAWS) DeleteSecret(_ context.Context, params *secretsmanager.DeleteSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.SecretId)
+	if f.secrets[name] == nil {
+		return nil, f.notFound(name)
+	}
+	delete(f.secrets, name)
+	return &secretsmanager.DeleteSecretOutput{}, nil
+}
+
+// stages returns the stages attached to the versions of the secret
+func (f *fakeAWS) stages(name string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var stages []string
+	for _, version := range f.secrets[name] {
+		for stage, attached := range version.stages {
+			if attached {
+				stages = append(stages, stage)
+			}
+		}
+	}
+	sort.Strings(stages)
+	return stages
+}
+
+func newTestAWSClient(fake *fakeAWS, versionStage string, writeStages ...string) SecretManager {
+	if len(writeStages) == 0 {
+		writeStages = []string{versionStage}
+	}
+	store := &awsStore{client: fake, namePrefix: "prefix/", versionStage: versionStage, writeStages: writeStages}
+	return newStoreClient(context.Background(), store, discardLogger())
+}
+
+func TestAWSSetGetDelete(t *testing.T) {
+	for _, stage := range []string{awsCurrentStage, "AWSPENDING"} {
+		t.Run(stage, func(t *testing.T) {
+			ctx := context.Background()
+			client := newTestAWSClient(newFakeAWS(), stage)
+			if _, err := client.Get(ctx, testRef); !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Get of missing secret returned %v, want ErrSecretNotFound", err)
+			}
+			for _, secret := range []Secret{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}} {
+				err := client.Set(ctx, SetRequest{OrgID: testRef.OrgID, User: testRef.User, Secrets: []Secret{secret}})
+				if err != nil {
+					t.Fatalf("Set: %+v", err)
+				}
+			}
+			got, err := client.Get(ctx, testRef)
+			if err != nil {
+				t.Fatalf("Get: %+v", err)
+			}
+			if want := map[string]string{"a": "1", "b": "2"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("Get = %v, want %v", got, want)
+			}
+
+			err = client.Delete(ctx, DeleteRequest{OrgID: testRef.OrgID, User: testRef.User, Keys: []string{"a", "b"}})
+			if err != nil {
+				t.Fatalf("Delete: %+v", err)
+			}
+			if _, err := client.Get(ctx, testRef); !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Get of removed secret returned %v, want ErrSecretNotFound", err)
+			}
+			err = client.Delete(ctx, DeleteRequest{OrgID: testRef.OrgID, User: testRef.User, Keys: []string{"a"}})
+			if !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Delete of removed secret returned %v, want ErrSecretNotFound", err)
+			}
+		})
+	}
+}
+
+func TestAWSCreateAttachesWriteStages(t *testing.T) {
+	fake := newFakeAWS()
+	client := newTestAWSClient(fake, "AWSPENDING", "AWSPENDING", "STAGED")
+	err := client.Set(context.Background(), SetRequest{OrgID: testRef.OrgID, User: testRef.User, Secrets: []Secret{{Key: "a", Value: "1"}}})
+	if err != nil {
+		t.Fatalf("Set: %+v", err)
+	}
+	got := fake.stages("prefix/" + testRef.name())
+	if want := []string{"AWSCURRENT", "AWSPENDING", "STAGED"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("created version has stages %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type FileClientParams struct {
+	// Dir holds one encrypted JSON file per user, it is created if missing
+	Dir string
+	// Key is the AES-256 key encrypting the files, it must be 32 bytes long
+	Key    []byte
+	Logger *log.Logger
+}
+
+// fileStore keeps the secrets of every user in an AES-GCM encrypted file
+type fileStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+func newFileClient(params FileClientParams) (SecretManager, error) {
+	if params.Dir == "" {
+		return nil, errors.New("missing secrets directory")
+	}
+	if len(params.Key) != 32 {
+		return nil, errors.New("secrets encryption key must be 32 bytes long")
+	}
+	block, err := aes.NewCipher(params.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets encryption key since: %+v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets encryption key since: %+v", err)
+	}
+	if err := os.MkdirAll(params.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("couldn't create secrets directory: %+v since: %+v", params.Dir, err)
+	}
+	return newStoreClient(context.Background(), &fileStore{dir: params.Dir, aead: aead}, params.Logger), nil
+}
+
+// NewFileClient returns a SecretManager keeping the secrets in encrypted files
+func NewFileClient(params FileClientParams) (SecretManager, error) {
+	return newFileClient(params)
+}
+
+func (f *fileStore) path(name string) string {
+	return filepath.Join(f.dir, name+".json.enc")
+}
+
+func (f *fileStore) get(_ context.Context, name string) ([]byte, error) {
+	sealed, err := os.ReadFile(f.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSecretNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := f.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("corrupted secret file: %+v", f.path(name))
+	}
+	// The secret name is authenticated so that files can't be swapped between users.
+	data, err := f.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt secret file: %+v since: %+v", f.path(name), err)
+	}
+	return data, nil
+}
+
+// put writes the encrypted data to a temporary file renamed over the
+// previous one, so that readers never see a partial file.
+func (f *fileStore) put(_ context.Context, name string, data []byte) error {
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := f.aead.Seal(nonce, nonce, data, []byte(name))
+
+	tmp, err := os.CreateTemp(f.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(name))
+}
+
+func (f *fileStore) remove(_ context.Context, name string) error {
+	err := os.Remove(f.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrSecretNotFound
+	}
+	return err
+}
@@ -2,30 +2,57 @@ package secrets
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"path"
+	"strconv"
+	"time"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	// gsmCurrentAlias is the version alias pointing to the committed version of a secret
+	gsmCurrentAlias = "current"
+	// defaultGSMConflictRetries is the number of retries of updates losing a race
+	defaultGSMConflictRetries = 5
+	gsmConflictBackoff        = 50 * time.Millisecond
 )
 
 type gsmClient struct {
 	projectID string
-	logger    log.Logger
+	logger    *log.Logger
 	client    *secretmanager.Client
 	ctx       context.Context
+	// conflictRetries is the number of times an update is retried after a
+	// concurrent writer committed first
+	conflictRetries int
+	// retainVersions is the number of enabled versions kept by pruning, zero keeps all
+	retainVersions int
+	pruneOnWrite   bool
 }
 
 type GSMClientParams struct {
 	ProjectID string
 	Logger    log.Logger
 	Ctx       context.Context
+	// ConflictRetries is the number of retries of updates racing with
+	// other writers of the same secret. Defaults to 5.
+	ConflictRetries int
+	// RetainVersions is the number of newest enabled versions kept per
+	// secret when pruning, older versions are destroyed. The current version
+	// is always kept. Zero keeps every version.
+	RetainVersions int
+	// PruneOnWrite prunes the versions of a secret after each update,
+	// otherwise they are only pruned by PruneVersions and Sweep
+	PruneOnWrite bool
 }
 
 func newGSMClient(ctx context.Context, params GSMClientParams) (SecretManager, error) {
@@ -36,41 +63,79 @@ func newGSMClient(ctx context.Context, params GSMClientParams) (SecretManager, e
 	if err != nil {
 		log.Fatalf("failed to setup client: %v", err)
 	}
+	if params.ConflictRetries <= 0 {
+		params.ConflictRetries = defaultGSMConflictRetries
+	}
+	if params.RetainVersions < 0 {
+		return nil, errors.New("RetainVersions can't be negative")
+	}
 
 	return gsmClient{
-		projectID: params.ProjectID,
-		logger:    params.Logger,
-		client:    client,
-		ctx:       params.Ctx,
+		projectID:       params.ProjectID,
+		logger:          &params.Logger,
+		client:          client,
+		ctx:             params.Ctx,
+		conflictRetries: params.ConflictRetries,
+		retainVersions:  params.RetainVersions,
+		pruneOnWrite:    params.PruneOnWrite && params.RetainVersions > 0,
 	}, nil
 }
 
-func (g gsmClient) GetSecret(payload map[string]string) (map[string]interface{}, error) {
-	secrets := make(map[string]interface{})
-	secretName := g.getSecretName(payload["username"])
-	response, err := g.client.AccessSecretVersion(g.ctx, &secretmanagerpb.AccessSecretVersionRequest{
-		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", g.projectID, secretName),
-	})
+func (g gsmClient) Get(ctx context.Context, ref UserRef) (map[string]string, error) {
+	if err := ref.validate(); err != nil {
+		return nil, err
+	}
+	secrets, err := g.get(ctx, ref)
 	if err != nil {
-		g.logger.Printf("Error accessing secret for user from GSM %s, error - %v", payload["username"], err.Error())
-		return secrets, err
+		return nil, gsmError(err)
 	}
+	return stringValues(secrets), nil
+}
 
-	if response.Payload.Data != nil {
-		err = json.Unmarshal([]byte(response.Payload.Data), &secrets)
-		if err != nil {
-			g.logger.Printf("Error unmarshalling secret value for user %s, error - %v", payload["username"], err.Error())
-			return secrets, err
-		}
+func (g gsmClient) GetValue(ctx context.Context, ref KeyRef) (string, error) {
+	if err := ref.validate(); err != nil {
+		return "", err
+	}
+	secrets, err := g.Get(ctx, ref.userRef())
+	if err != nil {
+		return "", err
+	}
+	value, ok := secrets[ref.Key]
+	if !ok {
+		return "", ErrSecretNotFound
 	}
+	return value, nil
+}
 
-	return secrets, nil
+func (g gsmClient) Set(ctx context.Context, req SetRequest) error {
+	if err := req.userRef().validate(); err != nil {
+		return err
+	}
+	return gsmError(g.set(ctx, req))
+}
+
+func (g gsmClient) Delete(ctx context.Context, req DeleteRequest) error {
+	if err := req.userRef().validate(); err != nil {
+		return err
+	}
+	return gsmError(g.delete(ctx, req))
+}
+
+// gsmError replaces the NotFound errors of GSM with ErrSecretNotFound
+func gsmError(err error) error {
+	if status, ok := status.FromError(err); ok && status.Code() == codes.NotFound {
+		return ErrSecretNotFound
+	}
+	return err
+}
+
+func (g gsmClient) GetSecret(payload map[string]string) (map[string]interface{}, error) {
+	return g.get(g.ctx, payloadRef(payload))
 }
 
 // this func will generate secret name for google secret manager
-func (g *gsmClient) getSecretName(username string) string {
-	mask := md5.Sum([]byte(username))
-	return "hyperexecute-secrets-" + hex.EncodeToString(mask[:])
+func (g *gsmClient) getSecretName(ref UserRef) string {
+	return ref.name()
 }
 
 func (g gsmClient) SetSecret(payload map[string]string) error {
@@ -91,128 +156,284 @@ func (g gsmClient) SetSecrets(payload *SecretsPayloadReq) error {
 	if payload == nil {
 		return errors.New("missing SecretsPayloadReq payload")
 	}
-	// Check if secret exists, if exists put a secret else create a new secret
-	secretName := g.getSecretName(payload.User)
-	secrets, err := g.GetSecret(map[string]string{"username": payload.User})
+	return g.set(g.ctx, SetRequest{OrgID: payload.OrgID, User: payload.User, Secrets: payload.Secrets})
+}
+
+func (g gsmClient) DeleteSecret(payload map[string]string) error {
+	return g.delete(g.ctx, DeleteRequest{
+		OrgID: payload["orgId"],
+		User:  payload["username"],
+		Keys:  []string{payload["secretKey"]},
+	})
+}
+
+func (g gsmClient) DeleteSecrets(payload *SecretsPayloadReq) error {
+	if payload == nil {
+		return errors.New("missing SecretsPayloadReq payload")
+	}
+	return g.delete(g.ctx, deleteKeys(payload))
+}
+
+func (g gsmClient) get(ctx context.Context, ref UserRef) (map[string]interface{}, error) {
+	secretName := g.getSecretName(ref)
+	secrets, err := g.access(ctx, secretName, gsmCurrentAlias)
+	// Secrets written before the alias was introduced only have a latest version.
+	if status, ok := status.FromError(err); ok && (status.Code() == codes.NotFound || status.Code() == codes.InvalidArgument) {
+		secrets, err = g.access(ctx, secretName, "latest")
+	}
 	if err != nil {
-		if status, ok := status.FromError(err); ok && status.Code() == codes.NotFound {
-			// If the secret does not exist, create it.
-			_, err := g.client.CreateSecret(g.ctx, &secretmanagerpb.CreateSecretRequest{
-				Parent:   fmt.Sprintf("projects/%s", g.projectID),
-				SecretId: secretName,
-				Secret: &secretmanagerpb.Secret{
-					Replication: &secretmanagerpb.Replication{
-						Replication: &secretmanagerpb.Replication_Automatic_{
-							Automatic: &secretmanagerpb.Replication_Automatic{},
-						},
-					},
-				},
-			})
-			if err != nil {
-				g.logger.Printf("Error creating secret for user in GSM %s, error - %v", payload.User, err.Error())
-				return err
-			}
+		g.logger.Printf("Error accessing secret for %s from GSM, error - %v", ref, err.Error())
+		return secrets, err
+	}
+	return secrets, nil
+}
+
+// access returns the secrets stored in the given version or alias of the secret
+func (g gsmClient) access(ctx context.Context, secretName, version string) (map[string]interface{}, error) {
+	secrets := make(map[string]interface{})
+	response, err := g.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/%s", g.projectID, secretName, version),
+	})
+	if err != nil {
+		return secrets, err
+	}
+
+	if response.Payload.Data != nil {
+		err = json.Unmarshal([]byte(response.Payload.Data), &secrets)
+		if err != nil {
+			return secrets, fmt.Errorf("error unmarshalling secret: %s since: %w", secretName, err)
+		}
+	}
+	return secrets, nil
+}
+
+func (g gsmClient) set(ctx context.Context, req SetRequest) error {
+	return g.update(ctx, req.userRef(), true, func(secrets map[string]interface{}) {
+		for idx := 0; idx < len(req.Secrets); idx += 1 {
+			secrets[req.Secrets[idx].Key] = req.Secrets[idx].Value
+		}
+	})
+}
+
+func (g gsmClient) delete(ctx context.Context, req DeleteRequest) error {
+	return g.update(ctx, req.userRef(), false, func(secrets map[string]interface{}) {
+		for _, key := range req.Keys {
+			delete(secrets, key)
+		}
+	})
+}
 
-			for idx := 0; idx < len(payload.Secrets); idx += 1 {
-				secrets[payload.Secrets[idx].Key] = payload.Secrets[idx].Value
+// update runs the read-modify-write cycle of the user's secret. The new
+// version is only committed by moving the current alias with the etag read
+// at the start of the cycle, so a writer racing with another one retries on
+// top of its changes instead of silently overwriting them. The secret is
+// created if missing and create is set, and deleted once it has no keys left.
+//
+// A version is added before the alias moves to it and is destroyed when the
+// writer loses the race, so the latest version of a secret may be
+// uncommitted or destroyed. Readers outside this package must access
+// versions/current, latest is only read for secrets without the alias,
+// i.e. the ones not written since it was introduced.
+func (g gsmClient) update(ctx context.Context, ref UserRef, create bool, modify func(map[string]interface{})) error {
+	secretName := g.getSecretName(ref)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > g.conflictRetries {
+				g.logger.Printf("Giving up updating secret for %s after %d conflicts", ref, attempt-1)
+				return ErrConflict
 			}
-			secretJSON, err := json.Marshal(secrets)
-			if err != nil {
-				g.logger.Printf("Error marshaling json for user - %s", payload.User)
+			if err := sleepContext(ctx, gsmConflictBackoff*time.Duration(attempt)+time.Duration(rand.Int63n(int64(gsmConflictBackoff)))); err != nil {
 				return err
 			}
-			_, err = g.client.AddSecretVersion(g.ctx, &secretmanagerpb.AddSecretVersionRequest{
-				Parent: fmt.Sprintf("projects/%s/secrets/%s", g.projectID, secretName),
-				Payload: &secretmanagerpb.SecretPayload{
-					Data: secretJSON,
-				},
+		}
+
+		secret, secrets, err := g.read(ctx, secretName, create)
+		if err != nil {
+			if isGSMConflict(err) {
+				continue
+			}
+			g.logger.Printf("Error reading secret for %s in GSM, error - %v", ref, err.Error())
+			return err
+		}
+		modify(secrets)
+
+		if len(secrets) == 0 {
+			err = g.client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{
+				Name: secret.Name,
+				Etag: secret.Etag,
 			})
+			if isGSMEtagMismatch(err) || isGSMNotFound(err) {
+				continue
+			}
 			if err != nil {
-				g.logger.Printf("Error adding payload to GSM secret for user - %s since - %+v", payload.User, err)
+				g.logger.Printf("Error deleting secret for %s since - %+v", ref, err)
 				return err
 			}
-			log.Printf("Created secret for %q user\n", payload.User)
+			g.logger.Printf("Deleted secret for %s\n", ref)
+			return nil
 		}
-	} else {
-		for idx := 0; idx < len(payload.Secrets); idx += 1 {
-			secrets[payload.Secrets[idx].Key] = payload.Secrets[idx].Value
-		}
-		secretJSON, err := json.Marshal(secrets)
+
+		committed, err := g.commit(ctx, secret, secrets)
 		if err != nil {
-			g.logger.Printf("Error marshaling json for user - %s", payload.User)
+			g.logger.Printf("Error adding payload to GSM secret for %s since - %+v", ref, err)
 			return err
 		}
-		_, err = g.client.AddSecretVersion(g.ctx, &secretmanagerpb.AddSecretVersionRequest{
-			Parent: fmt.Sprintf("projects/%s/secrets/%s", g.projectID, secretName),
-			Payload: &secretmanagerpb.SecretPayload{
-				Data: secretJSON,
+		if committed {
+			g.logger.Printf("Updated secret for %s\n", ref)
+			if g.pruneOnWrite {
+				// The update succeeded, pruning failures are only logged.
+				if _, err := g.prune(ctx, secret.Name); err != nil {
+					g.logger.Printf("Error pruning secret versions for %s since - %+v", ref, err)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// read returns the secret with its etag and the secrets of its current
+// version. A missing secret is created when create is set.
+func (g gsmClient) read(ctx context.Context, secretName string, create bool) (*secretmanagerpb.Secret, map[string]interface{}, error) {
+	secret, err := g.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{
+		Name: fmt.Sprintf("projects/%s/secrets/%s", g.projectID, secretName),
+	})
+	if status, ok := status.FromError(err); ok && status.Code() == codes.NotFound && create {
+		secret, err = g.client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+			Parent:   fmt.Sprintf("projects/%s", g.projectID),
+			SecretId: secretName,
+			Secret: &secretmanagerpb.Secret{
+				Replication: &secretmanagerpb.Replication{
+					Replication: &secretmanagerpb.Replication_Automatic_{
+						Automatic: &secretmanagerpb.Replication_Automatic{},
+					},
+				},
 			},
 		})
 		if err != nil {
-			g.logger.Printf("Error adding payload to GSM secret for user - %s since - %+v", payload.User, err)
-			return err
+			return nil, nil, err
 		}
-		log.Printf("Updated secret for %q user\n", payload.User)
+		return secret, make(map[string]interface{}), nil
+	}
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
-}
 
-func (g gsmClient) DeleteSecret(payload map[string]string) error {
-	req := &SecretsPayloadReq{
-		OrgID: payload["orgId"],
-		User:  payload["username"],
-		Secrets: []Secret{
-			{
-				Key:   payload["secretKey"],
-				Value: payload["secretValue"],
-			},
-		},
+	version := "latest"
+	if current, ok := secret.VersionAliases[gsmCurrentAlias]; ok {
+		version = strconv.FormatInt(current, 10)
+	}
+	secrets, err := g.access(ctx, secretName, version)
+	// A secret without versions was just created by another writer.
+	if status, ok := status.FromError(err); ok && status.Code() == codes.NotFound && create {
+		return secret, make(map[string]interface{}), nil
+	}
+	// The version may have been pruned after another writer moved the alias
+	// past it, which is a conflict. Otherwise it was disabled or destroyed.
+	if status.Code(err) == codes.FailedPrecondition {
+		if latest, getErr := g.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: secret.Name}); getErr == nil && latest.Etag != secret.Etag {
+			return nil, nil, status.Errorf(codes.Aborted, "secret %s changed while reading version %s", secretName, version)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
 	}
-	return g.DeleteSecrets(req)
+	return secret, secrets, nil
 }
 
-func (g gsmClient) DeleteSecrets(payload *SecretsPayloadReq) error {
-	if payload == nil {
-		return errors.New("missing SecretsPayloadReq payload")
+// commit adds the secrets as a new version and points the current alias to
+// it. It returns false if the secret changed since it was read, the added
+// version is destroyed then.
+func (g gsmClient) commit(ctx context.Context, secret *secretmanagerpb.Secret, secrets map[string]interface{}) (bool, error) {
+	secretJSON, err := json.Marshal(secrets)
+	if err != nil {
+		return false, err
+	}
+	version, err := g.client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent: secret.Name,
+		Payload: &secretmanagerpb.SecretPayload{
+			Data: secretJSON,
+		},
+	})
+	if isGSMNotFound(err) {
+		return false, nil
 	}
-	// Check if secret exists
-	secretName := g.getSecretName(payload.User)
-	existingData, err := g.GetSecret(map[string]string{"username": payload.User})
 	if err != nil {
-		return err
+		return false, err
+	}
+	number, err := versionNumber(version.Name)
+	if err != nil {
+		return false, err
 	}
 
-	for idx := 0; idx < len(payload.Secrets); idx += 1 {
-		delete(existingData, payload.Secrets[idx].Key)
+	aliases := make(map[string]int64, len(secret.VersionAliases)+1)
+	for alias, aliased := range secret.VersionAliases {
+		aliases[alias] = aliased
 	}
+	aliases[gsmCurrentAlias] = number
+	_, err = g.client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:           secret.Name,
+			Etag:           secret.Etag,
+			VersionAliases: aliases,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"version_aliases"}},
+	})
+	if err == nil {
+		return true, nil
+	}
+	// The version lost the race and is never read, destroy it to avoid paying for it.
+	if _, destroyErr := g.client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{
+		Name: version.Name,
+	}); destroyErr != nil {
+		g.logger.Printf("Error destroying uncommitted secret version - %s since - %+v", version.Name, destroyErr)
+	}
+	if isGSMEtagMismatch(err) || isGSMNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
 
-	if len(existingData) > 0 {
-		secretJSON, err := json.Marshal(existingData)
-		if err != nil {
-			g.logger.Printf("Error marshaling json for user - %s", payload.User)
-			return err
-		}
-		_, err = g.client.AddSecretVersion(g.ctx, &secretmanagerpb.AddSecretVersionRequest{
-			Parent: fmt.Sprintf("projects/%s/secrets/%s", g.projectID, secretName),
-			Payload: &secretmanagerpb.SecretPayload{
-				Data: secretJSON,
-			},
-		})
-		if err != nil {
-			g.logger.Printf("Error adding payload after deleting secret for user - %s since - %+v", payload.User, err)
-			return err
-		}
-		g.logger.Printf("Updated secret after deleting given secrets for %q user\n", payload.User)
-	} else {
-		err = g.client.DeleteSecret(g.ctx, &secretmanagerpb.DeleteSecretRequest{
-			Name: fmt.Sprintf("projects/%s/secrets/%s", g.projectID, secretName),
-		})
-		if err != nil {
-			g.logger.Printf("Error deleting secret for user - %s since - %+v", payload.User, err)
-			return err
-		}
-		g.logger.Printf("Deleted secret for %q user\n", payload.User)
+// versionNumber returns the number of the secret version with the given resource name
+func versionNumber(name string) (int64, error) {
+	number, err := strconv.ParseInt(path.Base(name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid secret version: %s since: %+v", name, err)
 	}
+	return number, nil
+}
 
-	return nil
+// isGSMConflict checks whether the secret was changed or created by another writer
+func isGSMConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Aborted, codes.AlreadyExists:
+		return true
+	}
+	return false
+}
+
+// isGSMEtagMismatch checks whether a request carrying the etag of the secret
+// failed since another writer changed it. Only these requests may report a
+// conflict as a failed precondition.
+func isGSMEtagMismatch(err error) bool {
+	return isGSMConflict(err) || status.Code(err) == codes.FailedPrecondition
+}
+
+// isGSMNotFound checks whether the secret was deleted, while updating it
+// this means that another writer removed its last key
+func isGSMNotFound(err error) bool {
+	return err != nil && status.Code(err) == codes.NotFound
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
@@ -0,0 +1,110 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/iterator"
+)
+
+var _ Pruner = gsmClient{}
+
+func (g gsmClient) PruneVersions(ctx context.Context, ref UserRef) (int, error) {
+	if err := ref.validate(); err != nil {
+		return 0, err
+	}
+	if g.retainVersions <= 0 {
+		return 0, errors.New("missing secret version retention policy")
+	}
+	destroyed, err := g.prune(ctx, g.secretPath(ref))
+	if err != nil {
+		g.logger.Printf("Error pruning secret versions for %s since - %+v", ref, err)
+	}
+	return destroyed, gsmError(err)
+}
+
+func (g gsmClient) Sweep(ctx context.Context) (*PruneReport, error) {
+	start := time.Now()
+	report := &PruneReport{}
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+	if g.retainVersions <= 0 {
+		return report, errors.New("missing secret version retention policy")
+	}
+
+	it := g.client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{
+		Parent: fmt.Sprintf("projects/%s", g.projectID),
+		Filter: "name:" + secretNamePrefix,
+	})
+	for {
+		secret, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("error listing secrets of project: %s since: %w", g.projectID, err)
+		}
+		// The filter matches the prefix anywhere in the name.
+		if !strings.HasPrefix(path.Base(secret.Name), secretNamePrefix) {
+			continue
+		}
+		report.Secrets++
+		destroyed, err := g.prune(ctx, secret.Name)
+		report.Destroyed += destroyed
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, fmt.Errorf("error pruning secret: %s since: %w", secret.Name, err))
+		}
+	}
+	g.logger.Printf("Secret versions sweep destroyed %d versions of %d secrets, %d failures in %+v",
+		report.Destroyed, report.Secrets, report.Failed, time.Since(start))
+	return report, nil
+}
+
+// prune destroys the versions older than the newest retainVersions enabled
+// ones. The current version is always kept, and versions newer than it are
+// skipped since they may belong to updates which aren't committed yet.
+func (g gsmClient) prune(ctx context.Context, secretPath string) (int, error) {
+	current, err := g.currentVersion(ctx, secretPath)
+	if err != nil {
+		return 0, err
+	}
+	versions, err := g.versions(ctx, secretPath)
+	if err != nil {
+		return 0, err
+	}
+
+	kept, destroyed := 0, 0
+	var errs []error
+	for _, version := range versions {
+		switch {
+		case version.number > current, version.State == secretmanagerpb.SecretVersion_DESTROYED:
+			continue
+		case version.number == current:
+			kept++
+			continue
+		case kept < g.retainVersions:
+			// Disabled versions within the retained ones are kept as they are.
+			if version.State == secretmanagerpb.SecretVersion_ENABLED {
+				kept++
+			}
+			continue
+		}
+		_, err := g.client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{
+			Name: version.Name,
+			Etag: version.Etag,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error destroying secret version: %s since: %w", version.Name, err))
+			continue
+		}
+		destroyed++
+	}
+	return destroyed, errors.Join(errs...)
+}
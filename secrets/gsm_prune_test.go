@@ -0,0 +1,174 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+)
+
+const (
+	enabled   = secretmanagerpb.SecretVersion_ENABLED
+	disabled  = secretmanagerpb.SecretVersion_DISABLED
+	destroyed = secretmanagerpb.SecretVersion_DESTROYED
+)
+
+// setCurrent points the current alias of the secret of ref to the version
+func (f *fakeGSM) setCurrent(ref UserRef, number int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s := f.secrets[f.secretPath(ref)]
+	s.secret.VersionAliases = map[string]int64{gsmCurrentAlias: number}
+	s.secret.Etag = f.etag()
+}
+
+func TestGSMPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  []secretmanagerpb.SecretVersion_State
+		current int64
+		retain  int
+		want    []secretmanagerpb.SecretVersion_State
+	}{
+		{
+			name:    "keeps retained versions",
+			states:  []secretmanagerpb.SecretVersion_State{enabled, enabled, enabled, enabled},
+			current: 4,
+			retain:  2,
+			want:    []secretmanagerpb.SecretVersion_State{destroyed, destroyed, enabled, enabled},
+		},
+		{
+			name:    "retains all",
+			states:  []secretmanagerpb.SecretVersion_State{enabled, enabled},
+			current: 2,
+			retain:  5,
+			want:    []secretmanagerpb.SecretVersion_State{enabled, enabled},
+		},
+		{
+			name:    "skips versions newer than current",
+			states:  []secretmanagerpb.SecretVersion_State{enabled, enabled, enabled, enabled, enabled},
+			current: 2,
+			retain:  1,
+			want:    []secretmanagerpb.SecretVersion_State{destroyed, enabled, enabled, enabled, enabled},
+		},
+		{
+			name:    "always keeps current",
+			states:  []secretmanagerpb.SecretVersion_State{enabled, enabled, enabled},
+			current: 1,
+			retain:  1,
+			want:    []secretmanagerpb.SecretVersion_State{enabled, enabled, enabled},
+		},
+		{
+			name:    "disabled versions don't count as retained",
+			states:  []secretmanagerpb.SecretVersion_State{enabled, enabled, disabled, enabled},
+			current: 4,
+			retain:  2,
+			want:    []secretmanagerpb.SecretVersion_State{destroyed, enabled, disabled, enabled},
+		},
+		{
+			name:    "skips destroyed versions",
+			states:  []secretmanagerpb.SecretVersion_State{destroyed, enabled, enabled},
+			current: 3,
+			retain:  1,
+			want:    []secretmanagerpb.SecretVersion_State{destroyed, destroyed, enabled},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, g := newFakeGSM(t)
+			g.retainVersions = test.retain
+			for i, state := range test.states {
+				number := f.addVersion(t, testRef, map[string]interface{}{"version": fmt.Sprint(i + 1)})
+				if state != enabled {
+					f.setState(testRef, number, state)
+				}
+			}
+			f.setCurrent(testRef, test.current)
+
+			wantDestroyed := 0
+			for i := range test.want {
+				if test.want[i] == destroyed && test.states[i] != destroyed {
+					wantDestroyed++
+				}
+			}
+			pruned, err := g.PruneVersions(context.Background(), testRef)
+			if err != nil {
+				t.Fatalf("PruneVersions: %+v", err)
+			}
+			if pruned != wantDestroyed {
+				t.Errorf("PruneVersions destroyed %d versions, want %d", pruned, wantDestroyed)
+			}
+			if got := f.states(testRef); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("version states = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGSMPruneWithoutRetention(t *testing.T) {
+	_, g := newFakeGSM(t)
+	if _, err := g.PruneVersions(context.Background(), testRef); err == nil {
+		t.Fatal("PruneVersions without retention returned no error")
+	}
+	if _, err := g.Sweep(context.Background()); err == nil {
+		t.Fatal("Sweep without retention returned no error")
+	}
+}
+
+func TestGSMSweep(t *testing.T) {
+	f, g := newFakeGSM(t)
+	g.retainVersions = 1
+	refs := []UserRef{{User: "first"}, {User: "second"}, {OrgID: "org"}}
+	for _, ref := range refs {
+		for i := 0; i < 3; i++ {
+			f.commit(t, ref, map[string]interface{}{"version": fmt.Sprint(i)})
+		}
+	}
+	// Secrets of other applications in the project are left alone.
+	f.mutex.Lock()
+	other := f.create(fmt.Sprintf("projects/%s/secrets/other", fakeGSMProject))
+	f.add(other, []byte("{}"))
+	f.add(other, []byte("{}"))
+	f.mutex.Unlock()
+
+	report, err := g.Sweep(context.Background())
+	if err != nil {
+		t.Fatalf("Sweep: %+v", err)
+	}
+	if report.Secrets != len(refs) || report.Destroyed != 2*len(refs) || report.Failed != 0 {
+		t.Fatalf("Sweep report = %+v", report)
+	}
+	for _, ref := range refs {
+		if got, want := f.states(ref), []secretmanagerpb.SecretVersion_State{destroyed, destroyed, enabled}; !reflect.DeepEqual(got, want) {
+			t.Errorf("version states of %s = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+// countingPruner counts sweeps and cancels the context after the first one
+type countingPruner struct {
+	sweeps int
+	cancel context.CancelFunc
+}
+
+func (p *countingPruner) PruneVersions(ctx context.Context, ref UserRef) (int, error) {
+	return 0, nil
+}
+
+func (p *countingPruner) Sweep(ctx context.Context) (*PruneReport, error) {
+	p.sweeps++
+	p.cancel()
+	return &PruneReport{}, nil
+}
+
+func TestRunSweepsWithoutLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pruner := &countingPruner{cancel: cancel}
+	RunSweeps(ctx, pruner, time.Millisecond, nil)
+	if pruner.sweeps != 1 {
+		t.Fatalf("got %d sweeps, want 1", pruner.sweeps)
+	}
+}
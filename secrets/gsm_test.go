@@ -0,0 +1,559 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const fakeGSMProject = "project"
+
+// fakeGSM serves the subset of the Secret Manager API used by the gsm client.
+// Requests carrying a stale etag fail with Aborted.
+type fakeGSM struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+
+	mutex   sync.Mutex
+	secrets map[string]*fakeSecret
+	etags   int
+	// beforeUpdate and beforeAccess run before UpdateSecret and
+	// AccessSecretVersion are applied, e.g. to commit a concurrent write
+	beforeUpdate func()
+	beforeAccess func()
+}
+
+type fakeSecret struct {
+	secret   *secretmanagerpb.Secret
+	versions []*secretmanagerpb.SecretVersion
+	data     map[int64][]byte
+}
+
+func newFakeGSM(t *testing.T) (*fakeGSM, gsmClient) {
+	t.Helper()
+	f := &fakeGSM{secrets: make(map[string]*fakeSecret)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %+v", err)
+	}
+	server := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(server, f)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	client, err := secretmanager.NewClient(context.Background(),
+		option.WithEndpoint(listener.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if err != nil {
+		t.Fatalf("couldn't create secret manager client: %+v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return f, gsmClient{
+		projectID:       fakeGSMProject,
+		logger:          discardLogger(),
+		client:          client,
+		ctx:             context.Background(),
+		conflictRetries: defaultGSMConflictRetries,
+	}
+}
+
+func (f *fakeGSM) etag() string {
+	f.etags++
+	return strconv.Quote(strconv.Itoa(f.etags))
+}
+
+// secretPath returns the resource name of the secret of ref
+func (f *fakeGSM) secretPath(ref UserRef) string {
+	return fmt.Sprintf("projects/%s/secrets/%s", fakeGSMProject, ref.name())
+}
+
+// commit adds a version with the secrets and points the current alias to it
+// as a concurrent writer would
+func (f *fakeGSM) commit(t *testing.T, ref UserRef, secrets map[string]interface{}) int64 {
+	t.Helper()
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		t.Fatalf("couldn't marshal secrets: %+v", err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := f.secretPath(ref)
+	s, ok := f.secrets[name]
+	if !ok {
+		s = f.create(name)
+	}
+	number := f.add(s, data)
+	s.secret.VersionAliases = map[string]int64{gsmCurrentAlias: number}
+	s.secret.Etag = f.etag()
+	return number
+}
+
+// addVersion adds a version without moving the current alias, as a writer
+// which didn't commit yet or one predating the alias would
+func (f *fakeGSM) addVersion(t *testing.T, ref UserRef, secrets map[string]interface{}) int64 {
+	t.Helper()
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		t.Fatalf("couldn't marshal secrets: %+v", err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := f.secretPath(ref)
+	s, ok := f.secrets[name]
+	if !ok {
+		s = f.create(name)
+	}
+	return f.add(s, data)
+}
+
+// setState changes the state of a version of the secret of ref
+func (f *fakeGSM) setState(ref UserRef, number int64, state secretmanagerpb.SecretVersion_State) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.secrets[f.secretPath(ref)].versions[number-1].State = state
+}
+
+// states returns the states of the versions of the secret of ref, oldest first
+func (f *fakeGSM) states(ref UserRef) []secretmanagerpb.SecretVersion_State {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var states []secretmanagerpb.SecretVersion_State
+	if s, ok := f.secrets[f.secretPath(ref)]; ok {
+		for _, version := range s.versions {
+			states = append(states, version.State)
+		}
+	}
+	return states
+}
+
+// current returns the number of the version the current alias points to
+func (f *fakeGSM) current(ref UserRef) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.secrets[f.secretPath(ref)].secret.VersionAliases[gsmCurrentAlias]
+}
+
+func (f *fakeGSM) create(name string) *fakeSecret {
+	s := &fakeSecret{
+		secret: &secretmanagerpb.Secret{Name: name, Etag: f.etag(), CreateTime: timestamppb.Now()},
+		data:   make(map[int64][]byte),
+	}
+	f.secrets[name] = s
+	return s
+}
+
+func (f *fakeGSM) add(s *fakeSecret, data []byte) int64 {
+	number := int64(len(s.versions) + 1)
+	s.versions = append(s.versions, &secretmanagerpb.SecretVersion{
+		Name:       fmt.Sprintf("%s/versions/%d", s.secret.Name, number),
+		State:      secretmanagerpb.SecretVersion_ENABLED,
+		CreateTime: timestamppb.Now(),
+		Etag:       f.etag(),
+	})
+	s.data[number] = data
+	return number
+}
+
+// version resolves the version, alias or latest of the given resource name
+func (f *fakeGSM) version(name string) (*fakeSecret, *secretmanagerpb.SecretVersion, error) {
+	secretName, id, ok := strings.Cut(name, "/versions/")
+	if !ok {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid version name: %s", name)
+	}
+	s, ok := f.secrets[secretName]
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "secret not found: %s", secretName)
+	}
+	number, err := strconv.ParseInt(id, 10, 64)
+	switch {
+	case id == "latest":
+		number = int64(len(s.versions))
+	case err != nil:
+		aliased, ok := s.secret.VersionAliases[id]
+		if !ok {
+			return nil, nil, status.Errorf(codes.NotFound, "alias not found: %s", id)
+		}
+		number = aliased
+	}
+	if number < 1 || number > int64(len(s.versions)) {
+		return nil, nil, status.Errorf(codes.NotFound, "version not found: %s", name)
+	}
+	return s, s.versions[number-1], nil
+}
+
+func (f *fakeGSM) GetSecret(ctx context.Context, req *secretmanagerpb.GetSecretRequest) (*secretmanagerpb.Secret, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.secrets[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret not found: %s", req.Name)
+	}
+	return proto.Clone(s.secret).(*secretmanagerpb.Secret), nil
+}
+
+func (f *fakeGSM) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := req.Parent + "/secrets/" + req.SecretId
+	if _, ok := f.secrets[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "secret already exists: %s", name)
+	}
+	return proto.Clone(f.create(name).secret).(*secretmanagerpb.Secret), nil
+}
+
+func (f *fakeGSM) UpdateSecret(ctx context.Context, req *secretmanagerpb.UpdateSecretRequest) (*secretmanagerpb.Secret, error) {
+	if f.beforeUpdate != nil {
+		f.beforeUpdate()
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.secrets[req.Secret.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret not found: %s", req.Secret.Name)
+	}
+	if req.Secret.Etag != "" && req.Secret.Etag != s.secret.Etag {
+		return nil, status.Errorf(codes.Aborted, "etag mismatch for secret: %s", req.Secret.Name)
+	}
+	if paths := req.UpdateMask.GetPaths(); len(paths) != 1 || paths[0] != "version_aliases" {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported update mask: %v", paths)
+	}
+	for alias, number := range req.Secret.VersionAliases {
+		if number < 1 || number > int64(len(s.versions)) {
+			return nil, status.Errorf(codes.InvalidArgument, "alias %s points to missing version %d", alias, number)
+		}
+	}
+	s.secret.VersionAliases = req.Secret.VersionAliases
+	s.secret.Etag = f.etag()
+	return proto.Clone(s.secret).(*secretmanagerpb.Secret), nil
+}
+
+func (f *fakeGSM) DeleteSecret(ctx context.Context, req *secretmanagerpb.DeleteSecretRequest) (*emptypb.Empty, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.secrets[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret not found: %s", req.Name)
+	}
+	if req.Etag != "" && req.Etag != s.secret.Etag {
+		return nil, status.Errorf(codes.Aborted, "etag mismatch for secret: %s", req.Name)
+	}
+	delete(f.secrets, req.Name)
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeGSM) ListSecrets(ctx context.Context, req *secretmanagerpb.ListSecretsRequest) (*secretmanagerpb.ListSecretsResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	res := &secretmanagerpb.ListSecretsResponse{}
+	for name, s := range f.secrets {
+		if strings.HasPrefix(name, req.Parent+"/secrets/") {
+			res.Secrets = append(res.Secrets, proto.Clone(s.secret).(*secretmanagerpb.Secret))
+		}
+	}
+	sort.Slice(res.Secrets, func(i, j int) bool { return res.Secrets[i].Name < res.Secrets[j].Name })
+	return res, nil
+}
+
+func (f *fakeGSM) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.secrets[req.Parent]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret not found: %s", req.Parent)
+	}
+	number := f.add(s, req.Payload.Data)
+	return proto.Clone(s.versions[number-1]).(*secretmanagerpb.SecretVersion), nil
+}
+
+func (f *fakeGSM) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	if f.beforeAccess != nil {
+		f.beforeAccess()
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, version, err := f.version(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if version.State != secretmanagerpb.SecretVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "secret version %s is in %s state", version.Name, version.State)
+	}
+	number, _ := versionNumber(version.Name)
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name:    version.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: s.data[number]},
+	}, nil
+}
+
+func (f *fakeGSM) GetSecretVersion(ctx context.Context, req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, version, err := f.version(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(version).(*secretmanagerpb.SecretVersion), nil
+}
+
+func (f *fakeGSM) ListSecretVersions(ctx context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.secrets[req.Parent]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret not found: %s", req.Parent)
+	}
+	res := &secretmanagerpb.ListSecretVersionsResponse{}
+	// Versions are listed newest first.
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		res.Versions = append(res.Versions, proto.Clone(s.versions[i]).(*secretmanagerpb.SecretVersion))
+	}
+	return res, nil
+}
+
+func (f *fakeGSM) DisableSecretVersion(ctx context.Context, req *secretmanagerpb.DisableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return f.changeState(req.Name, req.Etag, secretmanagerpb.SecretVersion_DISABLED)
+}
+
+func (f *fakeGSM) EnableSecretVersion(ctx context.Context, req *secretmanagerpb.EnableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return f.changeState(req.Name, req.Etag, secretmanagerpb.SecretVersion_ENABLED)
+}
+
+func (f *fakeGSM) DestroySecretVersion(ctx context.Context, req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return f.changeState(req.Name, req.Etag, secretmanagerpb.SecretVersion_DESTROYED)
+}
+
+func (f *fakeGSM) changeState(name, etag string, state secretmanagerpb.SecretVersion_State) (*secretmanagerpb.SecretVersion, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, version, err := f.version(name)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" && etag != version.Etag {
+		return nil, status.Errorf(codes.Aborted, "etag mismatch for secret version: %s", name)
+	}
+	if version.State == secretmanagerpb.SecretVersion_DESTROYED {
+		return nil, status.Errorf(codes.FailedPrecondition, "secret version %s is destroyed", name)
+	}
+	version.State = state
+	version.Etag = f.etag()
+	if state == secretmanagerpb.SecretVersion_DESTROYED {
+		number, _ := versionNumber(version.Name)
+		delete(s.data, number)
+	}
+	return proto.Clone(version).(*secretmanagerpb.SecretVersion), nil
+}
+
+var testRef = UserRef{OrgID: "org", User: "user"}
+
+func setSecret(t *testing.T, g gsmClient, key, value string) {
+	t.Helper()
+	err := g.Set(context.Background(), SetRequest{
+		OrgID:   testRef.OrgID,
+		User:    testRef.User,
+		Secrets: []Secret{{Key: key, Value: value}},
+	})
+	if err != nil {
+		t.Fatalf("Set %s: %+v", key, err)
+	}
+}
+
+func TestGSMSetGetDelete(t *testing.T) {
+	_, g := newFakeGSM(t)
+	ctx := context.Background()
+	if _, err := g.Get(ctx, testRef); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("Get of missing secret returned %v, want ErrSecretNotFound", err)
+	}
+	setSecret(t, g, "a", "1")
+	setSecret(t, g, "b", "2")
+	got, err := g.Get(ctx, testRef)
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if len(got) != 2 || got["a"] != "1" || got["b"] != "2" {
+		t.Fatalf("Get = %v", got)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		err := g.Delete(ctx, DeleteRequest{OrgID: testRef.OrgID, User: testRef.User, Keys: []string{key}})
+		if err != nil {
+			t.Fatalf("Delete %s: %+v", key, err)
+		}
+	}
+	if _, err := g.Get(ctx, testRef); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("Get of deleted secret returned %v, want ErrSecretNotFound", err)
+	}
+}
+
+func TestGSMConcurrentUpdates(t *testing.T) {
+	f, g := newFakeGSM(t)
+	g.conflictRetries = 100
+	setSecret(t, g, "initial", "0")
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- g.Set(context.Background(), SetRequest{
+				OrgID:   testRef.OrgID,
+				User:    testRef.User,
+				Secrets: []Secret{{Key: fmt.Sprintf("key%d", i), Value: strconv.Itoa(i)}},
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Set: %+v", err)
+		}
+	}
+
+	got, err := g.Get(context.Background(), testRef)
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if len(got) != writers+1 {
+		t.Fatalf("Get returned %d secrets, want %d: %v", len(got), writers+1, got)
+	}
+	for i := 0; i < writers; i++ {
+		if got[fmt.Sprintf("key%d", i)] != strconv.Itoa(i) {
+			t.Errorf("update of writer %d was lost: %v", i, got)
+		}
+	}
+	// Only the versions which moved the alias are kept.
+	current := f.current(testRef)
+	for i, state := range f.states(testRef) {
+		if int64(i+1) > current && state != secretmanagerpb.SecretVersion_DESTROYED {
+			t.Errorf("version %d newer than current %d is %s", i+1, current, state)
+		}
+	}
+}
+
+func TestGSMLostRace(t *testing.T) {
+	f, g := newFakeGSM(t)
+	setSecret(t, g, "a", "1")
+
+	// Another writer commits between the read and the commit of the first attempt.
+	var once sync.Once
+	f.beforeUpdate = func() {
+		once.Do(func() {
+			f.commit(t, testRef, map[string]interface{}{"a": "1", "b": "2"})
+		})
+	}
+	setSecret(t, g, "c", "3")
+
+	got, err := g.Get(context.Background(), testRef)
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if len(got) != 3 || got["b"] != "2" || got["c"] != "3" {
+		t.Fatalf("Get = %v, want the concurrent and the retried update", got)
+	}
+	// versions: 1 initial, 2 lost the race, 3 concurrent writer, 4 retry
+	want := []secretmanagerpb.SecretVersion_State{
+		secretmanagerpb.SecretVersion_ENABLED,
+		secretmanagerpb.SecretVersion_DESTROYED,
+		secretmanagerpb.SecretVersion_ENABLED,
+		secretmanagerpb.SecretVersion_ENABLED,
+	}
+	if states := f.states(testRef); fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("version states = %v, want %v", states, want)
+	}
+	if current := f.current(testRef); current != 4 {
+		t.Fatalf("current version = %d, want 4", current)
+	}
+}
+
+func TestGSMConflictRetriesExhausted(t *testing.T) {
+	f, g := newFakeGSM(t)
+	g.conflictRetries = 2
+	setSecret(t, g, "a", "1")
+
+	// Every commit loses the race to another writer.
+	commits := 0
+	f.beforeUpdate = func() {
+		commits++
+		f.commit(t, testRef, map[string]interface{}{"a": strconv.Itoa(commits)})
+	}
+	err := g.Set(context.Background(), SetRequest{
+		OrgID:   testRef.OrgID,
+		User:    testRef.User,
+		Secrets: []Secret{{Key: "b", Value: "2"}},
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Set returned %v, want ErrConflict", err)
+	}
+	if commits != g.conflictRetries+1 {
+		t.Fatalf("got %d attempts, want %d", commits, g.conflictRetries+1)
+	}
+}
+
+func TestGSMDestroyedCurrentVersionIsNotAConflict(t *testing.T) {
+	f, g := newFakeGSM(t)
+	setSecret(t, g, "a", "1")
+	f.setState(testRef, f.current(testRef), secretmanagerpb.SecretVersion_DESTROYED)
+
+	updates := 0
+	f.beforeUpdate = func() { updates++ }
+	err := g.Set(context.Background(), SetRequest{
+		OrgID:   testRef.OrgID,
+		User:    testRef.User,
+		Secrets: []Secret{{Key: "b", Value: "2"}},
+	})
+	if err == nil || errors.Is(err, ErrConflict) {
+		t.Fatalf("Set returned %v, want the failed precondition", err)
+	}
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Set returned %v, want FailedPrecondition", err)
+	}
+	if updates != 0 {
+		t.Fatalf("Set committed %d times on top of a destroyed version", updates)
+	}
+}
+
+func TestGSMPrunedVersionWhileReadingIsAConflict(t *testing.T) {
+	f, g := newFakeGSM(t)
+	setSecret(t, g, "a", "1")
+	stale := f.current(testRef)
+
+	// Between reading the alias and the version, another writer commits and
+	// the version read is pruned.
+	var once sync.Once
+	f.beforeAccess = func() {
+		once.Do(func() {
+			f.commit(t, testRef, map[string]interface{}{"a": "2"})
+			f.setState(testRef, stale, secretmanagerpb.SecretVersion_DESTROYED)
+		})
+	}
+	setSecret(t, g, "b", "2")
+
+	got, err := g.Get(context.Background(), testRef)
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if len(got) != 2 || got["a"] != "2" || got["b"] != "2" {
+		t.Fatalf("Get = %v, want the update retried on top of the concurrent one", got)
+	}
+}
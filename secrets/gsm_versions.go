@@ -0,0 +1,220 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/iterator"
+)
+
+var _ Versioner = gsmClient{}
+
+func (g gsmClient) ListVersions(ctx context.Context, ref UserRef) ([]SecretVersion, error) {
+	if err := ref.validate(); err != nil {
+		return nil, err
+	}
+	secretPath := g.secretPath(ref)
+	current, err := g.currentVersion(ctx, secretPath)
+	if err != nil {
+		g.logger.Printf("Error getting current secret version for %s since - %+v", ref, err)
+		return nil, gsmError(err)
+	}
+
+	gsmVersions, err := g.versions(ctx, secretPath)
+	if err != nil {
+		g.logger.Printf("Error listing secret versions for %s since - %+v", ref, err)
+		return nil, gsmError(err)
+	}
+	versions := make([]SecretVersion, 0, len(gsmVersions))
+	for _, version := range gsmVersions {
+		versions = append(versions, SecretVersion{
+			ID:        strconv.FormatInt(version.number, 10),
+			State:     versionState(version.State),
+			CreatedAt: version.CreateTime.AsTime(),
+			Current:   version.number == current,
+		})
+	}
+	return versions, nil
+}
+
+func (g gsmClient) GetVersion(ctx context.Context, ref UserRef, version string) (map[string]string, error) {
+	if err := validateVersion(ref, version); err != nil {
+		return nil, err
+	}
+	secrets, err := g.access(ctx, g.getSecretName(ref), version)
+	if err != nil {
+		g.logger.Printf("Error accessing secret version %s for %s since - %+v", version, ref, err)
+		return nil, gsmError(err)
+	}
+	return stringValues(secrets), nil
+}
+
+func (g gsmClient) Rollback(ctx context.Context, ref UserRef, version string) error {
+	if err := validateVersion(ref, version); err != nil {
+		return err
+	}
+	previous, err := g.access(ctx, g.getSecretName(ref), version)
+	if err != nil {
+		g.logger.Printf("Error accessing secret version %s for %s since - %+v", version, ref, err)
+		return gsmError(err)
+	}
+	if len(previous) == 0 {
+		return fmt.Errorf("secret version: %s of %s has no secrets", version, ref)
+	}
+	err = g.update(ctx, ref, false, func(secrets map[string]interface{}) {
+		for key := range secrets {
+			delete(secrets, key)
+		}
+		for key, value := range previous {
+			secrets[key] = value
+		}
+	})
+	if err != nil {
+		return gsmError(err)
+	}
+	g.logger.Printf("Rolled back secret for %s to version %s\n", ref, version)
+	return nil
+}
+
+func (g gsmClient) DisableVersion(ctx context.Context, ref UserRef, version string) error {
+	return g.changeVersion(ctx, ref, version, "disabling", func(name string) error {
+		_, err := g.client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: name})
+		return err
+	})
+}
+
+func (g gsmClient) EnableVersion(ctx context.Context, ref UserRef, version string) error {
+	if err := validateVersion(ref, version); err != nil {
+		return err
+	}
+	_, err := g.client.EnableSecretVersion(ctx, &secretmanagerpb.EnableSecretVersionRequest{
+		Name: g.secretPath(ref) + "/versions/" + version,
+	})
+	if err != nil {
+		g.logger.Printf("Error enabling secret version %s for %s since - %+v", version, ref, err)
+		return gsmError(err)
+	}
+	return nil
+}
+
+func (g gsmClient) DestroyVersion(ctx context.Context, ref UserRef, version string) error {
+	return g.changeVersion(ctx, ref, version, "destroying", func(name string) error {
+		_, err := g.client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{Name: name})
+		return err
+	})
+}
+
+// changeVersion applies change to versions older than the current one. Writers
+// only move the current version forward to the versions they add, so an older
+// version can't become current after the check. Newer versions are refused as
+// in prune since they may belong to updates which aren't committed yet.
+func (g gsmClient) changeVersion(ctx context.Context, ref UserRef, version, action string, change func(name string) error) error {
+	if err := validateVersion(ref, version); err != nil {
+		return err
+	}
+	secretPath := g.secretPath(ref)
+	secretVersion, err := g.client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+		Name: secretPath + "/versions/" + version,
+	})
+	if err != nil {
+		return gsmError(err)
+	}
+	number, err := versionNumber(secretVersion.Name)
+	if err != nil {
+		return err
+	}
+	current, err := g.currentVersion(ctx, secretPath)
+	if err != nil {
+		return gsmError(err)
+	}
+	switch {
+	case number == current:
+		return ErrCurrentVersion
+	case number > current:
+		return ErrPendingVersion
+	}
+	if err := change(secretVersion.Name); err != nil {
+		g.logger.Printf("Error %s secret version %s for %s since - %+v", action, version, ref, err)
+		return gsmError(err)
+	}
+	g.logger.Printf("Finished %s secret version %s for %s\n", action, version, ref)
+	return nil
+}
+
+// gsmVersion is a secret version along with its number
+type gsmVersion struct {
+	*secretmanagerpb.SecretVersion
+	number int64
+}
+
+// versions returns the versions of the secret, newest first
+func (g gsmClient) versions(ctx context.Context, secretPath string) ([]gsmVersion, error) {
+	var versions []gsmVersion
+	it := g.client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: secretPath,
+	})
+	for {
+		version, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		number, err := versionNumber(version.Name)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, gsmVersion{SecretVersion: version, number: number})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].number > versions[j].number
+	})
+	return versions, nil
+}
+
+// currentVersion returns the number of the version read by Get
+func (g gsmClient) currentVersion(ctx context.Context, secretPath string) (int64, error) {
+	secret, err := g.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: secretPath})
+	if err != nil {
+		return 0, err
+	}
+	if current, ok := secret.VersionAliases[gsmCurrentAlias]; ok {
+		return current, nil
+	}
+	latest, err := g.client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+		Name: secretPath + "/versions/latest",
+	})
+	if err != nil {
+		return 0, err
+	}
+	return versionNumber(latest.Name)
+}
+
+func (g gsmClient) secretPath(ref UserRef) string {
+	return fmt.Sprintf("projects/%s/secrets/%s", g.projectID, g.getSecretName(ref))
+}
+
+func validateVersion(ref UserRef, version string) error {
+	if err := ref.validate(); err != nil {
+		return err
+	}
+	if version == "" {
+		return errors.New("missing secret version")
+	}
+	return nil
+}
+
+func versionState(state secretmanagerpb.SecretVersion_State) VersionState {
+	switch state {
+	case secretmanagerpb.SecretVersion_DISABLED:
+		return VersionDisabled
+	case secretmanagerpb.SecretVersion_DESTROYED:
+		return VersionDestroyed
+	}
+	return VersionEnabled
+}
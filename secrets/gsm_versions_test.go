@@ -0,0 +1,149 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+)
+
+// versionSummary returns the IDs, states and current flags of the versions
+func versionSummary(versions []SecretVersion) []string {
+	summary := make([]string, 0, len(versions))
+	for _, version := range versions {
+		entry := version.ID + ":" + string(version.State)
+		if version.Current {
+			entry += ":current"
+		}
+		summary = append(summary, entry)
+	}
+	return summary
+}
+
+func TestGSMListVersions(t *testing.T) {
+	f, g := newFakeGSM(t)
+	ctx := context.Background()
+	setSecret(t, g, "a", "1")
+	setSecret(t, g, "a", "2")
+	setSecret(t, g, "a", "3")
+	// An update which isn't committed yet is newer than the current version.
+	f.addVersion(t, testRef, map[string]interface{}{"a": "4"})
+	f.setState(testRef, 1, secretmanagerpb.SecretVersion_DISABLED)
+
+	versions, err := g.ListVersions(ctx, testRef)
+	if err != nil {
+		t.Fatalf("ListVersions: %+v", err)
+	}
+	want := []string{"4:enabled", "3:enabled:current", "2:enabled", "1:disabled"}
+	if got := versionSummary(versions); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ListVersions = %v, want %v", got, want)
+	}
+
+	if _, err := g.ListVersions(ctx, UserRef{User: "missing"}); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("ListVersions of missing secret returned %v, want ErrSecretNotFound", err)
+	}
+}
+
+func TestGSMListVersionsWithoutAlias(t *testing.T) {
+	f, g := newFakeGSM(t)
+	// Secrets written before the alias was introduced follow their latest version.
+	f.addVersion(t, testRef, map[string]interface{}{"a": "1"})
+	f.addVersion(t, testRef, map[string]interface{}{"a": "2"})
+
+	versions, err := g.ListVersions(context.Background(), testRef)
+	if err != nil {
+		t.Fatalf("ListVersions: %+v", err)
+	}
+	want := []string{"2:enabled:current", "1:enabled"}
+	if got := versionSummary(versions); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ListVersions = %v, want %v", got, want)
+	}
+	got, err := g.Get(context.Background(), testRef)
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if got["a"] != "2" {
+		t.Fatalf("Get = %v, want the latest version", got)
+	}
+
+	// The first update moves the secret to the alias.
+	setSecret(t, g, "b", "3")
+	if current := f.current(testRef); current != 3 {
+		t.Fatalf("current version = %d, want 3", current)
+	}
+}
+
+func TestGSMGetVersionAndRollback(t *testing.T) {
+	f, g := newFakeGSM(t)
+	ctx := context.Background()
+	setSecret(t, g, "a", "1")
+	setSecret(t, g, "b", "2")
+
+	got, err := g.GetVersion(ctx, testRef, "1")
+	if err != nil {
+		t.Fatalf("GetVersion: %+v", err)
+	}
+	if !reflect.DeepEqual(got, map[string]string{"a": "1"}) {
+		t.Fatalf("GetVersion = %v", got)
+	}
+	if _, err := g.GetVersion(ctx, testRef, "9"); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("GetVersion of missing version returned %v, want ErrSecretNotFound", err)
+	}
+
+	if err := g.Rollback(ctx, testRef, "1"); err != nil {
+		t.Fatalf("Rollback: %+v", err)
+	}
+	got, err = g.Get(ctx, testRef)
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if !reflect.DeepEqual(got, map[string]string{"a": "1"}) {
+		t.Fatalf("Get after rollback = %v", got)
+	}
+	// The rollback is recorded as a new version.
+	if current := f.current(testRef); current != 3 {
+		t.Fatalf("current version = %d, want 3", current)
+	}
+}
+
+func TestGSMChangeVersion(t *testing.T) {
+	f, g := newFakeGSM(t)
+	ctx := context.Background()
+	setSecret(t, g, "a", "1")
+	setSecret(t, g, "a", "2")
+	pending := f.addVersion(t, testRef, map[string]interface{}{"a": "3"})
+
+	if err := g.DisableVersion(ctx, testRef, "2"); !errors.Is(err, ErrCurrentVersion) {
+		t.Fatalf("DisableVersion of current returned %v, want ErrCurrentVersion", err)
+	}
+	if err := g.DestroyVersion(ctx, testRef, "current"); !errors.Is(err, ErrCurrentVersion) {
+		t.Fatalf("DestroyVersion of the current alias returned %v, want ErrCurrentVersion", err)
+	}
+	if err := g.DestroyVersion(ctx, testRef, "latest"); !errors.Is(err, ErrPendingVersion) {
+		t.Fatalf("DestroyVersion of pending latest returned %v, want ErrPendingVersion", err)
+	}
+	if state := f.states(testRef)[pending-1]; state != secretmanagerpb.SecretVersion_ENABLED {
+		t.Fatalf("pending version is %s", state)
+	}
+
+	if err := g.DisableVersion(ctx, testRef, "1"); err != nil {
+		t.Fatalf("DisableVersion: %+v", err)
+	}
+	if _, err := g.GetVersion(ctx, testRef, "1"); err == nil {
+		t.Fatal("GetVersion of disabled version returned no error")
+	}
+	if err := g.EnableVersion(ctx, testRef, "1"); err != nil {
+		t.Fatalf("EnableVersion: %+v", err)
+	}
+	if _, err := g.GetVersion(ctx, testRef, "1"); err != nil {
+		t.Fatalf("GetVersion of enabled version: %+v", err)
+	}
+	if err := g.DestroyVersion(ctx, testRef, "1"); err != nil {
+		t.Fatalf("DestroyVersion: %+v", err)
+	}
+	if state := f.states(testRef)[0]; state != secretmanagerpb.SecretVersion_DESTROYED {
+		t.Fatalf("destroyed version is %s", state)
+	}
+}
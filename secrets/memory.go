@@ -0,0 +1,56 @@
+package secrets
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+type MemoryClientParams struct {
+	Logger *log.Logger
+}
+
+// memoryStore keeps the secrets in memory, for tests and local runs
+type memoryStore struct {
+	mutex sync.RWMutex
+	blobs map[string][]byte
+}
+
+func newMemoryClient(params MemoryClientParams) (SecretManager, error) {
+	return newStoreClient(context.Background(), &memoryStore{blobs: make(map[string][]byte)}, params.Logger), nil
+}
+
+// NewMemoryClient returns a SecretManager keeping the secrets in memory
+func NewMemoryClient(params MemoryClientParams) (SecretManager, error) {
+	return newMemoryClient(params)
+}
+
+func (m *memoryStore) get(_ context.Context, name string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return data, nil
+}
+
+func (m *memoryStore) put(_ context.Context, name string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.blobs[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memoryStore) remove(_ context.Context, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.blobs[name]; !ok {
+		return ErrSecretNotFound
+	}
+	delete(m.blobs, name)
+	return nil
+}
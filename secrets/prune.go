@@ -0,0 +1,51 @@
+package secrets
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// PruneReport summarizes a sweep of the secret versions
+type PruneReport struct {
+	Secrets   int
+	Destroyed int
+	Failed    int
+	Errors    []error
+	Duration  time.Duration
+}
+
+// Pruner is implemented by SecretManager backends destroying the versions
+// beyond their retention policy
+type Pruner interface {
+	// PruneVersions destroys the old versions of the secrets and returns their number
+	PruneVersions(ctx context.Context, ref UserRef) (int, error)
+	// Sweep prunes the versions of every secret of the client. Failures of
+	// single secrets are recorded in the report, the returned error is only
+	// set when the sweep couldn't complete.
+	Sweep(ctx context.Context) (*PruneReport, error)
+}
+
+// RunSweeps sweeps the pruner every interval until ctx is done. A nil logger
+// defaults to the standard logger.
+func RunSweeps(ctx context.Context, pruner Pruner, interval time.Duration, logger *log.Logger) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := pruner.Sweep(ctx)
+		if err != nil {
+			logger.Printf("Error sweeping secret versions since: %+v", err)
+			continue
+		}
+		logger.Printf("Swept %d secrets, destroyed %d versions, %d failures in %+v",
+			report.Secrets, report.Destroyed, report.Failed, report.Duration)
+	}
+}
@@ -0,0 +1,69 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+)
+
+// Resolver merges the secrets shared by an org with the secrets of its
+// members, the secrets of a user override the org secrets with the same key.
+type Resolver struct {
+	client Client
+}
+
+// NewResolver returns a Resolver reading the secrets from the client
+func NewResolver(client Client) Resolver {
+	return Resolver{client: client}
+}
+
+// Resolve returns the org secrets of ref.OrgID overridden by the secrets of
+// ref.User in that org. Either of them may be empty, ErrSecretNotFound is returned if
+// neither has secrets.
+func (r Resolver) Resolve(ctx context.Context, ref UserRef) (map[string]string, error) {
+	if err := ref.validate(); err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string)
+	found := false
+	if ref.OrgID != "" {
+		secrets, err := r.client.Get(ctx, UserRef{OrgID: ref.OrgID})
+		if err != nil && !errors.Is(err, ErrSecretNotFound) {
+			return nil, err
+		}
+		for key, value := range secrets {
+			resolved[key] = value
+		}
+		found = found || err == nil
+	}
+	if ref.User != "" {
+		secrets, err := r.client.Get(ctx, UserRef{OrgID: ref.OrgID, User: ref.User})
+		if err != nil && !errors.Is(err, ErrSecretNotFound) {
+			return nil, err
+		}
+		for key, value := range secrets {
+			resolved[key] = value
+		}
+		found = found || err == nil
+	}
+	if !found {
+		return nil, ErrSecretNotFound
+	}
+	return resolved, nil
+}
+
+// ResolveValue returns the secret of the user, or the org secret if the user
+// doesn't override it
+func (r Resolver) ResolveValue(ctx context.Context, ref KeyRef) (string, error) {
+	if err := ref.validate(); err != nil {
+		return "", err
+	}
+	secrets, err := r.Resolve(ctx, ref.userRef())
+	if err != nil {
+		return "", err
+	}
+	value, ok := secrets[ref.Key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
@@ -0,0 +1,144 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newTestResolver(t *testing.T, secrets map[UserRef]map[string]string) (Resolver, SecretManager) {
+	t.Helper()
+	client, err := NewMemoryClient(MemoryClientParams{Logger: discardLogger()})
+	if err != nil {
+		t.Fatalf("NewMemoryClient: %+v", err)
+	}
+	for ref, values := range secrets {
+		req := SetRequest{OrgID: ref.OrgID, User: ref.User}
+		for key, value := range values {
+			req.Secrets = append(req.Secrets, Secret{Key: key, Value: value})
+		}
+		if err := client.Set(context.Background(), req); err != nil {
+			t.Fatalf("Set: %+v", err)
+		}
+	}
+	return NewResolver(client), client
+}
+
+func TestResolverResolve(t *testing.T) {
+	resolver, _ := newTestResolver(t, map[UserRef]map[string]string{
+		{OrgID: "org"}:                 {"shared": "org", "token": "org"},
+		{OrgID: "org", User: "user"}:   {"token": "user", "own": "user"},
+		{OrgID: "other", User: "user"}: {"token": "other"},
+		{OrgID: "solo", User: "user"}:  {"own": "solo"},
+	})
+	tests := []struct {
+		name    string
+		ref     UserRef
+		want    map[string]string
+		wantErr error
+	}{
+		{"user overrides org", UserRef{OrgID: "org", User: "user"}, map[string]string{"shared": "org", "token": "user", "own": "user"}, nil},
+		{"org only", UserRef{OrgID: "org"}, map[string]string{"shared": "org", "token": "org"}, nil},
+		{"member without secrets", UserRef{OrgID: "org", User: "member"}, map[string]string{"shared": "org", "token": "org"}, nil},
+		// The secrets of a user in another org are never resolved.
+		{"user of another org", UserRef{OrgID: "other", User: "user"}, map[string]string{"token": "other"}, nil},
+		{"org without secrets", UserRef{OrgID: "solo", User: "user"}, map[string]string{"own": "solo"}, nil},
+		{"unscoped user", UserRef{User: "user"}, nil, ErrSecretNotFound},
+		{"nothing", UserRef{OrgID: "none", User: "user"}, nil, ErrSecretNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolver.Resolve(context.Background(), test.ref)
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Fatalf("Resolve returned %v, want %v", err, test.wantErr)
+			}
+			if test.want != nil && !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("Resolve = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if _, err := resolver.Resolve(context.Background(), UserRef{}); err == nil || errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("Resolve of empty ref returned %v, want a validation error", err)
+	}
+}
+
+func TestResolverResolveValue(t *testing.T) {
+	resolver, _ := newTestResolver(t, map[UserRef]map[string]string{
+		{OrgID: "org"}:               {"shared": "org", "token": "org"},
+		{OrgID: "org", User: "user"}: {"token": "user"},
+	})
+	tests := []struct {
+		key     string
+		want    string
+		wantErr error
+	}{
+		{"token", "user", nil},
+		{"shared", "org", nil},
+		{"missing", "", ErrSecretNotFound},
+	}
+	for _, test := range tests {
+		got, err := resolver.ResolveValue(context.Background(), KeyRef{OrgID: "org", User: "user", Key: test.key})
+		if got != test.want || !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("ResolveValue(%q) = %q, %v, want %q, %v", test.key, got, err, test.want, test.wantErr)
+		}
+	}
+	if _, err := resolver.ResolveValue(context.Background(), KeyRef{OrgID: "org", User: "user"}); err == nil {
+		t.Error("ResolveValue without key returned no error")
+	}
+}
+
+func TestUserRefNames(t *testing.T) {
+	refs := []UserRef{
+		{OrgID: "a", User: "bc"},
+		{OrgID: "ab", User: "c"},
+		{OrgID: "a"},
+		{User: "a"},
+		{OrgID: "b", User: "a"},
+		{OrgID: "a", User: "a"},
+	}
+	names := map[string]UserRef{}
+	for _, ref := range refs {
+		if other, ok := names[ref.name()]; ok {
+			t.Errorf("%v and %v share the secret name %q", ref, other, ref.name())
+		}
+		names[ref.name()] = ref
+	}
+	// Unscoped users keep the names of the secrets written before orgs scoped them.
+	if got := (UserRef{User: "user"}).name(); got != secretName("user") {
+		t.Errorf("unscoped user name = %q, want %q", got, secretName("user"))
+	}
+}
+
+func TestMigrateUserSecrets(t *testing.T) {
+	_, client := newTestResolver(t, map[UserRef]map[string]string{
+		{User: "user"}:               {"token": "legacy", "old": "legacy"},
+		{OrgID: "org", User: "user"}: {"token": "scoped"},
+	})
+	ctx := context.Background()
+	migrated, err := MigrateUserSecrets(ctx, client, "user", []string{"org", "other"})
+	if err != nil {
+		t.Fatalf("MigrateUserSecrets: %+v", err)
+	}
+	if migrated != 2 {
+		t.Fatalf("migrated %d secrets, want 2", migrated)
+	}
+	want := map[UserRef]map[string]string{
+		{OrgID: "org", User: "user"}:   {"token": "scoped", "old": "legacy"},
+		{OrgID: "other", User: "user"}: {"token": "legacy", "old": "legacy"},
+	}
+	for ref, values := range want {
+		got, err := client.Get(ctx, ref)
+		if err != nil || !reflect.DeepEqual(got, values) {
+			t.Errorf("Get(%v) = %v, %v, want %v", ref, got, err, values)
+		}
+	}
+	if _, err := client.Get(ctx, UserRef{User: "user"}); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("Get of unscoped secrets returned %v, want ErrSecretNotFound", err)
+	}
+
+	// Migrating again finds nothing to do.
+	if migrated, err := MigrateUserSecrets(ctx, client, "user", []string{"org"}); err != nil || migrated != 0 {
+		t.Fatalf("MigrateUserSecrets = %d, %v, want 0", migrated, err)
+	}
+}
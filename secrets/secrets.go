@@ -2,8 +2,13 @@ package secrets
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"strings"
+	"time"
 )
 
 type SecretsPayloadReq struct {
@@ -16,25 +21,230 @@ type Secret struct {
 	Value string `json:"secretValue"`
 }
 
+// UserRef identifies the secrets of a user. The secrets shared by an org
+// are identified by its OrgID without a User.
+type UserRef struct {
+	OrgID string
+	User  string
+}
+
+// KeyRef identifies a single secret of a user, or of an org without a User
+type KeyRef struct {
+	OrgID string
+	User  string
+	Key   string
+}
+
+// SetRequest holds the secrets merged into the existing secrets of a user
+type SetRequest struct {
+	OrgID   string
+	User    string
+	Secrets []Secret
+}
+
+// DeleteRequest holds the keys removed from the secrets of a user
+type DeleteRequest struct {
+	OrgID string
+	User  string
+	Keys  []string
+}
+
+// Client is the typed secrets API, every call is bound to the given context
+type Client interface {
+	// Get returns every secret of the user, ErrSecretNotFound if they have none
+	Get(ctx context.Context, ref UserRef) (map[string]string, error)
+	// GetValue returns a single secret, ErrSecretNotFound if it doesn't exist
+	GetValue(ctx context.Context, ref KeyRef) (string, error)
+	// Set merges the secrets into the existing secrets of the user
+	Set(ctx context.Context, req SetRequest) error
+	// Delete removes the keys, the secret is removed along with its last key.
+	// It returns ErrSecretNotFound if the user has no secrets.
+	Delete(ctx context.Context, req DeleteRequest) error
+}
+
+// SecretManager is implemented by every backend. The map based methods are
+// kept for existing callers and run with the context given at construction.
 type SecretManager interface {
+	Client
+
+	// Deprecated: use Get or GetValue
 	GetSecret(payload map[string]string) (map[string]interface{}, error)
+	// Deprecated: use Set
 	SetSecret(payload map[string]string) error
+	// Deprecated: use Set
 	SetSecrets(payload *SecretsPayloadReq) error
+	// Deprecated: use Delete
 	DeleteSecret(payload map[string]string) error
+	// Deprecated: use Delete
 	DeleteSecrets(payload *SecretsPayloadReq) error
 }
 
-// NewSecretsClient returns new storage client
+// VersionState is the state of a version of the secrets
+type VersionState string
+
+const (
+	// VersionEnabled versions can be read
+	VersionEnabled VersionState = "enabled"
+	// VersionDisabled versions can't be read until they are enabled again
+	VersionDisabled VersionState = "disabled"
+	// VersionDestroyed versions lost their secrets for good
+	VersionDestroyed VersionState = "destroyed"
+)
+
+// SecretVersion describes a version of the secrets of a user or org
+type SecretVersion struct {
+	ID        string
+	State     VersionState
+	CreatedAt time.Time
+	// Current is set for the version returned by Get
+	Current bool
+}
+
+// Versioner is implemented by SecretManager backends keeping every version
+// of the secrets. Versions are identified by the IDs returned by ListVersions.
+type Versioner interface {
+	// ListVersions returns the versions of the secrets, newest first
+	ListVersions(ctx context.Context, ref UserRef) ([]SecretVersion, error)
+	// GetVersion returns the secrets of the version, so that a reader can pin
+	// the secrets it uses instead of following the updates
+	GetVersion(ctx context.Context, ref UserRef, version string) (map[string]string, error)
+	// Rollback replaces the secrets with the secrets of the version, it is
+	// recorded as a new version
+	Rollback(ctx context.Context, ref UserRef, version string) error
+	// DisableVersion makes the version unreadable until EnableVersion
+	DisableVersion(ctx context.Context, ref UserRef, version string) error
+	EnableVersion(ctx context.Context, ref UserRef, version string) error
+	// DestroyVersion irreversibly removes the secrets of the version
+	DestroyVersion(ctx context.Context, ref UserRef, version string) error
+}
+
+func (r UserRef) validate() error {
+	if r.User == "" && r.OrgID == "" {
+		return errors.New("missing user or org")
+	}
+	return nil
+}
+
+// name returns the name of the secret holding the secrets of the user in
+// the org, or of the org if no user is given. Users without an org have the
+// unscoped names of the secrets written before user secrets were scoped by
+// org, see MigrateUserSecrets.
+func (r UserRef) name() string {
+	switch {
+	case r.User == "":
+		return orgSecretName(r.OrgID)
+	case r.OrgID == "":
+		return secretName(r.User)
+	}
+	return orgUserSecretName(r.OrgID, r.User)
+}
+
+func (r UserRef) String() string {
+	switch {
+	case r.User == "":
+		return fmt.Sprintf("org %q", r.OrgID)
+	case r.OrgID == "":
+		return fmt.Sprintf("user %q", r.User)
+	}
+	return fmt.Sprintf("user %q of org %q", r.User, r.OrgID)
+}
+
+func (r KeyRef) userRef() UserRef {
+	return UserRef{OrgID: r.OrgID, User: r.User}
+}
+
+func (r KeyRef) validate() error {
+	if err := r.userRef().validate(); err != nil {
+		return err
+	}
+	if r.Key == "" {
+		return errors.New("missing secret key")
+	}
+	return nil
+}
+
+func (r SetRequest) userRef() UserRef {
+	return UserRef{OrgID: r.OrgID, User: r.User}
+}
+
+func (r DeleteRequest) userRef() UserRef {
+	return UserRef{OrgID: r.OrgID, User: r.User}
+}
+
+func (p *SecretsPayloadReq) userRef() UserRef {
+	return UserRef{OrgID: p.OrgID, User: p.User}
+}
+
+// payloadRef returns the secrets referenced by the payload of the map based methods
+func payloadRef(payload map[string]string) UserRef {
+	return UserRef{OrgID: payload["orgId"], User: payload["username"]}
+}
+
+// stringValues converts the decoded secrets of a user to their typed form
+func stringValues(secrets map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(secrets))
+	for key, value := range secrets {
+		if s, ok := value.(string); ok {
+			values[key] = s
+		} else {
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values
+}
+
+// deleteKeys returns the keys of the secrets as a DeleteRequest, the values are ignored
+func deleteKeys(payload *SecretsPayloadReq) DeleteRequest {
+	req := DeleteRequest{OrgID: payload.OrgID, User: payload.User}
+	for _, secret := range payload.Secrets {
+		req.Keys = append(req.Keys, secret.Key)
+	}
+	return req
+}
+
+// NewSecretsClient returns new secrets client
 func NewSecretsClient(ctx context.Context, cloudProvider, projectID string,
 	logger log.Logger) (SecretManager, error) {
 
 	switch strings.ToLower(cloudProvider) {
-	case "gcs":
+	case "gcs", "gsm":
 		return newGSMClient(ctx, GSMClientParams{
 			ProjectID: projectID,
 			Logger:    logger,
 			Ctx:       ctx,
 		})
+	case "vault":
+		// projectID is the KV v2 mount path, the address and credentials are
+		// read from VAULT_ADDR, VAULT_TOKEN or VAULT_ROLE_ID and VAULT_SECRET_ID.
+		return newVaultClient(VaultClientParams{
+			RoleID:    os.Getenv("VAULT_ROLE_ID"),
+			SecretID:  os.Getenv("VAULT_SECRET_ID"),
+			MountPath: projectID,
+			Logger:    &logger,
+			Ctx:       ctx,
+		})
+	case "aws":
+		// projectID is the AWS region, credentials are loaded from the environment.
+		return newAWSSecretsClient(AWSSecretsParams{
+			Region: projectID,
+			Logger: &logger,
+			Ctx:    ctx,
+		})
+	case "memory":
+		return newMemoryClient(MemoryClientParams{
+			Logger: &logger,
+		})
+	case "file":
+		// projectID is the secrets directory, the key is read from the environment.
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("SECRETS_ENCRYPTION_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SECRETS_ENCRYPTION_KEY since: %+v", err)
+		}
+		return newFileClient(FileClientParams{
+			Dir:    projectID,
+			Key:    key,
+			Logger: &logger,
+		})
 	default:
 		return newGSMClient(ctx, GSMClientParams{
 			ProjectID: projectID,
@@ -43,3 +253,52 @@ func NewSecretsClient(ctx context.Context, cloudProvider, projectID string,
 		})
 	}
 }
+
+// MigrateUserSecrets copies the unscoped secrets of the user, written before
+// user secrets were scoped by org, to each of the orgs then removes them. The
+// secrets already set in an org are kept. It returns the number of unscoped
+// secrets, nothing is done if the user has none.
+func MigrateUserSecrets(ctx context.Context, client Client, user string, orgIDs []string) (int, error) {
+	if user == "" {
+		return 0, errors.New("missing user")
+	}
+	legacy, err := client.Get(ctx, UserRef{User: user})
+	if errors.Is(err, ErrSecretNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get unscoped secrets of user: %+v since: %+v", user, err)
+	}
+	for _, orgID := range orgIDs {
+		if orgID == "" {
+			return 0, errors.New("missing org")
+		}
+		ref := UserRef{OrgID: orgID, User: user}
+		scoped, err := client.Get(ctx, ref)
+		if err != nil && !errors.Is(err, ErrSecretNotFound) {
+			return 0, fmt.Errorf("couldn't get secrets of %+v since: %+v", ref, err)
+		}
+		var missing []Secret
+		for key, value := range legacy {
+			if _, ok := scoped[key]; !ok {
+				missing = append(missing, Secret{Key: key, Value: value})
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if err := client.Set(ctx, SetRequest{OrgID: orgID, User: user, Secrets: missing}); err != nil {
+			return 0, fmt.Errorf("couldn't set secrets of %+v since: %+v", ref, err)
+		}
+	}
+
+	keys := make([]string, 0, len(legacy))
+	for key := range legacy {
+		keys = append(keys, key)
+	}
+	err = client.Delete(ctx, DeleteRequest{User: user, Keys: keys})
+	if err != nil && !errors.Is(err, ErrSecretNotFound) {
+		return 0, fmt.Errorf("couldn't remove unscoped secrets of user: %+v since: %+v", user, err)
+	}
+	return len(legacy), nil
+}
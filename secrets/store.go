@@ -0,0 +1,234 @@
+package secrets
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrSecretNotFound is returned for users without secrets
+var ErrSecretNotFound = errors.New("secret not found")
+
+// ErrConflict is returned when an update kept losing races with other writers of the secret
+var ErrConflict = errors.New("secret was modified concurrently")
+
+// ErrCurrentVersion is returned when disabling or destroying the version read by Get
+var ErrCurrentVersion = errors.New("secret version is current")
+
+// ErrPendingVersion is returned when disabling or destroying a version newer
+// than the current one, which may belong to an update not committed yet
+var ErrPendingVersion = errors.New("secret version is newer than the current one")
+
+// secretNamePrefix starts the names of every secret of the clients
+const secretNamePrefix = "hyperexecute-"
+
+// secretName returns the name of the secret holding the user's secrets
+func secretName(username string) string {
+	mask := md5.Sum([]byte(username))
+	return secretNamePrefix + "secrets-" + hex.EncodeToString(mask[:])
+}
+
+// orgUserSecretName returns the name of the secret holding the user's
+// secrets in the org. Both are hashed on their own so that no other org and
+// user share the name.
+func orgUserSecretName(orgID, username string) string {
+	orgMask := md5.Sum([]byte(orgID))
+	userMask := md5.Sum([]byte(username))
+	return secretNamePrefix + "secrets-" + hex.EncodeToString(orgMask[:]) + "-" + hex.EncodeToString(userMask[:])
+}
+
+// orgSecretName returns the name of the secret holding the secrets shared by the org
+func orgSecretName(orgID string) string {
+	mask := md5.Sum([]byte(orgID))
+	return secretNamePrefix + "org-secrets-" + hex.EncodeToString(mask[:])
+}
+
+// blobStore persists the JSON encoded secrets of every user under their secret name
+type blobStore interface {
+	// get returns ErrSecretNotFound if the secret doesn't exist
+	get(ctx context.Context, name string) ([]byte, error)
+	put(ctx context.Context, name string, data []byte) error
+	remove(ctx context.Context, name string) error
+}
+
+// storeClient implements SecretManager on top of a blobStore with the same
+// semantics as the GSM client: secrets are merged on set and the secret is
+// removed once its last key is deleted.
+type storeClient struct {
+	store  blobStore
+	logger *log.Logger
+	// ctx is used by the deprecated map based methods
+	ctx context.Context
+	// mutex serializes the read-modify-write cycles of updates
+	mutex *sync.Mutex
+}
+
+func newStoreClient(ctx context.Context, store blobStore, logger *log.Logger) storeClient {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	return storeClient{store: store, logger: logger, ctx: ctx, mutex: &sync.Mutex{}}
+}
+
+func (s storeClient) Get(ctx context.Context, ref UserRef) (map[string]string, error) {
+	if err := ref.validate(); err != nil {
+		return nil, err
+	}
+	secrets, err := s.get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return stringValues(secrets), nil
+}
+
+func (s storeClient) GetValue(ctx context.Context, ref KeyRef) (string, error) {
+	if err := ref.validate(); err != nil {
+		return "", err
+	}
+	secrets, err := s.Get(ctx, ref.userRef())
+	if err != nil {
+		return "", err
+	}
+	value, ok := secrets[ref.Key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (s storeClient) Set(ctx context.Context, req SetRequest) error {
+	if err := req.userRef().validate(); err != nil {
+		return err
+	}
+	return s.set(ctx, req)
+}
+
+func (s storeClient) Delete(ctx context.Context, req DeleteRequest) error {
+	if err := req.userRef().validate(); err != nil {
+		return err
+	}
+	return s.delete(ctx, req)
+}
+
+func (s storeClient) GetSecret(payload map[string]string) (map[string]interface{}, error) {
+	return s.get(s.ctx, payloadRef(payload))
+}
+
+func (s storeClient) SetSecret(payload map[string]string) error {
+	return s.SetSecrets(&SecretsPayloadReq{
+		OrgID: payload["orgId"],
+		User:  payload["username"],
+		Secrets: []Secret{
+			{
+				Key:   payload["secretKey"],
+				Value: payload["secretValue"],
+			},
+		},
+	})
+}
+
+func (s storeClient) SetSecrets(payload *SecretsPayloadReq) error {
+	if payload == nil {
+		return errors.New("missing SecretsPayloadReq payload")
+	}
+	return s.set(s.ctx, SetRequest{OrgID: payload.OrgID, User: payload.User, Secrets: payload.Secrets})
+}
+
+func (s storeClient) DeleteSecret(payload map[string]string) error {
+	return s.delete(s.ctx, DeleteRequest{
+		OrgID: payload["orgId"],
+		User:  payload["username"],
+		Keys:  []string{payload["secretKey"]},
+	})
+}
+
+func (s storeClient) DeleteSecrets(payload *SecretsPayloadReq) error {
+	if payload == nil {
+		return errors.New("missing SecretsPayloadReq payload")
+	}
+	return s.delete(s.ctx, deleteKeys(payload))
+}
+
+func (s storeClient) get(ctx context.Context, ref UserRef) (map[string]interface{}, error) {
+	secrets := make(map[string]interface{})
+	data, err := s.store.get(ctx, ref.name())
+	if err != nil {
+		if !errors.Is(err, ErrSecretNotFound) {
+			s.logger.Printf("Error accessing secret for %s, error - %v", ref, err.Error())
+		}
+		return secrets, err
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		s.logger.Printf("Error unmarshalling secret value for %s, error - %v", ref, err.Error())
+		return secrets, err
+	}
+	return secrets, nil
+}
+
+func (s storeClient) set(ctx context.Context, req SetRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ref := req.userRef()
+	secrets, err := s.get(ctx, ref)
+	if err != nil && !errors.Is(err, ErrSecretNotFound) {
+		return err
+	}
+	for _, secret := range req.Secrets {
+		secrets[secret.Key] = secret.Value
+	}
+	if err := s.save(ctx, ref, secrets); err != nil {
+		return err
+	}
+	s.logger.Printf("Updated secret for %s\n", ref)
+	return nil
+}
+
+func (s storeClient) delete(ctx context.Context, req DeleteRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ref := req.userRef()
+	existingData, err := s.get(ctx, ref)
+	if err != nil {
+		return err
+	}
+	for _, key := range req.Keys {
+		delete(existingData, key)
+	}
+
+	if len(existingData) > 0 {
+		if err := s.save(ctx, ref, existingData); err != nil {
+			return err
+		}
+		s.logger.Printf("Updated secret after deleting given secrets for %s\n", ref)
+		return nil
+	}
+	if err := s.store.remove(ctx, ref.name()); err != nil {
+		s.logger.Printf("Error deleting secret for %s since - %+v", ref, err)
+		return err
+	}
+	s.logger.Printf("Deleted secret for %s\n", ref)
+	return nil
+}
+
+func (s storeClient) save(ctx context.Context, ref UserRef, secrets map[string]interface{}) error {
+	secretJSON, err := json.Marshal(secrets)
+	if err != nil {
+		s.logger.Printf("Error marshaling json for %s", ref)
+		return err
+	}
+	if err := s.store.put(ctx, ref.name(), secretJSON); err != nil {
+		s.logger.Printf("Error saving secret for %s since - %+v", ref, err)
+		return fmt.Errorf("error saving secret for %s since: %w", ref, err)
+	}
+	return nil
+}
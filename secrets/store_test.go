@@ -0,0 +1,229 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testFileKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func newTestFileClient(t *testing.T, dir string, key []byte) SecretManager {
+	t.Helper()
+	client, err := NewFileClient(FileClientParams{Dir: dir, Key: key, Logger: discardLogger()})
+	if err != nil {
+		t.Fatalf("NewFileClient: %+v", err)
+	}
+	return client
+}
+
+func storeClients(t *testing.T) map[string]SecretManager {
+	memory, err := NewMemoryClient(MemoryClientParams{Logger: discardLogger()})
+	if err != nil {
+		t.Fatalf("NewMemoryClient: %+v", err)
+	}
+	return map[string]SecretManager{
+		"memory": memory,
+		"file":   newTestFileClient(t, t.TempDir(), testFileKey(1)),
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for name, client := range storeClients(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := client.Get(ctx, testRef); !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Get of missing secret returned %v, want ErrSecretNotFound", err)
+			}
+			err := client.Set(ctx, SetRequest{OrgID: testRef.OrgID, User: testRef.User, Secrets: []Secret{{Key: "a", Value: "1"}}})
+			if err != nil {
+				t.Fatalf("Set: %+v", err)
+			}
+			// Sets are merged with the existing secrets.
+			err = client.Set(ctx, SetRequest{OrgID: testRef.OrgID, User: testRef.User, Secrets: []Secret{{Key: "b", Value: "2"}}})
+			if err != nil {
+				t.Fatalf("Set: %+v", err)
+			}
+			got, err := client.Get(ctx, testRef)
+			if err != nil {
+				t.Fatalf("Get: %+v", err)
+			}
+			if want := map[string]string{"a": "1", "b": "2"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("Get = %v, want %v", got, want)
+			}
+			value, err := client.GetValue(ctx, KeyRef{OrgID: testRef.OrgID, User: testRef.User, Key: "b"})
+			if err != nil || value != "2" {
+				t.Fatalf("GetValue = %q, %v", value, err)
+			}
+			if _, err := client.GetValue(ctx, KeyRef{OrgID: testRef.OrgID, User: testRef.User, Key: "c"}); !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("GetValue of missing key returned %v, want ErrSecretNotFound", err)
+			}
+			// Secrets of other users are separate.
+			if _, err := client.Get(ctx, UserRef{OrgID: testRef.OrgID, User: "other"}); !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Get of other user returned %v, want ErrSecretNotFound", err)
+			}
+
+			err = client.Delete(ctx, DeleteRequest{OrgID: testRef.OrgID, User: testRef.User, Keys: []string{"a"}})
+			if err != nil {
+				t.Fatalf("Delete: %+v", err)
+			}
+			got, err = client.Get(ctx, testRef)
+			if err != nil {
+				t.Fatalf("Get: %+v", err)
+			}
+			if want := map[string]string{"b": "2"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("Get after delete = %v, want %v", got, want)
+			}
+			// Deleting the last key removes the secret.
+			err = client.Delete(ctx, DeleteRequest{OrgID: testRef.OrgID, User: testRef.User, Keys: []string{"b"}})
+			if err != nil {
+				t.Fatalf("Delete: %+v", err)
+			}
+			if _, err := client.Get(ctx, testRef); !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Get of removed secret returned %v, want ErrSecretNotFound", err)
+			}
+			err = client.Delete(ctx, DeleteRequest{OrgID: testRef.OrgID, User: testRef.User, Keys: []string{"b"}})
+			if !errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Delete of removed secret returned %v, want ErrSecretNotFound", err)
+			}
+		})
+	}
+}
+
+func TestStoreConcurrentSets(t *testing.T) {
+	for name, client := range storeClients(t) {
+		t.Run(name, func(t *testing.T) {
+			const writers = 8
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					err := client.Set(context.Background(), SetRequest{
+						OrgID:   testRef.OrgID,
+						User:    testRef.User,
+						Secrets: []Secret{{Key: fmt.Sprintf("key%d", i), Value: "value"}},
+					})
+					if err != nil {
+						t.Errorf("Set: %+v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			got, err := client.Get(context.Background(), testRef)
+			if err != nil {
+				t.Fatalf("Get: %+v", err)
+			}
+			if len(got) != writers {
+				t.Fatalf("Get returned %d secrets, want %d: %v", len(got), writers, got)
+			}
+		})
+	}
+}
+
+func TestFileClientPersists(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	err := newTestFileClient(t, dir, testFileKey(1)).Set(ctx, SetRequest{User: testRef.User, Secrets: []Secret{{Key: "a", Value: "1"}}})
+	if err != nil {
+		t.Fatalf("Set: %+v", err)
+	}
+	got, err := newTestFileClient(t, dir, testFileKey(1)).Get(ctx, UserRef{User: testRef.User})
+	if err != nil {
+		t.Fatalf("Get: %+v", err)
+	}
+	if got["a"] != "1" {
+		t.Fatalf("Get = %v", got)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %+v", err)
+	}
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".json.enc") {
+		t.Fatalf("secrets directory holds %v, want a single encrypted file", files)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("ReadFile: %+v", err)
+	}
+	if bytes.Contains(data, []byte(`"a"`)) {
+		t.Fatal("secret file isn't encrypted")
+	}
+}
+
+func TestFileClientDecryptFailure(t *testing.T) {
+	ctx := context.Background()
+	user := UserRef{User: testRef.User}
+	other := UserRef{User: "other"}
+	path := func(dir string, ref UserRef) string {
+		return filepath.Join(dir, ref.name()+".json.enc")
+	}
+	tests := map[string]func(t *testing.T, dir string) SecretManager{
+		"wrong key": func(t *testing.T, dir string) SecretManager {
+			return newTestFileClient(t, dir, testFileKey(2))
+		},
+		"tampered file": func(t *testing.T, dir string) SecretManager {
+			data, err := os.ReadFile(path(dir, user))
+			if err != nil {
+				t.Fatalf("ReadFile: %+v", err)
+			}
+			data[len(data)-1] ^= 1
+			if err := os.WriteFile(path(dir, user), data, 0o600); err != nil {
+				t.Fatalf("WriteFile: %+v", err)
+			}
+			return newTestFileClient(t, dir, testFileKey(1))
+		},
+		"truncated file": func(t *testing.T, dir string) SecretManager {
+			if err := os.WriteFile(path(dir, user), []byte("short"), 0o600); err != nil {
+				t.Fatalf("WriteFile: %+v", err)
+			}
+			return newTestFileClient(t, dir, testFileKey(1))
+		},
+		// The secret name is authenticated so that files can't be swapped between users.
+		"swapped file": func(t *testing.T, dir string) SecretManager {
+			if err := os.Rename(path(dir, other), path(dir, user)); err != nil {
+				t.Fatalf("Rename: %+v", err)
+			}
+			return newTestFileClient(t, dir, testFileKey(1))
+		},
+	}
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			client := newTestFileClient(t, dir, testFileKey(1))
+			for _, ref := range []UserRef{user, other} {
+				if err := client.Set(ctx, SetRequest{User: ref.User, Secrets: []Secret{{Key: "a", Value: ref.User}}}); err != nil {
+					t.Fatalf("Set: %+v", err)
+				}
+			}
+			_, err := corrupt(t, dir).Get(ctx, user)
+			if err == nil || errors.Is(err, ErrSecretNotFound) {
+				t.Fatalf("Get of corrupted secret returned %v, want a decrypt error", err)
+			}
+		})
+	}
+}
+
+func TestFileClientInvalidParams(t *testing.T) {
+	tests := map[string]FileClientParams{
+		"missing dir": {Key: testFileKey(1)},
+		"short key":   {Dir: t.TempDir(), Key: testFileKey(1)[:16]},
+	}
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewFileClient(params); err == nil {
+				t.Fatal("NewFileClient returned no error")
+			}
+		})
+	}
+}
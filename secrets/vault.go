@@ -0,0 +1,183 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+const (
+	defaultVaultMountPath    = "secret"
+	defaultVaultAppRoleMount = "approle"
+)
+
+type VaultClientParams struct {
+	// Address of the Vault server, defaults to VAULT_ADDR
+	Address string
+	// Token authenticates the client, defaults to VAULT_TOKEN. It is ignored
+	// when RoleID is set.
+	Token string
+	// RoleID and SecretID log in with AppRole, the token is renewed by
+	// logging in again once it is rejected
+	RoleID   string
+	SecretID string
+	// AppRoleMount is the mount path of the AppRole auth method. Defaults to "approle".
+	AppRoleMount string
+	// Namespace is the Vault Enterprise namespace, defaults to VAULT_NAMESPACE
+	Namespace string
+	// MountPath is the mount path of the KV v2 secrets engine. Defaults to "secret".
+	MountPath string
+	// PathPrefix is prepended to the secret paths within the mount
+	PathPrefix string
+	Logger     *log.Logger
+	Ctx        context.Context
+	// HTTPClient sends the Vault requests, optional
+	HTTPClient *http.Client
+}
+
+// vaultStore keeps the secrets of every user as the fields of a KV v2 secret
+type vaultStore struct {
+	client     *vault.Client
+	kv         *vault.KVv2
+	pathPrefix string
+
+	roleID       string
+	secretID     string
+	appRoleMount string
+	// loginMutex serializes AppRole logins
+	loginMutex sync.Mutex
+}
+
+func newVaultClient(params VaultClientParams) (SecretManager, error) {
+	config := vault.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("invalid vault configuration since: %+v", config.Error)
+	}
+	if params.Address != "" {
+		config.Address = params.Address
+	}
+	if params.HTTPClient != nil {
+		config.HttpClient = params.HTTPClient
+	}
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create vault client since: %+v", err)
+	}
+	if params.Namespace != "" {
+		client.SetNamespace(params.Namespace)
+	}
+	if params.MountPath == "" {
+		params.MountPath = defaultVaultMountPath
+	}
+	if params.AppRoleMount == "" {
+		params.AppRoleMount = defaultVaultAppRoleMount
+	}
+	if params.Ctx == nil {
+		params.Ctx = context.Background()
+	}
+
+	store := &vaultStore{
+		client:       client,
+		kv:           client.KVv2(params.MountPath),
+		pathPrefix:   params.PathPrefix,
+		roleID:       params.RoleID,
+		secretID:     params.SecretID,
+		appRoleMount: params.AppRoleMount,
+	}
+	switch {
+	case params.RoleID != "":
+		if err := store.login(params.Ctx); err != nil {
+			return nil, err
+		}
+	case params.Token != "":
+		client.SetToken(params.Token)
+	case client.Token() == "":
+		return nil, errors.New("missing vault token or AppRole credentials")
+	}
+	return newStoreClient(params.Ctx, store, params.Logger), nil
+}
+
+// NewVaultClient returns a SecretManager keeping the secrets in a Vault KV v2 engine
+func NewVaultClient(params VaultClientParams) (SecretManager, error) {
+	return newVaultClient(params)
+}
+
+// login gets a new token with the AppRole credentials
+func (v *vaultStore) login(ctx context.Context) error {
+	v.loginMutex.Lock()
+	defer v.loginMutex.Unlock()
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, path.Join("auth", v.appRoleMount, "login"), map[string]interface{}{
+		"role_id":   v.roleID,
+		"secret_id": v.secretID,
+	})
+	if err != nil {
+		return fmt.Errorf("error logging in to vault with AppRole since: %w", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return errors.New("vault AppRole login returned no token")
+	}
+	v.client.SetToken(secret.Auth.ClientToken)
+	return nil
+}
+
+// do runs fn, logging in again and retrying once if an AppRole token was rejected
+func (v *vaultStore) do(ctx context.Context, fn func() error) error {
+	err := fn()
+	var respErr *vault.ResponseError
+	if v.roleID == "" || !errors.As(err, &respErr) || respErr.StatusCode != http.StatusForbidden {
+		return err
+	}
+	if err := v.login(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (v *vaultStore) path(name string) string {
+	return path.Join(v.pathPrefix, name)
+}
+
+func (v *vaultStore) get(ctx context.Context, name string) (data []byte, err error) {
+	err = v.do(ctx, func() error {
+		secret, err := v.kv.Get(ctx, v.path(name))
+		if errors.Is(err, vault.ErrSecretNotFound) {
+			return ErrSecretNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// The latest version of deleted secrets has no data.
+		if secret.Data == nil {
+			return ErrSecretNotFound
+		}
+		data, err = json.Marshal(secret.Data)
+		return err
+	})
+	return data, err
+}
+
+func (v *vaultStore) put(ctx context.Context, name string, data []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	return v.do(ctx, func() error {
+		_, err := v.kv.Put(ctx, v.path(name), fields)
+		return err
+	})
+}
+
+// remove deletes every version of the secret along with its metadata
+func (v *vaultStore) remove(ctx context.Context, name string) error {
+	return v.do(ctx, func() error {
+		return v.kv.DeleteMetadata(ctx, v.path(name))
+	})
+}
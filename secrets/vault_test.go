@@ -0,0 +1,267 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault serves the KV v2 and AppRole endpoints used by the vault client
+type fakeVault struct {
+	mount        string
+	namespace    string
+	appRoleMount string
+	roleID       string
+	secretID     string
+
+	mutex   sync.Mutex
+	tokens  map[string]bool
+	secrets map[string]map[string]interface{}
+	logins  int
+}
+
+func newFakeVault(t *testing.T, mount, namespace string) (*fakeVault, *httptest.Server) {
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_NAMESPACE", "")
+	f := &fakeVault{
+		mount:        mount,
+		namespace:    namespace,
+		appRoleMount: "approle",
+		tokens:       map[string]bool{"root": true},
+		secrets:      make(map[string]map[string]interface{}),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Header.Get("X-Vault-Namespace") != f.namespace {
+		writeVaultError(w, http.StatusBadRequest, "unexpected namespace")
+		return
+	}
+	if r.URL.Path == "/v1/auth/"+f.appRoleMount+"/login" {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role_id"] != f.roleID || body["secret_id"] != f.secretID {
+			writeVaultError(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		f.logins++
+		token := fmt.Sprintf("approle-token-%d", f.logins)
+		f.tokens[token] = true
+		writeVaultJSON(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": token}})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		writeVaultError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	dataPrefix, metadataPrefix := "/v1/"+f.mount+"/data/", "/v1/"+f.mount+"/metadata/"
+	switch {
+	case strings.HasPrefix(r.URL.Path, dataPrefix) && r.Method == http.MethodGet:
+		data, ok := f.secrets[strings.TrimPrefix(r.URL.Path, dataPrefix)]
+		if !ok {
+			writeVaultError(w, http.StatusNotFound, "")
+			return
+		}
+		writeVaultJSON(w, map[string]interface{}{"data": map[string]interface{}{
+			"data":     data,
+			"metadata": map[string]interface{}{"version": 1},
+		}})
+	case strings.HasPrefix(r.URL.Path, dataPrefix) && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeVaultError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.secrets[strings.TrimPrefix(r.URL.Path, dataPrefix)] = body.Data
+		writeVaultJSON(w, map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+	case strings.HasPrefix(r.URL.Path, metadataPrefix) && r.Method == http.MethodDelete:
+		delete(f.secrets, strings.TrimPrefix(r.URL.Path, metadataPrefix))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeVaultError(w, http.StatusNotFound, "")
+	}
+}
+
+// revokeTokens expires every token, as if their TTL ran out
+func (f *fakeVault) revokeTokens() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func (f *fakeVault) loginCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.logins
+}
+
+func (f *fakeVault) secret(path string) (map[string]interface{}, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	data, ok := f.secrets[path]
+	return data, ok
+}
+
+func writeVaultJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeVaultError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	errs := []string{}
+	if message != "" {
+		errs = append(errs, message)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
+
+func discardLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+func TestVaultTokenAuth(t *testing.T) {
+	fake, server := newFakeVault(t, "kv", "team")
+	client, err := NewVaultClient(VaultClientParams{
+		Address:    server.URL,
+		Token:      "root",
+		Namespace:  "team",
+		MountPath:  "kv",
+		PathPrefix: "hyperexecute",
+		Logger:     discardLogger(),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create client: %+v", err)
+	}
+	ctx := context.Background()
+	user := UserRef{User: "user"}
+
+	if err := client.Set(ctx, SetRequest{User: "user", Secrets: []Secret{{Key: "a", Value: "1"}}}); err != nil {
+		t.Fatalf("couldn't set secret: %+v", err)
+	}
+	if err := client.Set(ctx, SetRequest{User: "user", Secrets: []Secret{{Key: "b", Value: "2"}}}); err != nil {
+		t.Fatalf("couldn't set secret: %+v", err)
+	}
+	path := "hyperexecute/" + secretName("user")
+	stored, ok := fake.secret(path)
+	if !ok {
+		t.Fatalf("secret not stored at %s in mount kv", path)
+	}
+	if want := map[string]interface{}{"a": "1", "b": "2"}; !reflect.DeepEqual(stored, want) {
+		t.Fatalf("stored secrets %v, want merged %v", stored, want)
+	}
+
+	if err := client.Delete(ctx, DeleteRequest{User: "user", Keys: []string{"a"}}); err != nil {
+		t.Fatalf("couldn't delete key: %+v", err)
+	}
+	got, err := client.Get(ctx, user)
+	if err != nil {
+		t.Fatalf("couldn't get secrets: %+v", err)
+	}
+	if want := map[string]string{"b": "2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got secrets %v, want %v", got, want)
+	}
+
+	if err := client.Delete(ctx, DeleteRequest{User: "user", Keys: []string{"b"}}); err != nil {
+		t.Fatalf("couldn't delete last key: %+v", err)
+	}
+	if _, ok := fake.secret(path); ok {
+		t.Fatal("secret kept after deleting its last key")
+	}
+	if _, err := client.Get(ctx, user); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("got error %v for deleted secret, want ErrSecretNotFound", err)
+	}
+	if err := client.Delete(ctx, DeleteRequest{User: "user", Keys: []string{"b"}}); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("got error %v deleting missing secret, want ErrSecretNotFound", err)
+	}
+}
+
+func TestVaultWrongNamespace(t *testing.T) {
+	_, server := newFakeVault(t, "secret", "team")
+	client, err := NewVaultClient(VaultClientParams{
+		Address: server.URL,
+		Token:   "root",
+		Logger:  discardLogger(),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create client: %+v", err)
+	}
+	if _, err := client.Get(context.Background(), UserRef{User: "user"}); err == nil || errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("got error %v without namespace header, want a request error", err)
+	}
+}
+
+func TestVaultMissingToken(t *testing.T) {
+	_, server := newFakeVault(t, "secret", "")
+	if _, err := NewVaultClient(VaultClientParams{Address: server.URL, Logger: discardLogger()}); err == nil {
+		t.Fatal("created client without token or AppRole credentials")
+	}
+}
+
+func TestVaultAppRole(t *testing.T) {
+	fake, server := newFakeVault(t, "secret", "")
+	fake.appRoleMount = "ci"
+	fake.roleID, fake.secretID = "role", "secret"
+
+	if _, err := NewVaultClient(VaultClientParams{
+		Address:      server.URL,
+		RoleID:       "role",
+		SecretID:     "wrong",
+		AppRoleMount: "ci",
+		Logger:       discardLogger(),
+	}); err == nil {
+		t.Fatal("created client with invalid AppRole credentials")
+	}
+
+	client, err := NewVaultClient(VaultClientParams{
+		Address:      server.URL,
+		RoleID:       "role",
+		SecretID:     "secret",
+		AppRoleMount: "ci",
+		Logger:       discardLogger(),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create client: %+v", err)
+	}
+	if logins := fake.loginCount(); logins != 1 {
+		t.Fatalf("got %d logins after creating client, want 1", logins)
+	}
+	ctx := context.Background()
+	if err := client.Set(ctx, SetRequest{User: "user", Secrets: []Secret{{Key: "a", Value: "1"}}}); err != nil {
+		t.Fatalf("couldn't set secret: %+v", err)
+	}
+	if _, ok := fake.secret(secretName("user")); !ok {
+		t.Fatal("secret not stored in the default mount")
+	}
+
+	// The rejected token is renewed by logging in again and the request retried.
+	fake.revokeTokens()
+	value, err := client.GetValue(ctx, KeyRef{User: "user", Key: "a"})
+	if err != nil {
+		t.Fatalf("couldn't get secret after token expiry: %+v", err)
+	}
+	if value != "1" {
+		t.Fatalf("got value %q, want %q", value, "1")
+	}
+	if logins := fake.loginCount(); logins != 2 {
+		t.Fatalf("got %d logins after token expiry, want 2", logins)
+	}
+}
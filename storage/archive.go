@@ -0,0 +1,596 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ArchiveFormat is the format used to pack a directory into a single object
+type ArchiveFormat string
+
+const (
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	ArchiveZip   ArchiveFormat = "zip"
+)
+
+const archiveReadChunkSize = 8 << 20
+
+// ErrUnsafeArchivePath is returned when an archive entry would be extracted outside the target directory
+var ErrUnsafeArchivePath = errors.New("unsafe archive path")
+
+// archiveFormatFor returns format, or the one matching the key extension if
+// format is empty. Defaults to ArchiveTarGz.
+func archiveFormatFor(format ArchiveFormat, key string) (ArchiveFormat, error) {
+	switch format {
+	case ArchiveTarGz, ArchiveZip:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported archive format: %+v", format)
+	}
+	if strings.HasSuffix(strings.ToLower(key), ".zip") {
+		return ArchiveZip, nil
+	}
+	return ArchiveTarGz, nil
+}
+
+// UploadDirectory packs the content of dir into a single archive object. The
+// archive is streamed to the storage while it is being written.
+func UploadDirectory(ctx context.Context, s Storage, dir string, options *UploadOptions, format ArchiveFormat) error {
+	if options == nil {
+		return errors.New("missing upload options")
+	}
+	format, err := archiveFormatFor(format, options.Key)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%+v is not a directory", dir)
+	}
+
+	pr, pw := io.Pipe()
+	var wg sync.WaitGroup
+	var writeErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if format == ArchiveZip {
+			writeErr = writeZip(ctx, pw, dir)
+		} else {
+			writeErr = writeTarGz(ctx, pw, dir)
+		}
+		pw.CloseWithError(writeErr)
+	}()
+
+	err = s.Upload(ctx, options, pr)
+	// Unblock the writer if the upload stopped reading early.
+	pr.CloseWithError(errors.New("archive upload aborted"))
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return fmt.Errorf("error archiving directory: %+v since: %w", dir, writeErr)
+	}
+	return nil
+}
+
+// walkArchive calls fn for every entry of dir with its slash separated name
+func walkArchive(ctx context.Context, dir string, fn func(name, fullPath string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(dir, fullPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), fullPath, info)
+	})
+}
+
+func writeTarGz(ctx context.Context, w io.Writer, dir string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := walkArchive(ctx, dir, func(name, fullPath string, info fs.FileInfo) error {
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(fullPath); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(tw, fullPath)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeZip(ctx context.Context, w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+	err := walkArchive(ctx, dir, func(name, fullPath string, info fs.FileInfo) error {
+		isLink := info.Mode()&fs.ModeSymlink != 0
+		if !isLink && !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else if !isLink {
+			header.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		switch {
+		case isLink:
+			link, err := os.Readlink(fullPath)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, link)
+			return err
+		case info.IsDir():
+			return nil
+		}
+		return copyFile(fw, fullPath)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyFile(w io.Writer, fullPath string) error {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// DownloadAndExtract downloads the archive object and extracts it into dir.
+// Backends implementing ObjectReader are streamed, zip archives are read with
+// range reads when the backend also implements ObjectLister and are spooled
+// to a temporary file otherwise. Backends without ObjectReader only provide
+// the whole object through Download, it is extracted from memory then.
+// Entries resolving outside of dir are rejected with ErrUnsafeArchivePath.
+func DownloadAndExtract(ctx context.Context, s Storage, options *DownloadOptions, dir string, format ArchiveFormat) error {
+	if options == nil {
+		return errors.New("missing download options")
+	}
+	format, err := archiveFormatFor(format, options.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	x, err := newExtractor(dir)
+	if err != nil {
+		return err
+	}
+
+	if format == ArchiveZip {
+		readerAt, size, closeReader, err := openReaderAt(ctx, s, options)
+		if err != nil {
+			return err
+		}
+		defer closeReader()
+		zr, err := zip.NewReader(readerAt, size)
+		if err != nil {
+			return err
+		}
+		return x.extractZip(ctx, zr)
+	}
+
+	reader, err := openReader(ctx, s, options)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return x.extractTarGz(ctx, reader)
+}
+
+// openReader streams the object if the backend supports it, otherwise it is
+// downloaded in memory.
+func openReader(ctx context.Context, s Storage, options *DownloadOptions) (io.ReadCloser, error) {
+	if objectReader, ok := s.(ObjectReader); ok {
+		return objectReader.NewRangeReader(ctx, options, 0, -1)
+	}
+	data, err := s.Download(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// openReaderAt returns random access to the object through range reads if
+// the backend can stream and stat objects. Streamed objects of unknown size
+// are spooled to a temporary file removed by the returned close function.
+func openReaderAt(ctx context.Context, s Storage, options *DownloadOptions) (io.ReaderAt, int64, func(), error) {
+	objectReader, streams := s.(ObjectReader)
+	if lister, stats := s.(ObjectLister); streams && stats {
+		info, err := lister.StatObject(ctx, &ListOptions{Folder: options.Folder, Key: options.Key})
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return &rangeReaderAt{ctx: ctx, reader: objectReader, options: options, size: info.Size}, info.Size, func() {}, nil
+	}
+	reader, err := openReader(ctx, s, options)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer reader.Close()
+	if !streams {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return bytes.NewReader(data), int64(len(data)), func() {}, nil
+	}
+
+	spool, err := os.CreateTemp("", "archive-*.zip")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	closeSpool := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		closeSpool()
+		return nil, 0, nil, fmt.Errorf("error spooling archive to: %+v since: %w", spool.Name(), err)
+	}
+	return spool, size, closeSpool, nil
+}
+
+// rangeReaderAt implements io.ReaderAt with range reads of a chunk at a
+// time, caching the last chunk as archive readers issue many small reads.
+type rangeReaderAt struct {
+	ctx     context.Context
+	reader  ObjectReader
+	options *DownloadOptions
+	size    int64
+
+	mutex       sync.Mutex
+	chunk       []byte
+	chunkOffset int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for n < len(p) && off < r.size {
+		if off < r.chunkOffset || off >= r.chunkOffset+int64(len(r.chunk)) {
+			if err := r.fetch(off, int64(len(p)-n)); err != nil {
+				return n, err
+			}
+		}
+		copied := copy(p[n:], r.chunk[off-r.chunkOffset:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rangeReaderAt) fetch(off, want int64) error {
+	length := int64(archiveReadChunkSize)
+	if want > length {
+		length = want
+	}
+	if off+length > r.size {
+		length = r.size - off
+	}
+	reader, err := r.reader.NewRangeReader(r.ctx, r.options, off, length)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	chunk := make([]byte, length)
+	if _, err := io.ReadFull(reader, chunk); err != nil {
+		return err
+	}
+	r.chunk = chunk
+	r.chunkOffset = off
+	return nil
+}
+
+// extractor writes archive entries into dir, refusing any path which
+// resolves outside of it either lexically or through symlinks.
+type extractor struct {
+	dir     string
+	realDir string
+	// links are the extracted symlinks, checked again whenever a symlink is
+	// created since a later link may redirect the path of an earlier one
+	links []string
+}
+
+func newExtractor(dir string) (*extractor, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{dir: dir, realDir: realDir}, nil
+}
+
+func within(dir, target string) bool {
+	return target == dir || strings.HasPrefix(target, dir+string(filepath.Separator))
+}
+
+// targetPath returns the path an entry is extracted to after checking that
+// neither the name nor its existing parent directories escape dir.
+func (x *extractor) targetPath(name string) (string, error) {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeArchivePath, name)
+	}
+	target := filepath.Join(x.dir, filepath.FromSlash(name))
+	if !within(x.dir, target) || target == x.dir {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeArchivePath, name)
+	}
+
+	existing := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	realParent, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if !within(x.realDir, realParent) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeArchivePath, name)
+	}
+	return target, nil
+}
+
+func (x *extractor) writeDir(name string) error {
+	target, err := x.targetPath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0o755)
+}
+
+func (x *extractor) writeFile(name string, mode fs.FileMode, r io.Reader) error {
+	target, err := x.targetPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	// Never write through an existing symlink.
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0o644
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (x *extractor) writeSymlink(name, link string) error {
+	target, err := x.targetPath(name)
+	if err != nil {
+		return err
+	}
+	if link == "" || filepath.IsAbs(link) || path.IsAbs(link) || !within(x.dir, filepath.Join(filepath.Dir(target), link)) {
+		return fmt.Errorf("%w: symlink %q to %q", ErrUnsafeArchivePath, name, link)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := x.checkLink(target, link); err != nil {
+		return fmt.Errorf("%w: symlink %q to %q", err, name, link)
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Symlink(link, target); err != nil {
+		return err
+	}
+	// The new link may redirect an earlier one outside of dir, e.g. "a -> b/.."
+	// followed by "b -> ..", it is removed before any entry is written then.
+	if err := x.checkLinks(); err != nil {
+		os.Remove(target)
+		return fmt.Errorf("%w: symlink %q to %q redirects %+v", ErrUnsafeArchivePath, name, link, err)
+	}
+	x.links = append(x.links, target)
+	return nil
+}
+
+// checkLink checks that the link created at target resolves within dir when
+// following the symlinks already extracted, e.g. "a -> b/.." where b is a
+// link to "..". Missing path components are resolved lexically.
+func (x *extractor) checkLink(target, link string) error {
+	current, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	for _, part := range strings.Split(filepath.ToSlash(link), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, part)
+		if _, err := os.Lstat(next); err != nil {
+			current = next
+			continue
+		}
+		if current, err = filepath.EvalSymlinks(next); err != nil {
+			// Dangling links are resolved lexically as well.
+			current = next
+		}
+	}
+	if !within(x.realDir, current) {
+		return ErrUnsafeArchivePath
+	}
+	return nil
+}
+
+// checkLinks checks that the extracted symlinks still resolve within dir.
+// Links replaced by later entries are skipped.
+func (x *extractor) checkLinks() error {
+	for _, target := range x.links {
+		link, err := os.Readlink(target)
+		if err != nil {
+			continue
+		}
+		if err := x.checkLink(target, link); err != nil {
+			return fmt.Errorf("symlink %q to %q", target, link)
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractTarGz(ctx context.Context, r io.Reader) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(header.Name, "/")
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.writeDir(name)
+		case tar.TypeReg:
+			err = x.writeFile(name, header.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = x.writeSymlink(name, header.Linkname)
+		default:
+			err = fmt.Errorf("unsupported archive entry: %q of type %c", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractZip(ctx context.Context, zr *zip.Reader) error {
+	for _, file := range zr.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := x.extractZipFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractZipFile(file *zip.File) error {
+	name := strings.TrimSuffix(file.Name, "/")
+	mode := file.Mode()
+	if mode.IsDir() {
+		return x.writeDir(name)
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if mode&fs.ModeSymlink != 0 {
+		link, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		return x.writeSymlink(name, string(link))
+	}
+	if !mode.IsRegular() {
+		return fmt.Errorf("unsupported archive entry: %q with mode %+v", file.Name, mode)
+	}
+	return x.writeFile(name, mode, rc)
+}
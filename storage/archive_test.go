@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive, a symlink if link is set, a
+// directory if the name ends with "/" and a file otherwise
+type tarEntry struct {
+	name string
+	link string
+	data string
+}
+
+func newTarGz(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(entry.data))}
+		switch {
+		case entry.link != "":
+			header = &tar.Header{Name: entry.name, Mode: 0o777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+		case entry.name[len(entry.name)-1] == '/':
+			header = &tar.Header{Name: entry.name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// extractTestTarGz extracts the entries into the "out" directory of a temporary
+// directory, and returns the output directory
+func extractTestTarGz(t *testing.T, entries []tarEntry) (string, error) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "out")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	x, err := newExtractor(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, x.extractTarGz(context.Background(), newTarGz(t, entries))
+}
+
+// assertNoEscape checks that no extracted path resolves outside of dir
+func assertNoEscape(t *testing.T, dir string) {
+	t.Helper()
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk(dir, func(name string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return nil
+		}
+		if !within(realDir, resolved) {
+			t.Errorf("%s resolves outside of the extraction directory to %s", name, resolved)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractRejectsUnsafePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"parent file", []tarEntry{{name: "../evil", data: "x"}}},
+		{"nested parent file", []tarEntry{{name: "a/../../evil", data: "x"}}},
+		{"absolute file", []tarEntry{{name: "/tmp/evil", data: "x"}}},
+		{"parent symlink", []tarEntry{{name: "evil", link: "../"}}},
+		{"nested parent symlink", []tarEntry{{name: "a/evil", link: "../../x"}}},
+		{"absolute symlink", []tarEntry{{name: "evil", link: "/etc"}}},
+		{"chained symlinks", []tarEntry{
+			{name: "sub/"},
+			{name: "sub/s2", link: ".."},
+			{name: "s3", link: "sub/s2/.."},
+		}},
+		{"chained symlinks in reverse order", []tarEntry{
+			{name: "sub/"},
+			{name: "s3", link: "sub/s2/.."},
+			{name: "sub/s2", link: ".."},
+		}},
+		{"file through symlink", []tarEntry{
+			{name: "up", link: "."},
+			{name: "up/../../evil", data: "x"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := extractTestTarGz(t, test.entries)
+			if !errors.Is(err, ErrUnsafeArchivePath) {
+				t.Fatalf("got error %v, want ErrUnsafeArchivePath", err)
+			}
+			assertNoEscape(t, dir)
+			if _, err := os.Lstat(filepath.Join(filepath.Dir(dir), "evil")); err == nil {
+				t.Fatal("file written outside of the extraction directory")
+			}
+		})
+	}
+}
+
+func TestExtractSymlinks(t *testing.T) {
+	dir, err := extractTestTarGz(t, []tarEntry{
+		{name: "lib/"},
+		{name: "lib/a.txt", data: "a"},
+		{name: "current", link: "lib"},
+		{name: "docs/readme", link: "../lib/a.txt"},
+		{name: "dangling", link: "later/b.txt"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't extract archive: %+v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "docs", "readme"))
+	if err != nil || string(data) != "a" {
+		t.Fatalf("got %q, %v reading through symlink, want %q", data, err, "a")
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "current")); err != nil || link != "lib" {
+		t.Fatalf("got link %q, %v, want %q", link, err, "lib")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "dangling")); err != nil {
+		t.Fatalf("dangling symlink not extracted: %+v", err)
+	}
+	assertNoEscape(t, dir)
+}
+
+func TestExtractRefusesRedirectingSymlink(t *testing.T) {
+	dir, err := extractTestTarGz(t, []tarEntry{
+		{name: "sub/"},
+		{name: "s3", link: "sub/s2/.."},
+		{name: "sub/s2", link: ".."},
+		{name: "s3/evil", data: "x"},
+	})
+	if !errors.Is(err, ErrUnsafeArchivePath) {
+		t.Fatalf("got error %v, want ErrUnsafeArchivePath", err)
+	}
+	// The redirecting link is never left in place.
+	if _, err := os.Lstat(filepath.Join(dir, "sub", "s2")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("redirecting symlink was created: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "s3")); err != nil || link != "sub/s2/.." {
+		t.Fatalf("got link %q, %v, want the earlier safe link", link, err)
+	}
+	assertNoEscape(t, dir)
+}
+
+// downloadOnly is a Storage which only supports Download
+type downloadOnly struct {
+	Storage
+	data []byte
+}
+
+func (d downloadOnly) Download(ctx context.Context, options *DownloadOptions) ([]byte, error) {
+	return d.data, nil
+}
+
+// streamOnly is an ObjectReader without ObjectLister
+type streamOnly struct {
+	Storage
+	data []byte
+}
+
+func (s streamOnly) NewRangeReader(ctx context.Context, options *DownloadOptions, offset, length int64) (io.ReadCloser, error) {
+	if offset != 0 || length >= 0 {
+		return nil, errors.New("unexpected range read")
+	}
+	return io.NopCloser(bytes.NewReader(s.data)), nil
+}
+
+func TestDownloadAndExtractWithoutOptionalInterfaces(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	archive := func(write func(context.Context, io.Writer, string) error) []byte {
+		buf := &bytes.Buffer{}
+		if err := write(context.Background(), buf, src); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name   string
+		s      Storage
+		format ArchiveFormat
+	}{
+		{"tar.gz from download", downloadOnly{data: archive(writeTarGz)}, ArchiveTarGz},
+		{"tar.gz from stream", streamOnly{data: archive(writeTarGz)}, ArchiveTarGz},
+		{"zip from download", downloadOnly{data: archive(writeZip)}, ArchiveZip},
+		{"zip spooled from stream", streamOnly{data: archive(writeZip)}, ArchiveZip},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spoolDir := t.TempDir()
+			t.Setenv("TMPDIR", spoolDir)
+			dir := filepath.Join(t.TempDir(), "out")
+			err := DownloadAndExtract(context.Background(), test.s, &DownloadOptions{Key: "archive"}, dir, test.format)
+			if err != nil {
+				t.Fatalf("DownloadAndExtract: %+v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "sub", "a.txt"))
+			if err != nil || string(data) != "a" {
+				t.Fatalf("got %q, %v, want %q", data, err, "a")
+			}
+			// Spooled archives are removed once extracted.
+			if spooled, _ := os.ReadDir(spoolDir); len(spooled) != 0 {
+				t.Fatalf("spool files left behind: %v", spooled)
+			}
+		})
+	}
+}
@@ -0,0 +1,591 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+)
+
+// azureClient maps the first segment of object keys, usually the Folder, to
+// a container and the rest of the key to the blob name.
+type azureClient struct {
+	logger           *log.Logger
+	client           *azblob.Client
+	credential       *azblob.SharedKeyCredential
+	createContainers bool
+	cdn              *cdnClient
+	retry            RetryPolicy
+	limiter          *BandwidthLimiter
+	// sasProtocol allows http SAS URLs for emulators
+	sasProtocol sas.Protocol
+}
+
+type AzureParams struct {
+	// AccountName and AccountKey are the shared key credentials of the storage account
+	AccountName string
+	AccountKey  string
+	// ConnectionString overrides the account name, key and service URL,
+	// e.g. the AZURE_STORAGE_CONNECTION_STRING of the account or an emulator.
+	ConnectionString string
+	// ServiceURL overrides the blob service URL, e.g. http://127.0.0.1:10000/devstoreaccount1
+	// for a local emulator. Defaults to https://<account>.blob.core.windows.net/.
+	ServiceURL string
+	// CreateContainers creates missing containers on upload
+	CreateContainers bool
+	Logger           *log.Logger
+	// CDN configures DownloadFromCdn, if nil objects are fetched via SAS URLs
+	CDN *CDNConfig
+	// Retry configures retries of all blob operations, if nil DefaultRetryPolicy is used
+	Retry *RetryPolicy
+	// Limiter throttles uploads and downloads of the client
+	Limiter *BandwidthLimiter
+	// HTTPClient sends the blob service requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func newAzureClient(params AzureParams) (Storage, error) {
+	if params.ConnectionString != "" {
+		if err := parseAzureConnectionString(params.ConnectionString, &params); err != nil {
+			return nil, err
+		}
+	}
+	if params.AccountName == "" || params.AccountKey == "" {
+		return nil, errors.New("missing azure storage account name or key")
+	}
+	if params.Logger == nil {
+		params.Logger = log.Default()
+	}
+	if params.ServiceURL == "" {
+		params.ServiceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", params.AccountName)
+	}
+	serviceURL, err := url.Parse(params.ServiceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure blob service url: %+v since: %+v", params.ServiceURL, err)
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(params.AccountName, params.AccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure storage account key since: %+v", err)
+	}
+	options := &azblob.ClientOptions{}
+	// A negative MaxRetries turns off the SDK retry policy, requests are
+	// retried by RetryPolicy instead.
+	options.Retry = policy.RetryOptions{MaxRetries: -1}
+	if params.HTTPClient != nil {
+		options.Transport = params.HTTPClient
+	}
+	client, err := azblob.NewClientWithSharedKeyCredential(params.ServiceURL, credential, options)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create azure blob client since: %+v", err)
+	}
+
+	retry := newRetryPolicy(params.Retry)
+	if params.Retry == nil || params.Retry.Retryable == nil {
+		retry.Retryable = isAzureRetryableErr
+	}
+	cdn, err := newCdnClient(params.CDN, retry)
+	if err != nil {
+		return nil, err
+	}
+	a := azureClient{
+		logger:           params.Logger,
+		client:           client,
+		credential:       credential,
+		createContainers: params.CreateContainers,
+		cdn:              cdn,
+		retry:            retry,
+		limiter:          params.Limiter,
+		sasProtocol:      sas.ProtocolHTTPS,
+	}
+	if serviceURL.Scheme == "http" {
+		a.sasProtocol = sas.ProtocolHTTPSandHTTP
+	}
+	return a, nil
+}
+
+// parseAzureConnectionString sets the account and service URL of params from
+// a connection string like "DefaultEndpointsProtocol=https;AccountName=...;AccountKey=..."
+func parseAzureConnectionString(connectionString string, params *AzureParams) error {
+	values := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimRight(connectionString, ";"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return errors.New("invalid azure storage connection string")
+		}
+		values[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	params.AccountName = values["accountname"]
+	params.AccountKey = values["accountkey"]
+	if endpoint := values["blobendpoint"]; endpoint != "" {
+		params.ServiceURL = endpoint
+		return nil
+	}
+	if params.AccountName == "" {
+		return errors.New("missing AccountName in azure storage connection string")
+	}
+	protocol, suffix := values["defaultendpointsprotocol"], values["endpointsuffix"]
+	if protocol == "" {
+		protocol = "https"
+	}
+	if suffix == "" {
+		suffix = "core.windows.net"
+	}
+	params.ServiceURL = fmt.Sprintf("%s://%s.blob.%s/", protocol, params.AccountName, suffix)
+	return nil
+}
+
+// NewAzureClient returns new storage client for the given Azure storage account params
+func NewAzureClient(params AzureParams) (Storage, error) {
+	return newAzureClient(params)
+}
+
+// blobKey returns the container and blob name of the object for given folder and key
+func blobKey(folder, key string) (containerName, blobName string, err error) {
+	fullKey, err := ObjectKey(folder, key)
+	if err != nil {
+		return "", "", err
+	}
+	containerName, blobName, ok := strings.Cut(fullKey, DirDelim)
+	if !ok {
+		return "", "", fmt.Errorf("%w: %+v has no container", ErrInvalidKey, fullKey)
+	}
+	return containerName, blobName, nil
+}
+
+// blobPrefix returns the container and blob name prefix for given folder and prefix
+func blobPrefix(folder, prefix string) (containerName, blobPrefix string, err error) {
+	fullPrefix, err := PrefixKey(folder, prefix)
+	if err != nil {
+		return "", "", err
+	}
+	containerName, blobPrefix, _ = strings.Cut(fullPrefix, DirDelim)
+	if containerName == "" {
+		return "", "", fmt.Errorf("%w: missing container", ErrInvalidKey)
+	}
+	return containerName, blobPrefix, nil
+}
+
+// Download gets the content of given blob and returns []byte
+func (a azureClient) Download(ctx context.Context, options *DownloadOptions) ([]byte, error) {
+	if options == nil {
+		return nil, errors.New("missing download options")
+	}
+	containerName, blobName, err := blobKey(options.Folder, options.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	a.logger.Printf("Downloading blob: %+v from Azure Container: %+v...", blobName, containerName)
+
+	transfer := newTransfer(options.Progress, options.Limiter, a.limiter)
+	var data []byte
+	err = a.retry.Do(ctx, true, func(ctx context.Context) error {
+		res, err := a.client.DownloadStream(ctx, containerName, blobName, nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		total := int64(-1)
+		if res.ContentLength != nil {
+			total = *res.ContentLength
+		}
+		data, err = io.ReadAll(transfer.reader(ctx, res.Body, total))
+		return err
+	})
+	if err != nil {
+		return nil, newError("downloading file", containerName+DirDelim+blobName, err, azureErrorKind)
+	}
+	return data, nil
+}
+
+// NewRangeReader streams length bytes of the blob from offset, a negative length reads until the end
+func (a azureClient) NewRangeReader(ctx context.Context, options *DownloadOptions, offset, length int64) (io.ReadCloser, error) {
+	if options == nil {
+		return nil, errors.New("missing download options")
+	}
+	containerName, blobName, err := blobKey(options.Folder, options.Key)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	a.logger.Printf("Streaming blob: %+v from Azure Container: %+v...", blobName, containerName)
+	// A zero count reads until the end of the blob.
+	blobRange := blob.HTTPRange{Offset: offset}
+	if length > 0 {
+		blobRange.Count = length
+	}
+	var res azblob.DownloadStreamResponse
+	err = a.retry.Do(ctx, true, func(ctx context.Context) error {
+		res, err = a.client.DownloadStream(ctx, containerName, blobName, &azblob.DownloadStreamOptions{Range: blobRange})
+		return err
+	})
+	if err != nil {
+		return nil, newError("streaming file", containerName+DirDelim+blobName, err, azureErrorKind)
+	}
+	body := errorReadCloser{ReadCloser: res.Body, op: "streaming file", key: containerName + DirDelim + blobName, kind: azureErrorKind}
+	transfer := newTransfer(options.Progress, options.Limiter, a.limiter)
+	if transfer == nil {
+		return body, nil
+	}
+	total := int64(-1)
+	if res.ContentLength != nil {
+		total = *res.ContentLength
+	}
+	return transferReadCloser{Reader: transfer.reader(ctx, body, total), closer: body}, nil
+}
+
+// Upload uploads the content of the reader as a block blob
+func (a azureClient) Upload(ctx context.Context, options *UploadOptions, r io.Reader) error {
+	if options == nil {
+		return errors.New("missing upload options")
+	}
+	containerName, blobName, err := blobKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	a.logger.Printf("Uploading blob: %+v to Azure Container: %+v...", blobName, containerName)
+
+	// Uploads can only be retried if the reader can be rewound.
+	retry := a.retry
+	seeker, rewindable := r.(io.Seeker)
+	var start int64
+	if rewindable {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			rewindable = false
+		}
+	}
+	if !rewindable {
+		retry.MaxAttempts = 1
+	}
+	transfer := newTransfer(options.Progress, options.Limiter, a.limiter)
+	total := int64(-1)
+	if size, ok := readerSize(r); ok {
+		total = size
+	}
+	// Metadata names are case insensitive in Azure hence lower cased, so
+	// that listing and properties return the same names.
+	var metadata map[string]*string
+	if len(options.Metadata) > 0 {
+		metadata = make(map[string]*string, len(options.Metadata))
+		for name, value := range options.Metadata {
+			value := value
+			metadata[strings.ToLower(name)] = &value
+		}
+	}
+
+	attempt := 0
+	createdContainer := false
+	err = retry.Do(ctx, false, func(ctx context.Context) error {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		attempt++
+
+		_, err := a.client.UploadStream(ctx, containerName, blobName, transfer.reader(ctx, r, total), &azblob.UploadStreamOptions{
+			Metadata: metadata,
+		})
+		if !a.createContainers || createdContainer || !bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			return err
+		}
+
+		// The blob is uploaded again once the container exists.
+		a.logger.Printf("Creating Azure Container: %+v...", containerName)
+		_, err = a.client.CreateContainer(ctx, containerName, nil)
+		if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+			return err
+		}
+		createdContainer = true
+		if !rewindable {
+			return fmt.Errorf("couldn't upload blob: %+v since container %+v didn't exist", blobName, containerName)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = a.client.UploadStream(ctx, containerName, blobName, transfer.reader(ctx, r, total), &azblob.UploadStreamOptions{
+			Metadata: metadata,
+		})
+		return err
+	})
+	return newError("uploading file", containerName+DirDelim+blobName, err, azureErrorKind)
+}
+
+// Exists checks if the given blob exists
+func (a azureClient) Exists(ctx context.Context, options *ListOptions) (bool, error) {
+	_, err := a.StatObject(ctx, options)
+	if err == nil {
+		return true, nil
+	}
+	if a.IsNotFoundErr(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ListKeys lists the blob names and, unless recursive, virtual directories
+// for given options. Keys are prefixed by the container like ObjectKey.
+func (a azureClient) ListKeys(ctx context.Context, options *ListOptions) (keys []string, err error) {
+	err = a.listObjects(ctx, options, func() { keys = nil }, func(object ObjectInfo) {
+		keys = append(keys, object.Key)
+	})
+	return keys, err
+}
+
+// ListObjects lists the blobs for given options along with their attributes
+func (a azureClient) ListObjects(ctx context.Context, options *ListOptions) (objects []ObjectInfo, err error) {
+	err = a.listObjects(ctx, options, func() { objects = nil }, func(object ObjectInfo) {
+		objects = append(objects, object)
+	})
+	return objects, err
+}
+
+func (a azureClient) listObjects(ctx context.Context, options *ListOptions, reset func(), fn func(object ObjectInfo)) error {
+	if options == nil {
+		return errors.New("missing list options")
+	}
+	containerName, prefix, err := blobPrefix(options.Folder, options.Prefix)
+	if err != nil {
+		return err
+	}
+
+	a.logger.Printf("Iterating for prefix: %+v in Azure Container: %+v...", prefix, containerName)
+	containerClient := a.client.ServiceClient().NewContainerClient(containerName)
+	include := container.ListBlobsInclude{Metadata: true}
+	err = a.retry.Do(ctx, true, func(ctx context.Context) error {
+		reset()
+		if options.Recursive {
+			pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix, Include: include})
+			for pager.More() {
+				page, err := pager.NextPage(ctx)
+				if err != nil {
+					return err
+				}
+				for _, item := range page.Segment.BlobItems {
+					fn(newBlobInfo(containerName, item))
+				}
+			}
+			return nil
+		}
+
+		pager := containerClient.NewListBlobsHierarchyPager(DirDelim, &container.ListBlobsHierarchyOptions{Prefix: &prefix, Include: include})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, dir := range page.Segment.BlobPrefixes {
+				fn(ObjectInfo{Key: containerName + DirDelim + *dir.Name, IsDir: true})
+			}
+			for _, item := range page.Segment.BlobItems {
+				fn(newBlobInfo(containerName, item))
+			}
+		}
+		return nil
+	})
+	return newError("listing prefix", containerName+DirDelim+prefix, err, azureErrorKind)
+}
+
+func newBlobInfo(containerName string, item *container.BlobItem) ObjectInfo {
+	info := ObjectInfo{Key: containerName + DirDelim + *item.Name, Metadata: azureMetadata(item.Metadata)}
+	if props := item.Properties; props != nil {
+		info.Size = derefOr(props.ContentLength, 0)
+		info.ContentType = derefOr(props.ContentType, "")
+		info.Created = derefOr(props.CreationTime, time.Time{})
+		info.Updated = derefOr(props.LastModified, time.Time{})
+		info.Version = string(derefOr(props.ETag, ""))
+	}
+	return info
+}
+
+func azureMetadata(metadata map[string]*string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		values[strings.ToLower(name)] = derefOr(value, "")
+	}
+	return values
+}
+
+func derefOr[T any](value *T, fallback T) T {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+// StatObject returns the attributes of the blob for given options
+func (a azureClient) StatObject(ctx context.Context, options *ListOptions) (info ObjectInfo, err error) {
+	if options == nil {
+		return info, errors.New("missing list options")
+	}
+	containerName, blobName, err := blobKey(options.Folder, options.Key)
+	if err != nil {
+		return info, err
+	}
+	blobClient := a.client.ServiceClient().NewContainerClient(containerName).NewBlobClient(blobName)
+	err = a.retry.Do(ctx, true, func(ctx context.Context) error {
+		props, err := blobClient.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		info = ObjectInfo{
+			Key:         containerName + DirDelim + blobName,
+			Size:        derefOr(props.ContentLength, 0),
+			ContentType: derefOr(props.ContentType, ""),
+			Created:     derefOr(props.CreationTime, time.Time{}),
+			Updated:     derefOr(props.LastModified, time.Time{}),
+			Metadata:    azureMetadata(props.Metadata),
+			Version:     string(derefOr(props.ETag, "")),
+		}
+		return nil
+	})
+	return info, newError("getting attributes of file", containerName+DirDelim+blobName, err, azureErrorKind)
+}
+
+// GetTempTokenForDownload returns a read only SAS URL of the blob
+func (a azureClient) GetTempTokenForDownload(ctx context.Context, options *DownloadOptions) (string, error) {
+	if options == nil {
+		return "", errors.New("missing download options")
+	}
+	containerName, blobName, err := blobKey(options.Folder, options.Key)
+	if err != nil {
+		return "", err
+	}
+
+	a.logger.Printf("Getting SAS token for blob: %+v from Azure Container: %+v...", blobName, containerName)
+
+	query, err := sas.BlobSignatureValues{
+		Protocol:      a.sasProtocol,
+		ExpiryTime:    time.Now().UTC().Add(preSignURLExpiryDuration),
+		Permissions:   (&sas.BlobPermissions{Read: true}).String(),
+		ContainerName: containerName,
+		BlobName:      blobName,
+	}.SignWithSharedKey(a.credential)
+	if err != nil {
+		return "", newError("getting temp token for file", containerName+DirDelim+blobName, err, azureErrorKind)
+	}
+	blobURL := a.client.ServiceClient().NewContainerClient(containerName).NewBlobClient(blobName).URL()
+	return blobURL + "?" + query.Encode(), nil
+}
+
+// DownloadFromCdn downloads the blob via the configured CDN, falling back
+// to the SAS URL when no CDN base url is configured.
+func (a azureClient) DownloadFromCdn(ctx context.Context, options *DownloadOptions) ([]byte, error) {
+	if options == nil {
+		return nil, errors.New("missing download options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return nil, err
+	}
+	if a.cdn.baseURL == nil {
+		sourcePath, err := a.GetTempTokenForDownload(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		a.logger.Printf("Downloading data from Azure Blob Storage...")
+		transfer := newTransfer(options.Progress, options.Limiter, a.limiter)
+		output, err := a.cdn.fetch(ctx, transfer, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, sourcePath, http.NoBody)
+		})
+		return output, newError("downloading file", key, err, azureErrorKind)
+	}
+
+	a.logger.Printf("Downloading file: %+v from CDN: %+v...", key, a.cdn.baseURL.Host)
+	transfer := newTransfer(options.Progress, options.Limiter, a.limiter)
+	output, err := a.cdn.fetch(ctx, transfer, func(ctx context.Context) (*http.Request, error) {
+		return a.cdn.newRequest(ctx, key)
+	})
+	if err != nil {
+		return output, newError("downloading file", key, err, azureErrorKind)
+	}
+	return output, nil
+}
+
+func (a azureClient) IsNotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, ErrNotFound) || azureErrorKind(err) == ErrNotFound
+}
+
+// azureErrorKind maps Azure Blob errors to the sentinel errors of the package
+func azureErrorKind(err error) error {
+	switch {
+	case bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound, bloberror.ResourceNotFound):
+		return ErrNotFound
+	case bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ContainerAlreadyExists, bloberror.ResourceAlreadyExists):
+		return ErrAlreadyExists
+	case bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.SourceConditionNotMet, bloberror.TargetConditionNotMet):
+		return ErrPreconditionFailed
+	case bloberror.HasCode(err, bloberror.AuthenticationFailed, bloberror.AuthorizationFailure,
+		bloberror.AuthorizationPermissionMismatch, bloberror.InsufficientAccountPermissions):
+		return ErrPermissionDenied
+	case bloberror.HasCode(err, bloberror.ServerBusy):
+		return ErrQuotaExceeded
+	case bloberror.HasCode(err, bloberror.MD5Mismatch, bloberror.CRC64Mismatch):
+		return ErrChecksumMismatch
+	}
+	// Responses to HEAD requests have no body to carry the error code.
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return statusErrorKind(respErr.StatusCode)
+	}
+	return nil
+}
+
+// isAzureRetryableErr extends IsRetryableErr with the status codes of azure
+// response errors.
+func isAzureRetryableErr(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return isRetryableStatus(respErr.StatusCode)
+	}
+	return IsRetryableErr(err)
+}
+
+func (a azureClient) Delete(ctx context.Context, options *DeleteOptions) error {
+	if options == nil {
+		return errors.New("missing delete options")
+	}
+	containerName, blobName, err := blobKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	a.logger.Printf("Deleting blob: %+v from Azure Container: %+v...", blobName, containerName)
+
+	var deleteOptions *azblob.DeleteBlobOptions
+	if options.IfVersion != "" {
+		etag := azcore.ETag(options.IfVersion)
+		deleteOptions = &azblob.DeleteBlobOptions{AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: &etag},
+		}}
+	}
+	err = a.retry.DoDelete(ctx, true, a.IsNotFoundErr, func(ctx context.Context) error {
+		_, err := a.client.DeleteBlob(ctx, containerName, blobName, deleteOptions)
+		return err
+	})
+	return newError("deleting file", containerName+DirDelim+blobName, err, azureErrorKind)
+}
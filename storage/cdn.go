@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCdnTimeout = 30 * time.Second
+	cdnCookieName     = "Cloud-CDN-Cookie"
+)
+
+// CDNConfig configures DownloadFromCdn to fetch objects through Cloud CDN or
+// a custom domain in front of the bucket instead of a storage signed URL.
+type CDNConfig struct {
+	// BaseURL is the CDN origin, e.g. https://cdn.example.com. Objects are
+	// fetched from BaseURL/<folder>/<key>. If empty, a storage signed URL is used.
+	BaseURL string
+	// KeyName and Key are the Cloud CDN signing key name and its base64url
+	// encoded value. If KeyName is empty, requests are sent unsigned.
+	KeyName string
+	Key     string
+	// UseSignedCookies signs requests with a Cloud-CDN-Cookie scoped to the
+	// object URL instead of signing the URL query.
+	UseSignedCookies bool
+	// Expiry is the validity of the generated signature. Defaults to preSignURLExpiryDuration.
+	Expiry time.Duration
+	// Timeout bounds each attempt. Defaults to 30 seconds.
+	Timeout time.Duration
+	// HTTPClient is used for CDN requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type cdnClient struct {
+	baseURL          *url.URL
+	keyName          string
+	key              []byte
+	useSignedCookies bool
+	expiry           time.Duration
+	timeout          time.Duration
+	httpClient       *http.Client
+	retry            RetryPolicy
+}
+
+// httpStatusError is returned for non 200 responses of plain HTTP downloads
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("non-20x status code %d", e.StatusCode)
+}
+
+// Unwrap returns the sentinel error matching the status code, if any
+func (e *httpStatusError) Unwrap() error {
+	return statusErrorKind(e.StatusCode)
+}
+
+func newCdnClient(config *CDNConfig, retry RetryPolicy) (*cdnClient, error) {
+	c := &cdnClient{
+		expiry:     preSignURLExpiryDuration,
+		timeout:    defaultCdnTimeout,
+		httpClient: http.DefaultClient,
+		retry:      retry,
+	}
+	if config == nil {
+		return c, nil
+	}
+
+	if config.BaseURL != "" {
+		baseURL, err := url.Parse(strings.TrimSuffix(config.BaseURL, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CDN base url: %+v since: %+v", config.BaseURL, err)
+		}
+		if baseURL.Scheme == "" || baseURL.Host == "" {
+			return nil, fmt.Errorf("CDN base url: %+v must include scheme and host", config.BaseURL)
+		}
+		c.baseURL = baseURL
+	}
+	if config.KeyName != "" {
+		if c.baseURL == nil {
+			return nil, errors.New("CDN signing key requires a CDN base url")
+		}
+		key, err := base64.URLEncoding.DecodeString(config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode CDN signing key: %+v since: %+v", config.KeyName, err)
+		}
+		c.keyName = config.KeyName
+		c.key = key
+		c.useSignedCookies = config.UseSignedCookies
+	}
+	if config.Expiry > 0 {
+		c.expiry = config.Expiry
+	}
+	if config.Timeout > 0 {
+		c.timeout = config.Timeout
+	}
+	if config.HTTPClient != nil {
+		c.httpClient = config.HTTPClient
+	}
+	return c, nil
+}
+
+// objectURL returns the CDN URL for the given object key
+func (c *cdnClient) objectURL(key string) string {
+	u := *c.baseURL
+	u.Path = c.baseURL.Path + DirDelim + key
+	return u.String()
+}
+
+// signURL appends the Cloud CDN signed URL query parameters to rawURL
+func (c *cdnClient) signURL(rawURL string, expires time.Time) string {
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	toSign := fmt.Sprintf("%s%sExpires=%d&KeyName=%s", rawURL, sep, expires.Unix(), c.keyName)
+	return toSign + "&Signature=" + c.sign(toSign)
+}
+
+// signCookie returns the Cloud CDN signed cookie granting access to urlPrefix
+func (c *cdnClient) signCookie(urlPrefix string, expires time.Time) *http.Cookie {
+	toSign := fmt.Sprintf("URLPrefix=%s:Expires=%d:KeyName=%s",
+		base64.URLEncoding.EncodeToString([]byte(urlPrefix)), expires.Unix(), c.keyName)
+	return &http.Cookie{
+		Name:  cdnCookieName,
+		Value: toSign + ":Signature=" + c.sign(toSign),
+	}
+}
+
+func (c *cdnClient) sign(value string) string {
+	mac := hmac.New(sha1.New, c.key)
+	mac.Write([]byte(value))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newRequest builds the signed CDN request for the given object key
+func (c *cdnClient) newRequest(ctx context.Context, key string) (*http.Request, error) {
+	target := c.objectURL(key)
+	expires := time.Now().Add(c.expiry)
+	if c.keyName != "" && !c.useSignedCookies {
+		target = c.signURL(target, expires)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if c.keyName != "" && c.useSignedCookies {
+		req.AddCookie(c.signCookie(c.objectURL(key), expires))
+	}
+	return req, nil
+}
+
+// fetch performs a GET for the request built by newReq, retrying transient
+// failures as per the retry policy.
+func (c *cdnClient) fetch(ctx context.Context, transfer *transfer, newReq func(ctx context.Context) (*http.Request, error)) (output []byte, err error) {
+	err = c.retry.Do(ctx, true, func(ctx context.Context) error {
+		output, err = c.fetchOnce(ctx, transfer, newReq)
+		return err
+	})
+	return output, err
+}
+
+func (c *cdnClient) fetchOnce(ctx context.Context, transfer *transfer, newReq func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := newReq(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		output, _ := io.ReadAll(res.Body)
+		return output, &httpStatusError{StatusCode: res.StatusCode}
+	}
+	output, err := io.ReadAll(transfer.reader(ctx, res.Body, res.ContentLength))
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
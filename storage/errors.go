@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Errors of storage operations, backends map their provider errors onto
+// them so that callers can check errors with errors.Is whatever the backend.
+var (
+	// ErrNotFound is returned for missing objects, buckets or containers
+	ErrNotFound = errors.New("storage object not found")
+	// ErrAlreadyExists is returned when creating an object or container which exists
+	ErrAlreadyExists = errors.New("storage object already exists")
+	// ErrPreconditionFailed is returned when a conditional operation's precondition doesn't hold
+	ErrPreconditionFailed = errors.New("storage precondition failed")
+	// ErrPermissionDenied is returned when the credentials don't grant access to the object
+	ErrPermissionDenied = errors.New("storage permission denied")
+	// ErrQuotaExceeded is returned when a provider quota or rate limit, or the
+	// folder's quota of a quota enforcing Storage, is exceeded
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrChecksumMismatch is returned when the transferred data doesn't match its checksum
+	ErrChecksumMismatch = errors.New("storage checksum mismatch")
+)
+
+// Error describes a failed storage operation. It matches its Kind and the
+// provider error with errors.Is and errors.As.
+type Error struct {
+	// Op is the failed operation, e.g. "downloading file"
+	Op  string
+	Key string
+	// Kind is one of the sentinel errors of the package, nil if the
+	// provider error couldn't be classified
+	Kind error
+	// Err is the provider error
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error %s: %+v since: %+v", e.Op, e.Key, e.Err)
+}
+
+// Unwrap returns the kind and the provider error
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newError wraps the provider error of an operation on key, classified
+// with kind. Errors which are already classified are returned as is.
+func newError(op, key string, err error, kind func(err error) error) error {
+	if err == nil {
+		return nil
+	}
+	var storageErr *Error
+	if errors.As(err, &storageErr) || errors.Is(err, ErrInvalidKey) {
+		return err
+	}
+	return &Error{Op: op, Key: key, Kind: kind(err), Err: err}
+}
+
+// errorReadCloser classifies the errors of streamed reads like newError
+type errorReadCloser struct {
+	io.ReadCloser
+	op, key string
+	kind    func(err error) error
+}
+
+func (r errorReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = newError(r.op, r.key, err, r.kind)
+	}
+	return n, err
+}
+
+// statusErrorKind maps HTTP status codes to the sentinel errors
+func statusErrorKind(code int) error {
+	switch code {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrAlreadyExists
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrPermissionDenied
+	case http.StatusTooManyRequests:
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// grpcErrorKind maps gRPC status codes to the sentinel errors
+func grpcErrorKind(code codes.Code) error {
+	switch code {
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.AlreadyExists:
+		return ErrAlreadyExists
+	case codes.FailedPrecondition:
+		return ErrPreconditionFailed
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return ErrPermissionDenied
+	case codes.ResourceExhausted:
+		return ErrQuotaExceeded
+	case codes.DataLoss:
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type errorKindTest struct {
+	name string
+	err  error
+	want error
+}
+
+func testErrorKind(t *testing.T, kind func(err error) error, tests []errorKindTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := kind(test.err); got != test.want {
+				t.Errorf("kind of %v = %v, want %v", test.err, got, test.want)
+			}
+			wrapped := newError("testing", "key", test.err, kind)
+			if test.want != nil && !errors.Is(wrapped, test.want) {
+				t.Errorf("%v doesn't match %v", wrapped, test.want)
+			}
+			if !errors.Is(wrapped, test.err) {
+				t.Errorf("%v doesn't match the provider error", wrapped)
+			}
+		})
+	}
+}
+
+func TestGCSErrorKind(t *testing.T) {
+	testErrorKind(t, gcsErrorKind, []errorKindTest{
+		{"object not exist", storage.ErrObjectNotExist, ErrNotFound},
+		{"bucket not exist", fmt.Errorf("listing: %w", storage.ErrBucketNotExist), ErrNotFound},
+		{"not found", &googleapi.Error{Code: http.StatusNotFound}, ErrNotFound},
+		{"conflict", &googleapi.Error{Code: http.StatusConflict}, ErrAlreadyExists},
+		{"precondition", &googleapi.Error{Code: http.StatusPreconditionFailed}, ErrPreconditionFailed},
+		{"forbidden", &googleapi.Error{Code: http.StatusForbidden}, ErrPermissionDenied},
+		{"unauthorized", &googleapi.Error{Code: http.StatusUnauthorized}, ErrPermissionDenied},
+		{"too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, ErrQuotaExceeded},
+		{
+			"rate limit reason",
+			&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}},
+			ErrQuotaExceeded,
+		},
+		// The messages of the JSON API for uploads with wrong checksums.
+		{
+			"md5 mismatch",
+			&googleapi.Error{Code: http.StatusBadRequest, Message: `Provided MD5 hash "1B2M2Y8AsgTpgAmY7PhCfg==" doesn't match calculated MD5 hash "rL0Y20zC+Fzt72VPzMSk2A==".`},
+			ErrChecksumMismatch,
+		},
+		{
+			"crc32c mismatch",
+			&googleapi.Error{Code: http.StatusBadRequest, Message: `Provided CRC32C "AAAAAA==" doesn't match calculated CRC32C "4waSgw==".`},
+			ErrChecksumMismatch,
+		},
+		{"bad request", &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid argument."}, nil},
+		// The error of the storage package's readers, see reader.go.
+		{"bad crc on read", fmt.Errorf("storage: bad CRC on read: got %d, want %d", 1, 2), ErrChecksumMismatch},
+		{"grpc not found", status.Error(codes.NotFound, "no such object"), ErrNotFound},
+		{"grpc precondition", fmt.Errorf("writing: %w", status.Error(codes.FailedPrecondition, "generation mismatch")), ErrPreconditionFailed},
+		{"grpc permission", status.Error(codes.PermissionDenied, "denied"), ErrPermissionDenied},
+		{"grpc quota", status.Error(codes.ResourceExhausted, "slow down"), ErrQuotaExceeded},
+		{"grpc data loss", status.Error(codes.DataLoss, "checksum mismatch"), ErrChecksumMismatch},
+		{"grpc unavailable", status.Error(codes.Unavailable, "unavailable"), nil},
+		{"canceled", context.Canceled, nil},
+	})
+}
+
+func TestAzureErrorKind(t *testing.T) {
+	responseErr := func(code bloberror.Code, status int) error {
+		return &azcore.ResponseError{ErrorCode: string(code), StatusCode: status}
+	}
+	testErrorKind(t, azureErrorKind, []errorKindTest{
+		{"blob not found", responseErr(bloberror.BlobNotFound, http.StatusNotFound), ErrNotFound},
+		{"container not found", responseErr(bloberror.ContainerNotFound, http.StatusNotFound), ErrNotFound},
+		{"already exists", responseErr(bloberror.BlobAlreadyExists, http.StatusConflict), ErrAlreadyExists},
+		{"condition not met", responseErr(bloberror.ConditionNotMet, http.StatusPreconditionFailed), ErrPreconditionFailed},
+		{"authorization", responseErr(bloberror.AuthorizationPermissionMismatch, http.StatusForbidden), ErrPermissionDenied},
+		{"server busy", responseErr(bloberror.ServerBusy, http.StatusServiceUnavailable), ErrQuotaExceeded},
+		{"md5 mismatch", responseErr(bloberror.MD5Mismatch, http.StatusBadRequest), ErrChecksumMismatch},
+		{"crc64 mismatch", responseErr(bloberror.CRC64Mismatch, http.StatusBadRequest), ErrChecksumMismatch},
+		// Responses to HEAD requests only have a status code.
+		{"head not found", responseErr("", http.StatusNotFound), ErrNotFound},
+		{"head throttled", responseErr("", http.StatusTooManyRequests), ErrQuotaExceeded},
+		{"internal", responseErr(bloberror.InternalError, http.StatusInternalServerError), nil},
+		{"canceled", context.Canceled, nil},
+	})
+}
+
+func TestCdnErrorKind(t *testing.T) {
+	kind := func(err error) error {
+		var statusErr *httpStatusError
+		if errors.As(err, &statusErr) {
+			return statusErr.Unwrap()
+		}
+		return nil
+	}
+	testErrorKind(t, kind, []errorKindTest{
+		{"not found", &httpStatusError{StatusCode: http.StatusNotFound}, ErrNotFound},
+		{"forbidden", &httpStatusError{StatusCode: http.StatusForbidden}, ErrPermissionDenied},
+		{"throttled", &httpStatusError{StatusCode: http.StatusTooManyRequests}, ErrQuotaExceeded},
+		{"bad gateway", &httpStatusError{StatusCode: http.StatusBadGateway}, nil},
+	})
+}
+
+func TestNewErrorKeepsClassifiedErrors(t *testing.T) {
+	classified := newError("downloading file", "key", storage.ErrObjectNotExist, gcsErrorKind)
+	if err := newError("retrying", "key", fmt.Errorf("attempt: %w", classified), gcsErrorKind); !errors.Is(err, classified) {
+		t.Fatalf("reclassified %v", err)
+	}
+	if err := newError("uploading file", "key", ErrInvalidKey, gcsErrorKind); err != ErrInvalidKey {
+		t.Fatalf("wrapped invalid key error: %v", err)
+	}
+	var storageErr *Error
+	if !errors.As(classified, &storageErr) || storageErr.Kind != ErrNotFound || storageErr.Op != "downloading file" {
+		t.Fatalf("newError returned %#v", classified)
+	}
+}
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGCBatchSize   = 100
+	defaultGCConcurrency = 4
+)
+
+type GCParams struct {
+	// Storage is scanned for garbage, it must implement ObjectLister
+	Storage Storage
+	// Folder and Prefixes select the scanned objects, all of Folder if Prefixes is empty
+	Folder   string
+	Prefixes []string
+
+	// MaxAge collects objects last updated before it, zero disables the rule
+	MaxAge time.Duration
+	// MaxVersions keeps the newest objects of each version group, zero disables the rule
+	MaxVersions int
+	// VersionGroup returns the group of an object for MaxVersions. Defaults
+	// to the object's directory, i.e. every build under builds/<name>/.
+	VersionGroup func(object ObjectInfo) string
+	// Referenced returns the keys among the candidates which are still in
+	// use, e.g. by an active job. Referenced objects are never collected.
+	Referenced func(ctx context.Context, keys []string) (map[string]bool, error)
+
+	// Archive, if set, receives a copy of each object under ArchiveFolder before it is deleted
+	Archive       Storage
+	ArchiveFolder string
+
+	// BatchSize is the number of objects checked and deleted at once. Defaults to 100.
+	BatchSize int
+	// Concurrency is the number of objects deleted in parallel. Defaults to 4.
+	Concurrency int
+	// DryRun reports the objects which would be collected without deleting them
+	DryRun bool
+	Logger *log.Logger
+}
+
+// GCReport summarizes a garbage collection run
+type GCReport struct {
+	Scanned    int
+	Candidates int
+	Referenced int
+	Archived   int
+	// Changed counts the candidates updated or deleted since the scan, which are left as they are
+	Changed    int
+	Deleted    int
+	Failed     int
+	FreedBytes int64
+	// DeletedKeys lists the collected objects, or the ones which would be in a dry run
+	DeletedKeys []string
+	Errors      []error
+	Duration    time.Duration
+}
+
+// GarbageCollector deletes or archives objects matching all the configured rules
+type GarbageCollector struct {
+	params GCParams
+	lister ObjectLister
+}
+
+// NewGarbageCollector returns a collector for the given params. At least one
+// of MaxAge, MaxVersions and Referenced must be set.
+func NewGarbageCollector(params GCParams) (*GarbageCollector, error) {
+	if params.Storage == nil {
+		return nil, errors.New("missing storage client")
+	}
+	lister, ok := params.Storage.(ObjectLister)
+	if !ok {
+		return nil, errors.New("storage client doesn't support listing object attributes")
+	}
+	if params.MaxAge <= 0 && params.MaxVersions <= 0 && params.Referenced == nil {
+		return nil, errors.New("missing garbage collection rules")
+	}
+	if params.VersionGroup == nil {
+		params.VersionGroup = func(object ObjectInfo) string {
+			return path.Dir(object.Key)
+		}
+	}
+	if params.Logger == nil {
+		params.Logger = log.Default()
+	}
+	if params.BatchSize <= 0 {
+		params.BatchSize = defaultGCBatchSize
+	}
+	if params.Concurrency <= 0 {
+		params.Concurrency = defaultGCConcurrency
+	}
+	return &GarbageCollector{params: params, lister: lister}, nil
+}
+
+// Run scans the prefixes and collects the matching objects. Failures of
+// single objects are recorded in the report, the returned error is only set
+// when the run couldn't complete.
+func (c *GarbageCollector) Run(ctx context.Context) (*GCReport, error) {
+	start := time.Now()
+	report := &GCReport{}
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	objects, err := c.scan(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = len(objects)
+	candidates := c.candidates(objects, start)
+	report.Candidates = len(candidates)
+	c.params.Logger.Printf("Garbage collection found %d candidates among %d objects...", len(candidates), len(objects))
+
+	for len(candidates) > 0 {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		batch := candidates
+		if len(batch) > c.params.BatchSize {
+			batch = batch[:c.params.BatchSize]
+		}
+		candidates = candidates[len(batch):]
+
+		if batch, err = c.unreferenced(ctx, batch, report); err != nil {
+			return report, err
+		}
+		c.collect(ctx, batch, report)
+	}
+	sort.Strings(report.DeletedKeys)
+	c.params.Logger.Printf("Garbage collection deleted %d objects, %d bytes, %d failures in %+v",
+		report.Deleted, report.FreedBytes, report.Failed, time.Since(start))
+	return report, nil
+}
+
+func (c *GarbageCollector) scan(ctx context.Context) ([]ObjectInfo, error) {
+	prefixes := c.params.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	var objects []ObjectInfo
+	for _, prefix := range prefixes {
+		listed, err := c.lister.ListObjects(ctx, &ListOptions{Folder: c.params.Folder, Prefix: prefix, Recursive: true})
+		if err != nil {
+			return nil, fmt.Errorf("error listing prefix: %+v for garbage collection since: %w", prefix, err)
+		}
+		for _, object := range listed {
+			if !object.IsDir {
+				objects = append(objects, object)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// candidates returns the objects matching the age and versions rules
+func (c *GarbageCollector) candidates(objects []ObjectInfo, now time.Time) []ObjectInfo {
+	superseded := make(map[string]bool)
+	if c.params.MaxVersions > 0 {
+		groups := make(map[string][]ObjectInfo)
+		for _, object := range objects {
+			group := c.params.VersionGroup(object)
+			groups[group] = append(groups[group], object)
+		}
+		for _, group := range groups {
+			sort.Slice(group, func(i, j int) bool {
+				return group[i].Updated.After(group[j].Updated)
+			})
+			if len(group) <= c.params.MaxVersions {
+				continue
+			}
+			for _, object := range group[c.params.MaxVersions:] {
+				superseded[object.Key] = true
+			}
+		}
+	}
+
+	var candidates []ObjectInfo
+	for _, object := range objects {
+		if c.params.MaxAge > 0 && now.Sub(object.Updated) < c.params.MaxAge {
+			continue
+		}
+		if c.params.MaxVersions > 0 && !superseded[object.Key] {
+			continue
+		}
+		candidates = append(candidates, object)
+	}
+	return candidates
+}
+
+// unreferenced drops the objects still referenced from batch
+func (c *GarbageCollector) unreferenced(ctx context.Context, batch []ObjectInfo, report *GCReport) ([]ObjectInfo, error) {
+	if c.params.Referenced == nil {
+		return batch, nil
+	}
+	keys := make([]string, len(batch))
+	for i, object := range batch {
+		keys[i] = object.Key
+	}
+	referenced, err := c.params.Referenced(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("error checking referenced objects since: %w", err)
+	}
+	var unreferenced []ObjectInfo
+	for _, object := range batch {
+		if referenced[object.Key] {
+			report.Referenced++
+			continue
+		}
+		unreferenced = append(unreferenced, object)
+	}
+	return unreferenced, nil
+}
+
+// collect archives and deletes the batch concurrently
+func (c *GarbageCollector) collect(ctx context.Context, batch []ObjectInfo, report *GCReport) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.params.Concurrency)
+	for _, object := range batch {
+		if c.params.DryRun {
+			report.DeletedKeys = append(report.DeletedKeys, object.Key)
+			report.FreedBytes += object.Size
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(object ObjectInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			archived, err := c.collectObject(ctx, object)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if archived {
+				report.Archived++
+			}
+			if errors.Is(err, errObjectChanged) {
+				report.Changed++
+				return
+			}
+			if err != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, err)
+				return
+			}
+			report.Deleted++
+			report.FreedBytes += object.Size
+			report.DeletedKeys = append(report.DeletedKeys, object.Key)
+		}(object)
+	}
+	wg.Wait()
+}
+
+// errObjectChanged is returned for candidates updated or deleted since the scan
+var errObjectChanged = errors.New("object changed since the garbage collection scan")
+
+// collectObject archives and deletes the object unless it changed since the
+// scan. Objects with a Version are deleted on the condition that it still
+// matches the scanned one. Other objects are stat'ed again right before the
+// delete, an update landing between the stat and the delete is lost.
+func (c *GarbageCollector) collectObject(ctx context.Context, object ObjectInfo) (archived bool, err error) {
+	if c.params.Archive != nil {
+		if err := c.archive(ctx, object); err != nil {
+			return false, fmt.Errorf("error archiving key: %+v since: %w", object.Key, err)
+		}
+		archived = true
+	}
+	if object.Version != "" {
+		c.params.Logger.Printf("Garbage collecting key: %+v...", object.Key)
+		err = c.params.Storage.Delete(ctx, &DeleteOptions{Key: object.Key, IfVersion: object.Version})
+		if errors.Is(err, ErrPreconditionFailed) || c.params.Storage.IsNotFoundErr(err) {
+			c.params.Logger.Printf("Skipping garbage collection of key: %+v changed since the scan", object.Key)
+			return archived, errObjectChanged
+		}
+		if err != nil {
+			return archived, fmt.Errorf("error deleting key: %+v since: %w", object.Key, err)
+		}
+		return archived, nil
+	}
+	current, err := c.lister.StatObject(ctx, &ListOptions{Key: object.Key})
+	if err != nil {
+		if c.params.Storage.IsNotFoundErr(err) || errors.Is(err, ErrNotFound) {
+			return archived, errObjectChanged
+		}
+		return archived, fmt.Errorf("error checking key: %+v since: %w", object.Key, err)
+	}
+	if !current.Updated.Equal(object.Updated) {
+		c.params.Logger.Printf("Skipping garbage collection of key: %+v updated since the scan", object.Key)
+		return archived, errObjectChanged
+	}
+	c.params.Logger.Printf("Garbage collecting key: %+v...", object.Key)
+	err = c.params.Storage.Delete(ctx, &DeleteOptions{Key: object.Key})
+	if err != nil && !c.params.Storage.IsNotFoundErr(err) {
+		return archived, fmt.Errorf("error deleting key: %+v since: %w", object.Key, err)
+	}
+	return archived, nil
+}
+
+// archive copies the object to the archive storage, streaming it if possible
+func (c *GarbageCollector) archive(ctx context.Context, object ObjectInfo) error {
+	options := &UploadOptions{Folder: c.params.ArchiveFolder, Key: object.Key, Metadata: object.Metadata}
+	if reader, ok := c.params.Storage.(ObjectReader); ok {
+		r, err := reader.NewRangeReader(ctx, &DownloadOptions{Key: object.Key}, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return c.params.Archive.Upload(ctx, options, r)
+	}
+	data, err := c.params.Storage.Download(ctx, &DownloadOptions{Key: object.Key})
+	if err != nil {
+		return err
+	}
+	return c.params.Archive.Upload(ctx, options, bytes.NewReader(data))
+}
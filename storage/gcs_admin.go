@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// GrantRead gives the entity read access to the objects for given options
+func (g gcsClient) GrantRead(ctx context.Context, options *ACLOptions) error {
+	return g.updateACL(ctx, options, "granting read access to", func(ctx context.Context, acl *storage.ACLHandle, entity storage.ACLEntity) error {
+		return g.retry.Do(ctx, true, func(ctx context.Context) error {
+			return acl.Set(ctx, entity, storage.RoleReader)
+		})
+	})
+}
+
+// RevokeRead removes the entity's access to the objects for given options
+func (g gcsClient) RevokeRead(ctx context.Context, options *ACLOptions) error {
+	isNotFound := func(err error) bool {
+		return isHTTPStatus(err, http.StatusNotFound)
+	}
+	return g.updateACL(ctx, options, "revoking read access to", func(ctx context.Context, acl *storage.ACLHandle, entity storage.ACLEntity) error {
+		return g.retry.DoDelete(ctx, true, isNotFound, func(ctx context.Context) error {
+			return acl.Delete(ctx, entity)
+		})
+	})
+}
+
+// updateACL applies fn to the ACL of a single object or of every object under
+// the prefix, fn is responsible for retrying its requests.
+func (g gcsClient) updateACL(ctx context.Context, options *ACLOptions, action string, fn func(ctx context.Context, acl *storage.ACLHandle, entity storage.ACLEntity) error) error {
+	if options == nil {
+		return errors.New("missing acl options")
+	}
+	if options.Entity == "" {
+		return errors.New("missing acl entity")
+	}
+	entity := storage.ACLEntity(options.Entity)
+
+	var keys []string
+	if options.Key != "" {
+		key, err := ObjectKey(options.Folder, options.Key)
+		if err != nil {
+			return err
+		}
+		keys = []string{key}
+	} else {
+		listOptions := &ListOptions{Folder: options.Folder, Prefix: options.Prefix, Recursive: true}
+		err := g.listObjects(ctx, listOptions, func() { keys = nil }, func(attrs *storage.ObjectAttrs) {
+			if attrs.Name != "" {
+				keys = append(keys, attrs.Name)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("error listing objects for acl of: %+v since: %w", options.Entity, err)
+		}
+	}
+
+	var errs []error
+	for _, key := range keys {
+		g.logger.Printf("Updating acl of key: %+v for: %+v in GCS Bucket...", key, entity)
+		acl := g.bucket.Object(key).ACL()
+		if err := fn(ctx, acl, entity); err != nil {
+			errs = append(errs, newError(fmt.Sprintf("%s %+v on key", action, entity), key, err, gcsErrorKind))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MakePublic gives everyone read access to the object and returns its public URL
+func (g gcsClient) MakePublic(ctx context.Context, options *DownloadOptions) (string, error) {
+	if options == nil {
+		return "", errors.New("missing download options")
+	}
+	publicURL, err := g.PublicURL(options)
+	if err != nil {
+		return "", err
+	}
+	err = g.GrantRead(ctx, &ACLOptions{Folder: options.Folder, Key: options.Key, Entity: string(storage.AllUsers)})
+	if err != nil {
+		return "", err
+	}
+	return publicURL, nil
+}
+
+// PublicURL returns the stable URL of the object, which only works once it is public
+func (g gcsClient) PublicURL(options *DownloadOptions) (string, error) {
+	if options == nil {
+		return "", errors.New("missing download options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return "", err
+	}
+	publicURL := *g.publicURL
+	publicURL.Path += key
+	return publicURL.String(), nil
+}
+
+// BucketPolicy returns the IAM policy of the bucket
+func (g gcsClient) BucketPolicy(ctx context.Context) (*BucketPolicy, error) {
+	g.logger.Printf("Getting IAM policy of GCS Bucket: %+v...", g.bucketName)
+	policy := &BucketPolicy{}
+	err := g.retry.Do(ctx, true, func(ctx context.Context) error {
+		iamPolicy, err := g.bucket.IAM().Policy(ctx)
+		if err != nil {
+			return err
+		}
+		policy.Bindings = nil
+		for _, role := range iamPolicy.Roles() {
+			policy.Bindings = append(policy.Bindings, PolicyBinding{
+				Role:    string(role),
+				Members: iamPolicy.Members(role),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, newError("getting IAM policy of bucket", g.bucketName, err, gcsErrorKind)
+	}
+	return policy, nil
+}
+
+// isHTTPStatus returns true if err is a google API error with the given status code
+func isHTTPStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// serviceAccountKey is the subset of a JSON key file used for signing
+type serviceAccountKey struct {
+	Type                           string `json:"type"`
+	ClientEmail                    string `json:"client_email"`
+	PrivateKey                     string `json:"private_key"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+}
+
+// urlSigner provides the GoogleAccessID and signing method of V4 signed URLs
+type urlSigner struct {
+	googleAccessID string
+	privateKey     []byte
+	// iam signs through the SignBlob API when there is no private key
+	iam *iamcredentials.Service
+
+	// detect lazily resolves the signer from the ambient credentials
+	detect     func(ctx context.Context) error
+	detectOnce sync.Once
+	detectErr  error
+}
+
+// isServiceAccountEmail returns true if ServiceAccount names an account to impersonate rather than a key file
+func isServiceAccountEmail(serviceAccount string) bool {
+	return strings.Contains(serviceAccount, "@") && !strings.HasSuffix(serviceAccount, ".json") &&
+		!strings.ContainsAny(serviceAccount, `/\`)
+}
+
+// gcsCredentials returns the client options and URL signer for the given
+// params. A service account key is used for both API calls and signing, an
+// impersonated service account signs through the IAM SignBlob API.
+func gcsCredentials(ctx context.Context, params *GCSBucketParams) ([]option.ClientOption, *urlSigner, error) {
+	opts := append([]option.ClientOption{}, params.ClientOptions...)
+	key := params.ServiceAccountKey
+	if len(key) == 0 && params.ServiceAccount != "" && !isServiceAccountEmail(params.ServiceAccount) {
+		var err error
+		if key, err = os.ReadFile(params.ServiceAccount); err != nil {
+			return nil, nil, fmt.Errorf("couldn't read service account key file: %+v since: %+v", params.ServiceAccount, err)
+		}
+	}
+
+	signer := &urlSigner{googleAccessID: params.GoogleAccessID, privateKey: params.PrivateKey}
+	// iamOpts authenticate the SignBlob calls made on behalf of googleAccessID.
+	iamOpts := params.ClientOptions
+	switch {
+	case len(key) > 0:
+		var sa serviceAccountKey
+		if err := json.Unmarshal(key, &sa); err != nil {
+			return nil, nil, fmt.Errorf("couldn't parse service account key since: %+v", err)
+		}
+		opts = append(opts, option.WithCredentialsJSON(key))
+		if signer.googleAccessID == "" {
+			signer.googleAccessID = sa.ClientEmail
+		}
+		if len(signer.privateKey) == 0 && sa.PrivateKey != "" {
+			signer.privateKey = []byte(sa.PrivateKey)
+		}
+		iamOpts = opts
+		if len(signer.privateKey) == 0 && signer.googleAccessID == "" {
+			signer.detect = signer.detectDefault
+		}
+	case params.ServiceAccount != "":
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: params.ServiceAccount,
+			Scopes:          []string{storage.ScopeFullControl},
+		}, params.ClientOptions...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't impersonate service account: %+v since: %+v", params.ServiceAccount, err)
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+		// The ambient credentials sign on behalf of the impersonated account.
+		if signer.googleAccessID == "" {
+			signer.googleAccessID = params.ServiceAccount
+		}
+	case len(signer.privateKey) == 0:
+		signer.detect = signer.detectDefault
+	}
+	if len(signer.privateKey) == 0 {
+		iam, err := iamcredentials.NewService(ctx, iamOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't create IAM credentials client since: %+v", err)
+		}
+		signer.iam = iam
+	}
+	return opts, signer, nil
+}
+
+// detectDefault resolves the signer from the application default
+// credentials or, e.g. with workload identity, the metadata server.
+func (s *urlSigner) detectDefault(ctx context.Context) error {
+	if creds, err := google.FindDefaultCredentials(ctx, storage.ScopeFullControl); err == nil && len(creds.JSON) > 0 {
+		var sa serviceAccountKey
+		if err := json.Unmarshal(creds.JSON, &sa); err == nil {
+			switch {
+			case sa.Type == "service_account" && sa.PrivateKey != "":
+				if s.googleAccessID == "" {
+					s.googleAccessID = sa.ClientEmail
+				}
+				s.privateKey = []byte(sa.PrivateKey)
+				return nil
+			case s.googleAccessID == "" && sa.ClientEmail != "":
+				s.googleAccessID = sa.ClientEmail
+			case s.googleAccessID == "" && sa.ServiceAccountImpersonationURL != "":
+				// The URL ends with .../serviceAccounts/<email>:generateAccessToken
+				start := strings.LastIndex(sa.ServiceAccountImpersonationURL, "/")
+				end := strings.LastIndex(sa.ServiceAccountImpersonationURL, ":")
+				if end > start {
+					s.googleAccessID = sa.ServiceAccountImpersonationURL[start+1 : end]
+				}
+			}
+		}
+	}
+	if s.googleAccessID == "" && metadata.OnGCE() {
+		email, err := metadata.Email("default")
+		if err != nil {
+			return fmt.Errorf("couldn't get service account from metadata server since: %+v", err)
+		}
+		s.googleAccessID = email
+	}
+	if s.googleAccessID == "" {
+		return errors.New("couldn't detect a service account to sign URLs, configure ServiceAccount or GoogleAccessID")
+	}
+	return nil
+}
+
+// apply sets the signing fields of opts, detecting them on first use. IAM
+// signing calls made through opts are bound to ctx.
+func (s *urlSigner) apply(ctx context.Context, opts *storage.SignedURLOptions) error {
+	if s.detect != nil {
+		s.detectOnce.Do(func() { s.detectErr = s.detect(ctx) })
+		if s.detectErr != nil {
+			return s.detectErr
+		}
+	}
+	opts.GoogleAccessID = s.googleAccessID
+	if len(s.privateKey) > 0 {
+		opts.PrivateKey = s.privateKey
+	} else {
+		opts.SignBytes = func(payload []byte) ([]byte, error) {
+			return s.signBytes(ctx, payload)
+		}
+	}
+	return nil
+}
+
+// signBytes signs with the IAM SignBlob API on behalf of googleAccessID, for
+// service accounts without a private key like workload identity ones.
+func (s *urlSigner) signBytes(ctx context.Context, payload []byte) ([]byte, error) {
+	res, err := s.iam.Projects.ServiceAccounts.SignBlob("projects/-/serviceAccounts/"+s.googleAccessID, &iamcredentials.SignBlobRequest{
+		Payload: base64.StdEncoding.EncodeToString(payload),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign blob for service account: %+v since: %w", s.googleAccessID, err)
+	}
+	return base64.StdEncoding.DecodeString(res.SignedBlob)
+}
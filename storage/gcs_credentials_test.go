@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+const testAccount = "signer@project.iam.gserviceaccount.com"
+
+func testPrivateKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %+v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func testKeyFile(t *testing.T, key map[string]any) string {
+	t.Helper()
+	data, err := json.Marshal(key)
+	if err != nil {
+		t.Fatalf("couldn't marshal key: %+v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("couldn't write key: %+v", err)
+	}
+	return path
+}
+
+func TestIsServiceAccountEmail(t *testing.T) {
+	tests := []struct {
+		serviceAccount string
+		want           bool
+	}{
+		{testAccount, true},
+		{"key.json", false},
+		{"/secrets/key", false},
+		{`C:\keys\sa@project`, false},
+		{"sa@project.json", false},
+	}
+	for _, test := range tests {
+		if got := isServiceAccountEmail(test.serviceAccount); got != test.want {
+			t.Errorf("isServiceAccountEmail(%q) = %v, want %v", test.serviceAccount, got, test.want)
+		}
+	}
+}
+
+func TestGCSCredentials(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	noAuth := []option.ClientOption{option.WithoutAuthentication()}
+	tests := []struct {
+		name       string
+		params     GCSBucketParams
+		wantID     string
+		wantKey    bool
+		wantIAM    bool
+		wantDetect bool
+	}{
+		{
+			name: "key file",
+			params: GCSBucketParams{ServiceAccount: testKeyFile(t, map[string]any{
+				"type": "service_account", "client_email": testAccount, "private_key": privateKey,
+			})},
+			wantID:  testAccount,
+			wantKey: true,
+		},
+		{
+			name:    "explicit key",
+			params:  GCSBucketParams{GoogleAccessID: testAccount, PrivateKey: []byte(privateKey), ClientOptions: noAuth},
+			wantID:  testAccount,
+			wantKey: true,
+		},
+		{
+			name:       "explicit account without key",
+			params:     GCSBucketParams{GoogleAccessID: testAccount, ClientOptions: noAuth},
+			wantID:     testAccount,
+			wantIAM:    true,
+			wantDetect: true,
+		},
+		{
+			name:       "ambient credentials",
+			params:     GCSBucketParams{ClientOptions: noAuth},
+			wantIAM:    true,
+			wantDetect: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, signer, err := gcsCredentials(context.Background(), &test.params)
+			if err != nil {
+				t.Fatalf("gcsCredentials: %+v", err)
+			}
+			if signer.googleAccessID != test.wantID {
+				t.Errorf("googleAccessID = %q, want %q", signer.googleAccessID, test.wantID)
+			}
+			if got := len(signer.privateKey) > 0; got != test.wantKey {
+				t.Errorf("has private key = %v, want %v", got, test.wantKey)
+			}
+			if got := signer.iam != nil; got != test.wantIAM {
+				t.Errorf("has IAM client = %v, want %v", got, test.wantIAM)
+			}
+			if got := signer.detect != nil; got != test.wantDetect {
+				t.Errorf("detects lazily = %v, want %v", got, test.wantDetect)
+			}
+		})
+	}
+}
+
+func TestGCSCredentialsInvalid(t *testing.T) {
+	tests := map[string]GCSBucketParams{
+		"missing key file": {ServiceAccount: filepath.Join(t.TempDir(), "missing.json")},
+		"malformed key":    {ServiceAccountKey: []byte("{")},
+	}
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := gcsCredentials(context.Background(), &params); err == nil {
+				t.Fatal("gcsCredentials returned no error")
+			}
+		})
+	}
+}
+
+func TestDetectDefault(t *testing.T) {
+	privateKey := testPrivateKey(t)
+	tests := []struct {
+		name    string
+		key     map[string]any
+		wantID  string
+		wantKey bool
+	}{
+		{
+			name:    "service account key",
+			key:     map[string]any{"type": "service_account", "client_email": testAccount, "private_key": privateKey},
+			wantID:  testAccount,
+			wantKey: true,
+		},
+		{
+			name: "impersonated service account",
+			key: map[string]any{
+				"type":                              "impersonated_service_account",
+				"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + testAccount + ":generateAccessToken",
+				"source_credentials": map[string]string{
+					"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token",
+				},
+			},
+			wantID: testAccount,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", testKeyFile(t, test.key))
+			signer := &urlSigner{}
+			if err := signer.detectDefault(context.Background()); err != nil {
+				t.Fatalf("detectDefault: %+v", err)
+			}
+			if signer.googleAccessID != test.wantID {
+				t.Errorf("googleAccessID = %q, want %q", signer.googleAccessID, test.wantID)
+			}
+			if got := len(signer.privateKey) > 0; got != test.wantKey {
+				t.Errorf("has private key = %v, want %v", got, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestSignWithPrivateKey(t *testing.T) {
+	signer := &urlSigner{googleAccessID: testAccount, privateKey: []byte(testPrivateKey(t))}
+	opts := &storage.SignedURLOptions{Method: http.MethodGet, Expires: time.Now().Add(time.Hour), Scheme: storage.SigningSchemeV4}
+	if err := signer.apply(context.Background(), opts); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	signed, err := storage.SignedURL("bucket", "folder/object", opts)
+	if err != nil {
+		t.Fatalf("SignedURL: %+v", err)
+	}
+	if !strings.Contains(signed, url.QueryEscape(testAccount)) {
+		t.Errorf("signed URL %q doesn't name %q", signed, testAccount)
+	}
+}
+
+func TestSignWithIAM(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if want := "/v1/projects/-/serviceAccounts/" + testAccount + ":signBlob"; r.URL.Path != want {
+			t.Errorf("request path = %q, want %q", r.URL.Path, want)
+		}
+		var req iamcredentials.SignBlobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("couldn't decode request: %+v", err)
+		}
+		// The fake signature is the payload itself so that it can be checked.
+		_ = json.NewEncoder(w).Encode(iamcredentials.SignBlobResponse{SignedBlob: req.Payload})
+	}))
+	defer server.Close()
+
+	iam, err := iamcredentials.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("couldn't create IAM client: %+v", err)
+	}
+	signer := &urlSigner{googleAccessID: testAccount, iam: iam}
+
+	payload := []byte("payload")
+	signature, err := signer.signBytes(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("signBytes: %+v", err)
+	}
+	if string(signature) != string(payload) {
+		t.Errorf("signature = %q, want %q", signature, payload)
+	}
+
+	opts := &storage.SignedURLOptions{Method: http.MethodGet, Expires: time.Now().Add(time.Hour), Scheme: storage.SigningSchemeV4}
+	if err := signer.apply(context.Background(), opts); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	signed, err := storage.SignedURL("bucket", "object", opts)
+	if err != nil {
+		t.Fatalf("SignedURL: %+v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("couldn't parse signed URL: %+v", err)
+	}
+	if _, err := hex.DecodeString(u.Query().Get("X-Goog-Signature")); err != nil {
+		t.Errorf("signature isn't hex encoded: %+v", err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d SignBlob calls, want 2", calls)
+	}
+
+	// Signing is bound to the context given to apply.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts = &storage.SignedURLOptions{Method: http.MethodGet, Expires: time.Now().Add(time.Hour), Scheme: storage.SigningSchemeV4}
+	if err := signer.apply(ctx, opts); err != nil {
+		t.Fatalf("apply: %+v", err)
+	}
+	if _, err := storage.SignedURL("bucket", "object", opts); err == nil {
+		t.Error("SignedURL with canceled context returned no error")
+	}
+}
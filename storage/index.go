@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	indexObjectsBucket = []byte("objects")
+	indexTagsBucket    = []byte("tags")
+	indexMetaBucket    = []byte("meta")
+	indexVersionKey    = []byte("version")
+)
+
+// indexVersion is the format of the tags bucket, which is rebuilt from the
+// objects bucket when opening an index of another format
+const indexVersion = "2"
+
+// IndexEntry is an object recorded in a MetadataIndex
+type IndexEntry struct {
+	Key      string            `json:"key"`
+	Size     int64             `json:"size"`
+	Updated  time.Time         `json:"updated"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// MetadataIndex is a local BoltDB index of object metadata, answering
+// queries like all the objects of a job without listing the bucket.
+type MetadataIndex struct {
+	db *bbolt.DB
+}
+
+// OpenMetadataIndex opens or creates the index database at path
+func OpenMetadataIndex(path string) (*MetadataIndex, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open metadata index: %+v since: %+v", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{indexObjectsBucket, indexTagsBucket, indexMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if string(tx.Bucket(indexMetaBucket).Get(indexVersionKey)) == indexVersion {
+			return nil
+		}
+		if err := rebuildTags(tx); err != nil {
+			return err
+		}
+		return tx.Bucket(indexMetaBucket).Put(indexVersionKey, []byte(indexVersion))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't initialize metadata index: %+v since: %+v", path, err)
+	}
+	return &MetadataIndex{db: db}, nil
+}
+
+// Close closes the index database
+func (i *MetadataIndex) Close() error {
+	return i.db.Close()
+}
+
+// rebuildTags recreates the tags bucket from the entries of the objects bucket
+func rebuildTags(tx *bbolt.Tx) error {
+	if err := tx.DeleteBucket(indexTagsBucket); err != nil {
+		return err
+	}
+	tags, err := tx.CreateBucket(indexTagsBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(indexObjectsBucket).ForEach(func(_, data []byte) error {
+		var entry IndexEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		for name, value := range entry.Metadata {
+			if err := tags.Put(tagKey(name, value, entry.Key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tagPrefix returns the prefix of the tags of objects with the metadata
+// value. The name and value are prefixed with their lengths so that any
+// bytes, including the ones of a separator, can't make tags collide.
+func tagPrefix(name, value string) []byte {
+	prefix := binary.AppendUvarint(nil, uint64(len(name)))
+	prefix = append(prefix, name...)
+	prefix = binary.AppendUvarint(prefix, uint64(len(value)))
+	return append(prefix, value...)
+}
+
+func tagKey(name, value, key string) []byte {
+	return append(tagPrefix(name, value), key...)
+}
+
+// Put records the entry, replacing any previous entry of the same key
+func (i *MetadataIndex) Put(entry IndexEntry) error {
+	if entry.Key == "" {
+		return fmt.Errorf("%w: missing index entry key", ErrInvalidKey)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		if err := removeEntry(tx, entry.Key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(indexObjectsBucket).Put([]byte(entry.Key), data); err != nil {
+			return err
+		}
+		tags := tx.Bucket(indexTagsBucket)
+		for name, value := range entry.Metadata {
+			if err := tags.Put(tagKey(name, value, entry.Key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes the entry of the given key, if any
+func (i *MetadataIndex) Remove(key string) error {
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		return removeEntry(tx, key)
+	})
+}
+
+func removeEntry(tx *bbolt.Tx, key string) error {
+	objects := tx.Bucket(indexObjectsBucket)
+	data := objects.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	var entry IndexEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	tags := tx.Bucket(indexTagsBucket)
+	for name, value := range entry.Metadata {
+		if err := tags.Delete(tagKey(name, value, key)); err != nil {
+			return err
+		}
+	}
+	return objects.Delete([]byte(key))
+}
+
+// Get returns the entry of the given key and false if it isn't indexed
+func (i *MetadataIndex) Get(key string) (entry IndexEntry, found bool, err error) {
+	err = i.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(indexObjectsBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &entry)
+	})
+	return entry, found, err
+}
+
+// Find returns the entries having all the given metadata values, sorted by
+// key. An empty query returns every entry.
+func (i *MetadataIndex) Find(query map[string]string) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		if len(query) == 0 {
+			return objects.ForEach(func(_, data []byte) error {
+				var entry IndexEntry
+				if err := json.Unmarshal(data, &entry); err != nil {
+					return err
+				}
+				entries = append(entries, entry)
+				return nil
+			})
+		}
+
+		// Scan the objects tagged with one of the values then filter on the others.
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		prefix := tagPrefix(names[0], query[names[0]])
+		cursor := tx.Bucket(indexTagsBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			data := objects.Get(k[len(prefix):])
+			if data == nil {
+				continue
+			}
+			var entry IndexEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			if matchesMetadata(entry.Metadata, query) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't query metadata index since: %+v", err)
+	}
+	return entries, nil
+}
+
+func matchesMetadata(metadata, query map[string]string) bool {
+	for name, value := range query {
+		if actual, ok := metadata[name]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Rebuild replaces the entries under the folder and prefix of options with
+// the objects listed from s, which must implement ObjectLister. It returns
+// the number of indexed objects.
+func (i *MetadataIndex) Rebuild(ctx context.Context, s Storage, options *ListOptions) (int, error) {
+	if options == nil {
+		return 0, errors.New("missing list options")
+	}
+	lister, ok := s.(ObjectLister)
+	if !ok {
+		return 0, errors.New("storage client doesn't support listing object attributes")
+	}
+	prefix, err := PrefixKey(options.Folder, options.Prefix)
+	if err != nil {
+		return 0, err
+	}
+	objects, err := lister.ListObjects(ctx, &ListOptions{Folder: options.Folder, Prefix: options.Prefix, Recursive: true})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = i.db.Update(func(tx *bbolt.Tx) error {
+		var stale []string
+		cursor := tx.Bucket(indexObjectsBucket).Cursor()
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = cursor.Next() {
+			stale = append(stale, string(k))
+		}
+		for _, key := range stale {
+			if err := removeEntry(tx, key); err != nil {
+				return err
+			}
+		}
+
+		objectsBucket := tx.Bucket(indexObjectsBucket)
+		tags := tx.Bucket(indexTagsBucket)
+		for _, object := range objects {
+			if object.IsDir {
+				continue
+			}
+			data, err := json.Marshal(IndexEntry{Key: object.Key, Size: object.Size, Updated: object.Updated, Metadata: object.Metadata})
+			if err != nil {
+				return err
+			}
+			if err := objectsBucket.Put([]byte(object.Key), data); err != nil {
+				return err
+			}
+			for name, value := range object.Metadata {
+				if err := tags.Put(tagKey(name, value, object.Key), nil); err != nil {
+					return err
+				}
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("couldn't rebuild metadata index for prefix: %+v since: %+v", prefix, err)
+	}
+	return count, nil
+}
+
+type IndexParams struct {
+	// Storage is the wrapped client
+	Storage Storage
+	// Index records the metadata of uploaded objects
+	Index *MetadataIndex
+}
+
+type indexedStorage struct {
+	Storage
+	index *MetadataIndex
+}
+
+// NewIndexedStorage returns a Storage recording the metadata of uploaded
+// objects in the index and removing deleted ones from it.
+// The optional interfaces of the wrapped client are kept.
+func NewIndexedStorage(params IndexParams) (Storage, error) {
+	if params.Storage == nil {
+		return nil, errors.New("missing storage client")
+	}
+	if params.Index == nil {
+		return nil, errors.New("missing metadata index")
+	}
+	return withOptional(&indexedStorage{Storage: params.Storage, index: params.Index}, params.Storage), nil
+}
+
+// Upload uploads the object then records it in the index
+func (s *indexedStorage) Upload(ctx context.Context, options *UploadOptions, r io.Reader) error {
+	if options == nil {
+		return errors.New("missing upload options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+
+	r, uploaded := measureUpload(r)
+	if err := s.Storage.Upload(ctx, options, r); err != nil {
+		return err
+	}
+
+	entry := IndexEntry{Key: key, Size: uploaded(), Updated: time.Now(), Metadata: options.Metadata}
+	if err := s.index.Put(entry); err != nil {
+		return fmt.Errorf("uploaded file: %+v but couldn't index it since: %+v", key, err)
+	}
+	return nil
+}
+
+// Delete deletes the object then removes it from the index
+func (s *indexedStorage) Delete(ctx context.Context, options *DeleteOptions) error {
+	if options == nil {
+		return errors.New("missing delete options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	// Objects missing from the storage are removed from the index as well.
+	err = s.Storage.Delete(ctx, options)
+	if err != nil && !s.IsNotFoundErr(err) {
+		return err
+	}
+	if indexErr := s.index.Remove(key); indexErr != nil {
+		return fmt.Errorf("deleted file: %+v but couldn't remove it from the index since: %+v", key, indexErr)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidKey is returned when a folder, prefix or key can't be turned into a valid object name
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// JoinKey joins the given path parts with DirDelim. Leading and trailing
+// delimiters of every part are trimmed and empty parts are skipped, while
+// empty, "." and ".." segments within a part are rejected.
+func JoinKey(parts ...string) (string, error) {
+	segments := make([]string, 0, len(parts))
+	for _, part := range parts {
+		part = strings.Trim(part, DirDelim)
+		if part == "" {
+			continue
+		}
+		for _, segment := range strings.Split(part, DirDelim) {
+			if segment == "" || segment == "." || segment == ".." {
+				return "", fmt.Errorf("%w: segment %q in %q", ErrInvalidKey, segment, part)
+			}
+		}
+		segments = append(segments, part)
+	}
+	return strings.Join(segments, DirDelim), nil
+}
+
+// ObjectKey returns the object name for key inside folder. Keys which
+// already start with the folder, like the ones returned by ListKeys, are
+// used as is so that an object has a single name: the key "a/b" in the
+// folder "a" is the object "a/b". Keys meant to repeat the folder need an
+// empty folder and the full key.
+func ObjectKey(folder, key string) (string, error) {
+	objectKey, err := JoinKey(withoutFolder(folder, key))
+	if err != nil {
+		return "", err
+	}
+	if objectKey == "" {
+		return "", fmt.Errorf("%w: missing key", ErrInvalidKey)
+	}
+	return JoinKey(folder, objectKey)
+}
+
+// PrefixKey returns the listing prefix for prefix inside folder. Non empty
+// prefixes always end with DirDelim, an empty folder and prefix returns "".
+func PrefixKey(folder, prefix string) (string, error) {
+	key, err := JoinKey(folder, withoutFolder(folder, prefix))
+	if err != nil || key == "" {
+		return key, err
+	}
+	return key + DirDelim, nil
+}
+
+// withoutFolder strips folder from the start of key if key is already a full path
+func withoutFolder(folder, key string) string {
+	folder = strings.Trim(folder, DirDelim)
+	if folder == "" {
+		return key
+	}
+	trimmed := strings.TrimPrefix(key, DirDelim)
+	if strings.HasPrefix(trimmed, folder+DirDelim) {
+		return strings.TrimPrefix(trimmed, folder+DirDelim)
+	}
+	return key
+}
+
+// MigrateFolderKeys moves the objects named folder/folder/... to
+// folder/..., which is where ObjectKey stores folder prefixed keys. Older
+// clients stored them under the repeated folder. Objects whose new name is
+// taken are left in place. It returns the number of moved objects and must
+// not be run on folders with keys meant to repeat the folder.
+func MigrateFolderKeys(ctx context.Context, s Storage, folder string) (int, error) {
+	folder = strings.Trim(folder, DirDelim)
+	if folder == "" {
+		return 0, fmt.Errorf("%w: missing folder", ErrInvalidKey)
+	}
+	keys, err := s.ListKeys(ctx, &ListOptions{Folder: folder, Prefix: folder, Recursive: true})
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, key := range keys {
+		target := strings.TrimPrefix(key, folder+DirDelim)
+		if target == key || strings.HasSuffix(key, DirDelim) {
+			continue
+		}
+		exists, err := s.Exists(ctx, &ListOptions{Key: target})
+		if err != nil {
+			return moved, err
+		}
+		if exists {
+			continue
+		}
+		data, err := s.Download(ctx, &DownloadOptions{Key: key})
+		if err != nil {
+			return moved, err
+		}
+		if err := s.Upload(ctx, &UploadOptions{Key: target}, bytes.NewReader(data)); err != nil {
+			return moved, err
+		}
+		if err := s.Delete(ctx, &DeleteOptions{Key: key}); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
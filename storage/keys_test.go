@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestObjectKey(t *testing.T) {
+	tests := []struct {
+		folder, key string
+		want        string
+	}{
+		{"", "a/b", "a/b"},
+		{"", "/a/b/", "a/b"},
+		{"folder", "a", "folder/a"},
+		{"/folder/", "/a/", "folder/a"},
+		{"folder", "a/b", "folder/a/b"},
+		{"folder", "folder/a", "folder/a"},
+		{"folder", "/folder/a", "folder/a"},
+		{"folder/sub", "folder/sub/a", "folder/sub/a"},
+		{"folder", "folder", "folder/folder"},
+		{"folder", "folderx/a", "folder/folderx/a"},
+		{"", "folder/folder/a", "folder/folder/a"},
+	}
+	for _, test := range tests {
+		got, err := ObjectKey(test.folder, test.key)
+		if err != nil {
+			t.Errorf("ObjectKey(%q, %q) returned error: %+v", test.folder, test.key, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ObjectKey(%q, %q) = %q, want %q", test.folder, test.key, got, test.want)
+		}
+	}
+}
+
+func TestObjectKeyInvalid(t *testing.T) {
+	tests := []struct {
+		folder, key string
+	}{
+		{"", ""},
+		{"folder", ""},
+		{"folder", "/"},
+		{"folder", "folder/"},
+		{"", ".."},
+		{"", "a/../b"},
+		{"folder", "../a"},
+		{"../folder", "a"},
+		{"folder", "./a"},
+		{"", "a//b"},
+	}
+	for _, test := range tests {
+		if got, err := ObjectKey(test.folder, test.key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("ObjectKey(%q, %q) = %q, %v, want ErrInvalidKey", test.folder, test.key, got, err)
+		}
+	}
+}
+
+func TestPrefixKey(t *testing.T) {
+	tests := []struct {
+		folder, prefix string
+		want           string
+	}{
+		{"", "", ""},
+		{"folder", "", "folder/"},
+		{"", "p", "p/"},
+		{"/folder/", "/p/", "folder/p/"},
+		{"folder", "folder/p", "folder/p/"},
+		{"folder", "p/q/", "folder/p/q/"},
+	}
+	for _, test := range tests {
+		got, err := PrefixKey(test.folder, test.prefix)
+		if err != nil {
+			t.Errorf("PrefixKey(%q, %q) returned error: %+v", test.folder, test.prefix, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("PrefixKey(%q, %q) = %q, want %q", test.folder, test.prefix, got, test.want)
+		}
+	}
+	if _, err := PrefixKey("folder", ".."); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("PrefixKey with traversal returned %v, want ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Quota limits the usage of a folder, zero values mean unlimited
+type Quota struct {
+	MaxObjects int64
+	MaxBytes   int64
+}
+
+func (q Quota) unlimited() bool {
+	return q.MaxObjects <= 0 && q.MaxBytes <= 0
+}
+
+type QuotaParams struct {
+	// Storage is the wrapped client, it must implement ObjectLister
+	Storage Storage
+	// Usage tracks the folders usage, if nil a tracker with the default ttl is used
+	Usage *UsageTracker
+	// Quotas maps a folder (tenant) to its quota
+	Quotas map[string]Quota
+	// DefaultQuota applies to folders missing from Quotas
+	DefaultQuota Quota
+}
+
+type quotaStorage struct {
+	Storage
+	lister       ObjectLister
+	usage        *UsageTracker
+	quotas       map[string]Quota
+	defaultQuota Quota
+	mutex        sync.Mutex
+	reserved     map[string]Usage
+}
+
+// NewQuotaStorage returns a Storage which rejects uploads exceeding the
+// per folder quota and keeps the usage tracker updated on uploads and deletes.
+// The optional interfaces of the wrapped client are kept.
+func NewQuotaStorage(params QuotaParams) (Storage, error) {
+	if params.Storage == nil {
+		return nil, errors.New("missing storage client")
+	}
+	lister, ok := params.Storage.(ObjectLister)
+	if !ok {
+		return nil, errors.New("storage client doesn't support listing object attributes")
+	}
+	usage := params.Usage
+	if usage == nil {
+		var err error
+		if usage, err = NewUsageTracker(params.Storage, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	quotas := make(map[string]Quota, len(params.Quotas))
+	for folder, quota := range params.Quotas {
+		folder, err := JoinKey(folder)
+		if err != nil {
+			return nil, err
+		}
+		quotas[folder] = quota
+	}
+	return withOptional(&quotaStorage{
+		Storage:      params.Storage,
+		lister:       lister,
+		usage:        usage,
+		quotas:       quotas,
+		defaultQuota: params.DefaultQuota,
+		reserved:     make(map[string]Usage),
+	}, params.Storage), nil
+}
+
+func (q *quotaStorage) quotaFor(folder string) Quota {
+	if quota, ok := q.quotas[folder]; ok {
+		return quota
+	}
+	return q.defaultQuota
+}
+
+// quotaFolder returns the folder whose quota applies to key inside folder,
+// i.e. the longest folder of Quotas containing the object, so that folder
+// prefixed keys count against their folder. Defaults to folder.
+func (q *quotaStorage) quotaFolder(folder, key string) (string, error) {
+	objectKey, err := ObjectKey(folder, key)
+	if err != nil {
+		return "", err
+	}
+	quotaFolder := ""
+	for configured := range q.quotas {
+		if strings.HasPrefix(objectKey, configured+DirDelim) && len(configured) > len(quotaFolder) {
+			quotaFolder = configured
+		}
+	}
+	if quotaFolder != "" {
+		return quotaFolder, nil
+	}
+	return JoinKey(folder)
+}
+
+// Upload checks the folder's quota before uploading. Readers of unknown size
+// are aborted as soon as they exceed the remaining quota.
+func (q *quotaStorage) Upload(ctx context.Context, options *UploadOptions, r io.Reader) error {
+	if options == nil {
+		return errors.New("missing upload options")
+	}
+	folder, err := q.quotaFolder(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+
+	var previous int64
+	existing, err := q.lister.StatObject(ctx, &ListOptions{Folder: options.Folder, Key: options.Key})
+	switch {
+	case err == nil:
+		previous = existing.Size
+	case !q.IsNotFoundErr(err):
+		return err
+	}
+	objects := int64(0)
+	if err != nil {
+		objects = 1
+	}
+
+	quota := q.quotaFor(folder)
+	size, sized := readerSize(r)
+	reservation := Usage{Objects: objects}
+	if sized {
+		reservation.Bytes = size - previous
+	}
+	if !quota.unlimited() {
+		usage, err := q.usage.Usage(ctx, folder)
+		if err != nil {
+			return err
+		}
+		remaining, err := q.reserve(folder, quota, usage, reservation)
+		if err != nil {
+			return err
+		}
+		defer q.release(folder, reservation)
+		if !sized && quota.MaxBytes > 0 {
+			r = &quotaReader{reader: r, remaining: remaining + previous}
+		}
+	}
+
+	r, uploaded := measureUpload(r)
+	if err := q.Storage.Upload(ctx, options, r); err != nil {
+		return err
+	}
+	q.usage.Add(folder, objects, uploaded()-previous)
+	return nil
+}
+
+// reserve checks usage plus in flight uploads against quota and reserves
+// the given usage. It returns the remaining bytes after the reservation.
+func (q *quotaStorage) reserve(folder string, quota Quota, usage, reservation Usage) (int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	reserved := q.reserved[folder]
+	objects := usage.Objects + reserved.Objects + reservation.Objects
+	bytes := usage.Bytes + reserved.Bytes + reservation.Bytes
+	if quota.MaxObjects > 0 && reservation.Objects > 0 && objects > quota.MaxObjects {
+		return 0, fmt.Errorf("%w: folder %+v would have %d objects, limit is %d", ErrQuotaExceeded, folder, objects, quota.MaxObjects)
+	}
+	if quota.MaxBytes > 0 && reservation.Bytes > 0 && bytes > quota.MaxBytes {
+		return 0, fmt.Errorf("%w: folder %+v would use %d bytes, limit is %d", ErrQuotaExceeded, folder, bytes, quota.MaxBytes)
+	}
+
+	q.reserved[folder] = Usage{
+		Objects: reserved.Objects + reservation.Objects,
+		Bytes:   reserved.Bytes + reservation.Bytes,
+	}
+	return quota.MaxBytes - bytes, nil
+}
+
+func (q *quotaStorage) release(folder string, reservation Usage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	reserved := q.reserved[folder]
+	reserved.Objects -= reservation.Objects
+	reserved.Bytes -= reservation.Bytes
+	if reserved == (Usage{}) {
+		delete(q.reserved, folder)
+		return
+	}
+	q.reserved[folder] = reserved
+}
+
+// Delete deletes the object and removes it from the folder's usage
+func (q *quotaStorage) Delete(ctx context.Context, options *DeleteOptions) error {
+	if options == nil {
+		return errors.New("missing delete options")
+	}
+	folder, err := q.quotaFolder(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	existing, statErr := q.lister.StatObject(ctx, &ListOptions{Folder: options.Folder, Key: options.Key})
+	if statErr != nil && !q.IsNotFoundErr(statErr) {
+		return statErr
+	}
+	if err := q.Storage.Delete(ctx, options); err != nil {
+		return err
+	}
+	if statErr == nil {
+		q.usage.Add(folder, -1, -existing.Size)
+	}
+	return nil
+}
+
+// quotaReader fails with ErrQuotaExceeded once more than remaining bytes are read
+type quotaReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.reader.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,621 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRepairQueueSize  = 1000
+	defaultRepairWorkers    = 2
+	defaultFailureThreshold = 3
+	defaultReplicaCooldown  = 30 * time.Second
+)
+
+// ReplicationMode selects how writes reach the secondary replicas
+type ReplicationMode int
+
+const (
+	// ReplicateSync writes the secondaries before returning, failed writes are repaired in the background
+	ReplicateSync ReplicationMode = iota
+	// ReplicateAsync only writes the primary, the secondaries are updated by the repair queue
+	ReplicateAsync
+)
+
+// Replica is a named Storage backend, e.g. a bucket in a region
+type Replica struct {
+	Name    string
+	Storage Storage
+}
+
+type ReplicationParams struct {
+	// Primary receives every write first and is the source of repairs
+	Primary Replica
+	// Secondaries are kept in sync with the primary
+	Secondaries []Replica
+	Mode        ReplicationMode
+	// ReadOrder lists replica names from the nearest, reads fail over in that
+	// order. Defaults to the primary then the secondaries.
+	ReadOrder []string
+	// FailureThreshold consecutive failures mark a replica unhealthy for
+	// Cooldown, it's skipped by reads meanwhile. Defaults to 3 and 30 seconds.
+	FailureThreshold int
+	Cooldown         time.Duration
+	// RepairQueueSize bounds the pending repairs, further ones are dropped. Defaults to 1000.
+	RepairQueueSize int
+	// RepairWorkers is the number of concurrent repairs. Defaults to 2. The
+	// repairs of a key are always run in order by the same worker.
+	RepairWorkers int
+	// RepairRetry configures the retries of a repair, if nil DefaultRetryPolicy is used
+	RepairRetry *RetryPolicy
+	Logger      *log.Logger
+	// Ctx bounds the repairs, defaults to context.Background()
+	Ctx context.Context
+}
+
+// RepairStats counts the repairs of the secondaries
+type RepairStats struct {
+	Pending  int64
+	Repaired int64
+	Failed   int64
+	Dropped  int64
+}
+
+type replica struct {
+	Replica
+	mutex          sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+}
+
+type repairTask struct {
+	replica *replica
+	key     string
+}
+
+// ReplicatedStorage writes to a primary and secondary replicas and reads
+// from the nearest healthy replica, failing over to the next ones. See
+// Storage for the optional interfaces of the replicas.
+type ReplicatedStorage struct {
+	primary          *replica
+	secondaries      []*replica
+	readOrder        []*replica
+	mode             ReplicationMode
+	failureThreshold int
+	cooldown         time.Duration
+	retry            RetryPolicy
+	logger           *log.Logger
+	ctx              context.Context
+
+	queues  []chan repairTask
+	closed  bool
+	closing sync.RWMutex
+	workers sync.WaitGroup
+	stats   struct{ pending, repaired, failed, dropped atomic.Int64 }
+}
+
+// NewReplicatedStorage returns a replicated storage and starts its repair workers, see Close
+func NewReplicatedStorage(params ReplicationParams) (*ReplicatedStorage, error) {
+	if params.Primary.Storage == nil {
+		return nil, errors.New("missing primary storage client")
+	}
+	s := &ReplicatedStorage{
+		primary:          &replica{Replica: params.Primary},
+		mode:             params.Mode,
+		failureThreshold: defaultFailureThreshold,
+		cooldown:         defaultReplicaCooldown,
+		retry:            newRetryPolicy(params.RepairRetry),
+		logger:           params.Logger,
+		ctx:              params.Ctx,
+	}
+	replicas := map[string]*replica{params.Primary.Name: s.primary}
+	for _, secondary := range params.Secondaries {
+		if secondary.Storage == nil {
+			return nil, fmt.Errorf("missing storage client of replica: %+v", secondary.Name)
+		}
+		if _, ok := replicas[secondary.Name]; ok {
+			return nil, fmt.Errorf("duplicate replica name: %+v", secondary.Name)
+		}
+		r := &replica{Replica: secondary}
+		replicas[secondary.Name] = r
+		s.secondaries = append(s.secondaries, r)
+	}
+
+	if s.logger == nil {
+		s.logger = log.Default()
+	}
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+	if len(params.ReadOrder) == 0 {
+		s.readOrder = append([]*replica{s.primary}, s.secondaries...)
+	}
+	for _, name := range params.ReadOrder {
+		r, ok := replicas[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown replica in read order: %+v", name)
+		}
+		s.readOrder = append(s.readOrder, r)
+	}
+	if params.FailureThreshold > 0 {
+		s.failureThreshold = params.FailureThreshold
+	}
+	if params.Cooldown > 0 {
+		s.cooldown = params.Cooldown
+	}
+
+	queueSize := params.RepairQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultRepairQueueSize
+	}
+	workers := params.RepairWorkers
+	if workers <= 0 {
+		workers = defaultRepairWorkers
+	}
+	// Each worker has its own share of the queue.
+	queueSize = (queueSize + workers - 1) / workers
+	for i := 0; i < workers; i++ {
+		queue := make(chan repairTask, queueSize)
+		s.queues = append(s.queues, queue)
+		s.workers.Add(1)
+		go s.repairWorker(queue)
+	}
+	return s, nil
+}
+
+// Close stops accepting repairs and waits for the pending ones to finish
+func (s *ReplicatedStorage) Close() error {
+	s.closing.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, queue := range s.queues {
+			close(queue)
+		}
+	}
+	s.closing.Unlock()
+	s.workers.Wait()
+	return nil
+}
+
+// RepairStats returns the repair counters of the secondaries
+func (s *ReplicatedStorage) RepairStats() RepairStats {
+	return RepairStats{
+		Pending:  s.stats.pending.Load(),
+		Repaired: s.stats.repaired.Load(),
+		Failed:   s.stats.failed.Load(),
+		Dropped:  s.stats.dropped.Load(),
+	}
+}
+
+// healthy returns the replicas to read from in order, unhealthy ones are
+// only tried last in case every replica is failing.
+func (s *ReplicatedStorage) healthy() []*replica {
+	now := time.Now()
+	healthy := make([]*replica, 0, len(s.readOrder))
+	var unhealthy []*replica
+	for _, r := range s.readOrder {
+		r.mutex.Lock()
+		down := now.Before(r.unhealthyUntil)
+		r.mutex.Unlock()
+		if down {
+			unhealthy = append(unhealthy, r)
+			continue
+		}
+		healthy = append(healthy, r)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// record updates the health of the replica after an operation
+func (s *ReplicatedStorage) record(r *replica, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err == nil || r.Storage.IsNotFoundErr(err) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidKey) ||
+		errors.Is(err, ErrPreconditionFailed) || errors.Is(err, context.Canceled) {
+		r.failures = 0
+		return
+	}
+	r.failures++
+	if r.failures >= s.failureThreshold {
+		s.logger.Printf("Marking replica: %+v unhealthy for %+v since: %+v", r.Name, s.cooldown, err)
+		r.unhealthyUntil = time.Now().Add(s.cooldown)
+		r.failures = 0
+	}
+}
+
+// read runs fn on the replicas in read order until one succeeds. Not found
+// errors fall through as well since a secondary may not be repaired yet.
+func (s *ReplicatedStorage) read(ctx context.Context, fn func(r *replica) error) error {
+	var errs []error
+	var notFound error
+	for _, r := range s.healthy() {
+		err := fn(r)
+		s.record(r, err)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if r.Storage.IsNotFoundErr(err) || errors.Is(err, ErrNotFound) {
+			if notFound == nil {
+				notFound = err
+			}
+			continue
+		}
+		errs = append(errs, fmt.Errorf("replica %+v: %w", r.Name, err))
+	}
+	if notFound != nil {
+		return notFound
+	}
+	return errors.Join(errs...)
+}
+
+// enqueue schedules the repair of key on the replica. The key picks the
+// worker so that an older repair can't overwrite the result of a newer one.
+func (s *ReplicatedStorage) enqueue(r *replica, key string) {
+	s.closing.RLock()
+	defer s.closing.RUnlock()
+	if s.closed {
+		s.stats.dropped.Add(1)
+		return
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	queue := s.queues[hash.Sum32()%uint32(len(s.queues))]
+	s.stats.pending.Add(1)
+	select {
+	case queue <- repairTask{replica: r, key: key}:
+	default:
+		s.stats.pending.Add(-1)
+		s.stats.dropped.Add(1)
+		s.logger.Printf("Repair queue full, dropping repair of key: %+v on replica: %+v", key, r.Name)
+	}
+}
+
+func (s *ReplicatedStorage) repairWorker(queue chan repairTask) {
+	defer s.workers.Done()
+	for task := range queue {
+		err := s.retry.Do(s.ctx, true, func(ctx context.Context) error {
+			return s.repair(ctx, task)
+		})
+		s.stats.pending.Add(-1)
+		if err != nil {
+			s.stats.failed.Add(1)
+			s.logger.Printf("Couldn't repair key: %+v on replica: %+v since: %+v", task.key, task.replica.Name, err)
+			continue
+		}
+		s.stats.repaired.Add(1)
+	}
+}
+
+// repair makes the replica's object match the primary's. Repairs of uploads
+// and deletes are alike since the primary may have changed since either: the
+// object is copied if the primary has it and deleted otherwise.
+func (s *ReplicatedStorage) repair(ctx context.Context, task repairTask) error {
+	target := task.replica.Storage
+	err := copyObject(ctx, s.primary.Storage, target, task.key)
+	if err == nil || !s.primary.Storage.IsNotFoundErr(err) {
+		return err
+	}
+	err = target.Delete(ctx, &DeleteOptions{Key: task.key})
+	if err != nil && !target.IsNotFoundErr(err) {
+		return err
+	}
+	return nil
+}
+
+// copyObject copies key from src to dst, streaming it if possible
+func copyObject(ctx context.Context, src, dst Storage, key string) error {
+	var metadata map[string]string
+	if lister, ok := src.(ObjectLister); ok {
+		info, err := lister.StatObject(ctx, &ListOptions{Key: key})
+		if err != nil {
+			return err
+		}
+		metadata = info.Metadata
+	}
+	options := &UploadOptions{Key: key, Metadata: metadata}
+	if reader, ok := src.(ObjectReader); ok {
+		r, err := reader.NewRangeReader(ctx, &DownloadOptions{Key: key}, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return dst.Upload(ctx, options, r)
+	}
+	data, err := src.Download(ctx, &DownloadOptions{Key: key})
+	if err != nil {
+		return err
+	}
+	return dst.Upload(ctx, options, bytes.NewReader(data))
+}
+
+// Upload writes the primary then, depending on the mode, the secondaries or the repair queue
+func (s *ReplicatedStorage) Upload(ctx context.Context, options *UploadOptions, r io.Reader) error {
+	if options == nil {
+		return errors.New("missing upload options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	if s.mode == ReplicateAsync || len(s.secondaries) == 0 {
+		err := s.primary.Storage.Upload(ctx, options, r)
+		s.record(s.primary, err)
+		if err != nil {
+			return err
+		}
+		for _, secondary := range s.secondaries {
+			s.enqueue(secondary, key)
+		}
+		return nil
+	}
+
+	// The content is written once per replica, hence must be rewindable.
+	// Other readers are spooled to a temporary file while uploading the primary.
+	var start int64
+	seeker, ok := r.(io.ReadSeeker)
+	if ok {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		err = s.primary.Storage.Upload(ctx, options, seeker)
+	} else {
+		spool, spoolErr := os.CreateTemp("", "replication-*")
+		if spoolErr != nil {
+			return fmt.Errorf("couldn't create spool file since: %+v", spoolErr)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		tee := io.TeeReader(r, spool)
+		err = s.primary.Storage.Upload(ctx, options, tee)
+		if err == nil {
+			// Spools whatever the primary's upload left unread.
+			_, err = io.Copy(io.Discard, tee)
+		}
+		seeker = spool
+	}
+	s.record(s.primary, err)
+	if err != nil {
+		return err
+	}
+	for _, secondary := range s.secondaries {
+		if _, err = seeker.Seek(start, io.SeekStart); err == nil {
+			err = secondary.Storage.Upload(ctx, options, seeker)
+		}
+		s.record(secondary, err)
+		if err != nil {
+			s.logger.Printf("Couldn't replicate key: %+v to replica: %+v since: %+v", key, secondary.Name, err)
+			s.enqueue(secondary, key)
+		}
+	}
+	return nil
+}
+
+// Delete deletes from the primary then, depending on the mode, the secondaries
+// or the repair queue. IfVersion only applies to the primary since the
+// versions of the replicas differ.
+func (s *ReplicatedStorage) Delete(ctx context.Context, options *DeleteOptions) error {
+	if options == nil {
+		return errors.New("missing delete options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	err = s.primary.Storage.Delete(ctx, options)
+	s.record(s.primary, err)
+	if err != nil && !s.primary.Storage.IsNotFoundErr(err) {
+		return err
+	}
+	secondaryOptions := *options
+	secondaryOptions.IfVersion = ""
+	for _, secondary := range s.secondaries {
+		if s.mode == ReplicateAsync {
+			s.enqueue(secondary, key)
+			continue
+		}
+		secondaryErr := secondary.Storage.Delete(ctx, &secondaryOptions)
+		s.record(secondary, secondaryErr)
+		if secondaryErr != nil && !secondary.Storage.IsNotFoundErr(secondaryErr) {
+			s.logger.Printf("Couldn't delete key: %+v from replica: %+v since: %+v", key, secondary.Name, secondaryErr)
+			s.enqueue(secondary, key)
+		}
+	}
+	return err
+}
+
+func (s *ReplicatedStorage) Download(ctx context.Context, options *DownloadOptions) (data []byte, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		data, err = r.Storage.Download(ctx, options)
+		return err
+	})
+	return data, err
+}
+
+// Exists checks the replicas in read order until one has the object
+func (s *ReplicatedStorage) Exists(ctx context.Context, options *ListOptions) (bool, error) {
+	found := false
+	err := s.read(ctx, func(r *replica) error {
+		exists, err := r.Storage.Exists(ctx, options)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errReplicaMissing
+		}
+		found = true
+		return nil
+	})
+	if errors.Is(err, errReplicaMissing) {
+		return false, nil
+	}
+	return found, err
+}
+
+// errReplicaMissing lets Exists fall through replicas which lack the object
+var errReplicaMissing = fmt.Errorf("%w: object missing from replica", ErrNotFound)
+
+// ListKeys lists the keys of the nearest healthy replica, which may lag behind the primary
+func (s *ReplicatedStorage) ListKeys(ctx context.Context, options *ListOptions) (keys []string, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		keys, err = r.Storage.ListKeys(ctx, options)
+		return err
+	})
+	return keys, err
+}
+
+func (s *ReplicatedStorage) GetTempTokenForDownload(ctx context.Context, options *DownloadOptions) (token string, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		token, err = r.Storage.GetTempTokenForDownload(ctx, options)
+		return err
+	})
+	return token, err
+}
+
+func (s *ReplicatedStorage) DownloadFromCdn(ctx context.Context, options *DownloadOptions) (data []byte, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		data, err = r.Storage.DownloadFromCdn(ctx, options)
+		return err
+	})
+	return data, err
+}
+
+func (s *ReplicatedStorage) IsNotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNotFound) || s.primary.Storage.IsNotFoundErr(err) {
+		return true
+	}
+	for _, secondary := range s.secondaries {
+		if secondary.Storage.IsNotFoundErr(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage returns s along with the ObjectLister, ObjectReader and Admin
+// interfaces which every replica implements
+func (s *ReplicatedStorage) Storage() Storage {
+	lists, reads, administers := true, true, true
+	for _, r := range append([]*replica{s.primary}, s.secondaries...) {
+		_, ok := r.Storage.(ObjectLister)
+		lists = lists && ok
+		_, ok = r.Storage.(ObjectReader)
+		reads = reads && ok
+		_, ok = r.Storage.(Admin)
+		administers = administers && ok
+	}
+	optional := &replicatedOptional{s}
+	var lister ObjectLister
+	if lists {
+		lister = optional
+	}
+	var reader ObjectReader
+	if reads {
+		reader = optional
+	}
+	var admin Admin
+	if administers {
+		admin = optional
+	}
+	return withInterfaces(s, lister, reader, admin)
+}
+
+// replicatedOptional implements the optional interfaces of a ReplicatedStorage
+// whose replicas all implement them
+type replicatedOptional struct {
+	*ReplicatedStorage
+}
+
+func (s *replicatedOptional) ListObjects(ctx context.Context, options *ListOptions) (objects []ObjectInfo, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		objects, err = r.Storage.(ObjectLister).ListObjects(ctx, options)
+		return err
+	})
+	return objects, err
+}
+
+func (s *replicatedOptional) StatObject(ctx context.Context, options *ListOptions) (info ObjectInfo, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		info, err = r.Storage.(ObjectLister).StatObject(ctx, options)
+		return err
+	})
+	return info, err
+}
+
+func (s *replicatedOptional) NewRangeReader(ctx context.Context, options *DownloadOptions, offset, length int64) (reader io.ReadCloser, err error) {
+	err = s.read(ctx, func(r *replica) error {
+		reader, err = r.Storage.(ObjectReader).NewRangeReader(ctx, options, offset, length)
+		return err
+	})
+	return reader, err
+}
+
+// administer runs fn on the primary then the secondaries. ACL changes aren't
+// repaired, failures of the secondaries are returned after trying all of them.
+func (s *replicatedOptional) administer(fn func(r *replica, admin Admin) error) error {
+	var errs []error
+	for _, r := range append([]*replica{s.primary}, s.secondaries...) {
+		err := fn(r, r.Storage.(Admin))
+		s.record(r, err)
+		if err == nil {
+			continue
+		}
+		if r == s.primary {
+			return err
+		}
+		s.logger.Printf("Couldn't change access on replica: %+v since: %+v", r.Name, err)
+		errs = append(errs, fmt.Errorf("replica %+v: %w", r.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *replicatedOptional) GrantRead(ctx context.Context, options *ACLOptions) error {
+	return s.administer(func(r *replica, admin Admin) error {
+		return admin.GrantRead(ctx, options)
+	})
+}
+
+func (s *replicatedOptional) RevokeRead(ctx context.Context, options *ACLOptions) error {
+	return s.administer(func(r *replica, admin Admin) error {
+		return admin.RevokeRead(ctx, options)
+	})
+}
+
+// MakePublic makes the object public on every replica and returns the primary's URL
+func (s *replicatedOptional) MakePublic(ctx context.Context, options *DownloadOptions) (url string, err error) {
+	err = s.administer(func(r *replica, admin Admin) error {
+		replicaURL, err := admin.MakePublic(ctx, options)
+		if r == s.primary {
+			url = replicaURL
+		}
+		return err
+	})
+	return url, err
+}
+
+// PublicURL returns the URL of the object on the primary
+func (s *replicatedOptional) PublicURL(options *DownloadOptions) (string, error) {
+	return s.primary.Storage.(Admin).PublicURL(options)
+}
+
+// BucketPolicy returns the policy of the primary's bucket
+func (s *replicatedOptional) BucketPolicy(ctx context.Context) (*BucketPolicy, error) {
+	policy, err := s.primary.Storage.(Admin).BucketPolicy(ctx)
+	s.record(s.primary, err)
+	return policy, err
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultRetryMaxAttempts    = 4
+	defaultRetryInitialBackoff = 200 * time.Millisecond
+	defaultRetryMaxBackoff     = 10 * time.Second
+	defaultRetryMultiplier     = 2
+)
+
+// RetryPolicy configures how storage operations are retried on transient errors.
+// Zero values fall back to the defaults of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one,
+	// 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts.
+	MaxBackoff time.Duration
+	// Multiplier grows the backoff after every attempt.
+	Multiplier float64
+	// Retryable classifies errors as transient. Defaults to IsRetryableErr.
+	Retryable func(err error) bool
+	// RetryNonIdempotent enables retries of operations which may not be safe
+	// to repeat, like uploads without preconditions. Deletes are always
+	// retried since a not found error of a retry counts as success.
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    defaultRetryMaxAttempts,
+		InitialBackoff: defaultRetryInitialBackoff,
+		MaxBackoff:     defaultRetryMaxBackoff,
+		Multiplier:     defaultRetryMultiplier,
+		Retryable:      IsRetryableErr,
+	}
+}
+
+func newRetryPolicy(policy *RetryPolicy) RetryPolicy {
+	p := DefaultRetryPolicy()
+	if policy == nil {
+		return p
+	}
+	if policy.MaxAttempts > 0 {
+		p.MaxAttempts = policy.MaxAttempts
+	}
+	if policy.InitialBackoff > 0 {
+		p.InitialBackoff = policy.InitialBackoff
+	}
+	if policy.MaxBackoff > 0 {
+		p.MaxBackoff = policy.MaxBackoff
+	}
+	if policy.Multiplier >= 1 {
+		p.Multiplier = policy.Multiplier
+	}
+	if policy.Retryable != nil {
+		p.Retryable = policy.Retryable
+	}
+	p.RetryNonIdempotent = policy.RetryNonIdempotent
+	return p
+}
+
+// Do runs fn until it succeeds, returns a non retryable error or the attempts
+// are exhausted. Non idempotent operations are attempted once unless
+// RetryNonIdempotent is set.
+func (p RetryPolicy) Do(ctx context.Context, idempotent bool, fn func(ctx context.Context) error) error {
+	p = newRetryPolicy(&p)
+	maxAttempts := p.MaxAttempts
+	if !idempotent && !p.RetryNonIdempotent {
+		maxAttempts = 1
+	}
+
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= maxAttempts || !p.Retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = time.Duration(float64(backoff) * p.Multiplier)
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// DoDelete runs a delete like Do. A not found error of a retry is a success
+// since an earlier attempt may have deleted the target before failing.
+func (p RetryPolicy) DoDelete(ctx context.Context, idempotent bool, isNotFound func(err error) bool, fn func(ctx context.Context) error) error {
+	attempt := 0
+	return p.Do(ctx, idempotent, func(ctx context.Context) error {
+		attempt++
+		err := fn(ctx)
+		if attempt > 1 && isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// jitter returns a random duration in [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// IsRetryableErr returns true for errors which are likely transient, like
+// 408, 429 and 5xx responses, connection failures and truncated reads.
+func IsRetryableErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	// Deadlines of a single attempt are retried, Do gives up once the
+	// caller's context is done.
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.Code)
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests ||
+		code >= http.StatusInternalServerError
+}
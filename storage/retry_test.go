@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func TestDoDelete(t *testing.T) {
+	errTransient := errors.New("transient")
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Retryable:      func(err error) bool { return errors.Is(err, errTransient) },
+	}
+	isNotFound := func(err error) bool { return errors.Is(err, ErrNotFound) }
+	tests := []struct {
+		name     string
+		errs     []error
+		want     error
+		attempts int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"not found on first attempt", []error{ErrNotFound}, ErrNotFound, 1},
+		{"not found on retry", []error{errTransient, ErrNotFound}, nil, 2},
+		{"exhausted", []error{errTransient, errTransient, errTransient}, errTransient, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := policy.DoDelete(context.Background(), true, isNotFound, func(ctx context.Context) error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+				t.Fatalf("got error %v, want %v", err, test.want)
+			}
+			if attempts != test.attempts {
+				t.Fatalf("got %d attempts, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestIsAzureRetryableErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttled", &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server error", &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"not found", &azcore.ResponseError{StatusCode: http.StatusNotFound}, false},
+		{"truncated read", io.ErrUnexpectedEOF, true},
+		{"canceled", context.Canceled, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isAzureRetryableErr(test.err); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			if IsRetryableErr(test.err) && !test.want {
+				t.Fatalf("IsRetryableErr retries %v", test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned for URLs which weren't signed with the server's key
+	ErrInvalidSignature = errors.New("invalid url signature")
+	// ErrSignatureExpired is returned for signed URLs past their expiry
+	ErrSignatureExpired = errors.New("url signature expired")
+)
+
+// AuditEvent describes a request served by a SignedURLServer
+type AuditEvent struct {
+	Time   time.Time
+	Method string
+	Path   string
+	// Key is the requested object, empty if the signature is invalid
+	Key        string
+	RemoteAddr string
+	UserAgent  string
+	Status     int
+	Err        error
+}
+
+type SignedURLServerParams struct {
+	// Storage serves the objects
+	Storage Storage
+	// BaseURL is the public URL the server is reachable at, e.g.
+	// https://artifacts.example.com/download. Objects are served from BaseURL/<folder>/<key>.
+	BaseURL string
+	// Key is the HMAC-SHA256 secret signing the URLs
+	Key []byte
+	// Expiry is the validity of signed URLs. Defaults to preSignURLExpiryDuration.
+	Expiry time.Duration
+	// Audit is called once per request, if nil requests are logged with Logger
+	Audit func(AuditEvent)
+	// HTTPClient fetches signed URLs in DownloadFromCdn. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	Logger     *log.Logger
+}
+
+// SignedURLServer issues expiring HMAC signed URLs for the objects of any
+// Storage backend and serves them over HTTP. Backends without native signed
+// URLs can use it for GetTempTokenForDownload and DownloadFromCdn.
+type SignedURLServer struct {
+	storage    Storage
+	baseURL    *url.URL
+	key        []byte
+	expiry     time.Duration
+	audit      func(AuditEvent)
+	httpClient *http.Client
+	retry      RetryPolicy
+	logger     *log.Logger
+}
+
+// NewSignedURLServer returns a server for the given params
+func NewSignedURLServer(params SignedURLServerParams) (*SignedURLServer, error) {
+	if params.Storage == nil {
+		return nil, errors.New("missing storage client")
+	}
+	if len(params.Key) == 0 {
+		return nil, errors.New("missing url signing key")
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(params.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed url base url: %+v since: %+v", params.BaseURL, err)
+	}
+	if baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, fmt.Errorf("signed url base url: %+v must include scheme and host", params.BaseURL)
+	}
+	s := &SignedURLServer{
+		storage:    params.Storage,
+		baseURL:    baseURL,
+		key:        params.Key,
+		expiry:     preSignURLExpiryDuration,
+		audit:      params.Audit,
+		httpClient: http.DefaultClient,
+		retry:      DefaultRetryPolicy(),
+		logger:     params.Logger,
+	}
+	if s.logger == nil {
+		s.logger = log.Default()
+	}
+	if params.Expiry > 0 {
+		s.expiry = params.Expiry
+	}
+	if params.HTTPClient != nil {
+		s.httpClient = params.HTTPClient
+	}
+	if s.audit == nil {
+		s.audit = s.logAudit
+	}
+	return s, nil
+}
+
+// GetTempTokenForDownload returns a signed URL for the object valid for the server's expiry
+func (s *SignedURLServer) GetTempTokenForDownload(ctx context.Context, options *DownloadOptions) (string, error) {
+	return s.SignURL(options, time.Now().Add(s.expiry))
+}
+
+// SignURL returns a URL for the object valid until expires
+func (s *SignedURLServer) SignURL(options *DownloadOptions, expires time.Time) (string, error) {
+	if options == nil {
+		return "", errors.New("missing download options")
+	}
+	key, err := ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return "", err
+	}
+	u := *s.baseURL
+	u.Path = s.baseURL.Path + DirDelim + key
+	expiresAt := strconv.FormatInt(expires.Unix(), 10)
+	u.RawQuery = url.Values{
+		"Expires":   {expiresAt},
+		"Signature": {s.sign(key, expiresAt)},
+	}.Encode()
+	return u.String(), nil
+}
+
+// DownloadFromCdn downloads the object through a signed URL of the server
+func (s *SignedURLServer) DownloadFromCdn(ctx context.Context, options *DownloadOptions) ([]byte, error) {
+	signedURL, err := s.GetTempTokenForDownload(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	var output []byte
+	err = s.retry.Do(ctx, true, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, signedURL, http.NoBody)
+		if err != nil {
+			return err
+		}
+		res, err := s.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return &httpStatusError{StatusCode: res.StatusCode}
+		}
+		transfer := newTransfer(options.Progress, options.Limiter, nil)
+		output, err = io.ReadAll(transfer.reader(ctx, res.Body, res.ContentLength))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error downloading file: %+v via signed url since: %w", options.Key, err)
+	}
+	return output, nil
+}
+
+// sign returns the signature of key and expires. The key is prefixed with
+// its length so that no other key and expiry sign the same payload.
+func (s *SignedURLServer) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(key)))
+	mac.Write(length)
+	mac.Write([]byte(key))
+	mac.Write([]byte(expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a request and returns the requested object key
+func (s *SignedURLServer) Verify(r *http.Request) (string, error) {
+	key, ok := strings.CutPrefix(r.URL.Path, s.baseURL.Path+DirDelim)
+	if !ok || key == "" {
+		return "", fmt.Errorf("%w: unknown path %+v", ErrInvalidSignature, r.URL.Path)
+	}
+	if _, err := JoinKey(key); err != nil {
+		return "", err
+	}
+	query := r.URL.Query()
+	expiresAt := query.Get("Expires")
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("Signature"))
+	if err != nil || expiresAt == "" {
+		return "", ErrInvalidSignature
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(s.sign(key, expiresAt))
+	if !hmac.Equal(signature, expected) {
+		return "", ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if time.Now().Unix() > expires {
+		return "", ErrSignatureExpired
+	}
+	return key, nil
+}
+
+// ServeHTTP serves GET and HEAD requests of signed URLs, including range requests
+func (s *SignedURLServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	event := AuditEvent{
+		Time:       time.Now(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		event.Status = recorder.status
+		s.audit(event)
+	}()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		recorder.Header().Set("Allow", "GET, HEAD")
+		http.Error(recorder, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := s.Verify(r)
+	event.Key = key
+	if err != nil {
+		event.Err = err
+		http.Error(recorder, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	content, info, err := s.open(r.Context(), key)
+	if err != nil {
+		event.Err = err
+		if s.storage.IsNotFoundErr(err) {
+			http.Error(recorder, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		http.Error(recorder, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if info.ContentType != "" {
+		recorder.Header().Set("Content-Type", info.ContentType)
+	}
+	recorder.Header().Set("Cache-Control", "private, max-age=0")
+	http.ServeContent(recorder, r, key, info.Updated, content)
+}
+
+// open returns the object for random access, through range reads if the
+// backend supports it, otherwise the object is downloaded in memory.
+func (s *SignedURLServer) open(ctx context.Context, key string) (io.ReadSeeker, ObjectInfo, error) {
+	options := &DownloadOptions{Key: key}
+	objectReader, streams := s.storage.(ObjectReader)
+	lister, stats := s.storage.(ObjectLister)
+	if streams && stats {
+		info, err := lister.StatObject(ctx, &ListOptions{Key: key})
+		if err != nil {
+			return nil, info, err
+		}
+		readerAt := &rangeReaderAt{ctx: ctx, reader: objectReader, options: options, size: info.Size}
+		return io.NewSectionReader(readerAt, 0, info.Size), info, nil
+	}
+	data, err := s.storage.Download(ctx, options)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return bytes.NewReader(data), ObjectInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+func (s *SignedURLServer) logAudit(event AuditEvent) {
+	if event.Err != nil {
+		s.logger.Printf("Signed url %+v %+v from %+v: %d since: %+v", event.Method, event.Path, event.RemoteAddr, event.Status, event.Err)
+		return
+	}
+	s.logger.Printf("Signed url %+v %+v from %+v: %d", event.Method, event.Path, event.RemoteAddr, event.Status)
+}
+
+// statusRecorder captures the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
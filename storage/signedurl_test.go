@@ -0,0 +1,16 @@
+package storage
+
+import "testing"
+
+func TestSignSeparatesKeyAndExpiry(t *testing.T) {
+	s := &SignedURLServer{key: []byte("signing-key")}
+	pairs := [][2][2]string{
+		{{"folder/a\n1", "2"}, {"folder/a", "1\n2"}},
+		{{"folder/a1", "2"}, {"folder/a", "12"}},
+	}
+	for _, pair := range pairs {
+		if s.sign(pair[0][0], pair[0][1]) == s.sign(pair[1][0], pair[1][1]) {
+			t.Errorf("key %q expiring %q has the signature of key %q expiring %q", pair[0][0], pair[0][1], pair[1][0], pair[1][1])
+		}
+	}
+}
@@ -4,18 +4,30 @@ import (
 	"context"
 	"io"
 	"log"
+	"os"
 	"strings"
+	"time"
 )
 
 type DownloadOptions struct {
 	Folder string
 	Key    string
+	// Progress reports the bytes downloaded, optional
+	Progress Progress
+	// Limiter throttles the download, it overrides the client's limiter
+	Limiter *BandwidthLimiter
 }
 
 type UploadOptions struct {
 	Folder   string // Bucket or Container Name
 	Key      string
 	FileType string
+	// Metadata is stored with the object, e.g. job id, tenant or test name
+	Metadata map[string]string
+	// Progress reports the bytes uploaded, optional
+	Progress Progress
+	// Limiter throttles the upload, it overrides the client's limiter
+	Limiter *BandwidthLimiter
 }
 
 type ListOptions struct {
@@ -30,6 +42,9 @@ type DeleteOptions struct {
 	Folder   string
 	Key      string
 	FileType string
+	// IfVersion deletes the object only if its ObjectInfo.Version still
+	// matches, otherwise Delete fails with ErrPreconditionFailed. Optional.
+	IfVersion string
 }
 
 type Storage interface {
@@ -42,7 +57,7 @@ type Storage interface {
 	// ListKeys list all the keys for given options
 	ListKeys(ctx context.Context, options *ListOptions) ([]string, error)
 	// GetTempTokenForDownload returns the signed token to download files.
-	GetTempTokenForDownload(options *DownloadOptions) (string, error)
+	GetTempTokenForDownload(ctx context.Context, options *DownloadOptions) (string, error)
 	// DownloadFromCdn download objects via CDN
 	DownloadFromCdn(ctx context.Context, options *DownloadOptions) (output []byte, err error)
 	// Delete deletes the object for given options
@@ -51,6 +66,152 @@ type Storage interface {
 	IsNotFoundErr(err error) bool
 }
 
+// ObjectInfo describes an object or, for non recursive listings, a directory prefix
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	Created     time.Time
+	Updated     time.Time
+	IsDir       bool
+	Metadata    map[string]string
+	// Version identifies the object's content, e.g. its GCS generation or
+	// Azure ETag. It changes on every update, empty if unknown.
+	Version string
+}
+
+// ObjectLister is implemented by Storage backends which can report object attributes
+type ObjectLister interface {
+	// ListObjects lists the objects for given options along with their attributes
+	ListObjects(ctx context.Context, options *ListOptions) ([]ObjectInfo, error)
+	// StatObject returns the attributes of the object for given options
+	StatObject(ctx context.Context, options *ListOptions) (ObjectInfo, error)
+}
+
+// ObjectReader is implemented by Storage backends which can stream objects
+type ObjectReader interface {
+	// NewRangeReader returns a reader for length bytes of the object starting
+	// at offset, a negative length reads until the end of the object.
+	NewRangeReader(ctx context.Context, options *DownloadOptions, offset, length int64) (io.ReadCloser, error)
+}
+
+// ACLOptions selects the objects and the entity of an ACL change. A Key
+// selects a single object, otherwise every object under Folder and Prefix.
+type ACLOptions struct {
+	Folder string
+	Key    string
+	Prefix string
+	// Entity is granted or revoked access, e.g. "user-jane@example.com",
+	// "group-team@example.com", "domain-example.com" or "allUsers".
+	Entity string
+}
+
+// PolicyBinding grants a role to a set of members
+type PolicyBinding struct {
+	Role    string
+	Members []string
+}
+
+// BucketPolicy is the IAM policy of a bucket
+type BucketPolicy struct {
+	Bindings []PolicyBinding
+}
+
+// Members returns the members having the given role
+func (p *BucketPolicy) Members(role string) []string {
+	for _, binding := range p.Bindings {
+		if binding.Role == role {
+			return binding.Members
+		}
+	}
+	return nil
+}
+
+// Admin is implemented by Storage backends which can manage access to objects
+type Admin interface {
+	// GrantRead gives the entity read access to the objects for given options.
+	// Objects created afterwards under a prefix aren't affected.
+	GrantRead(ctx context.Context, options *ACLOptions) error
+	// RevokeRead removes the entity's access to the objects for given options
+	RevokeRead(ctx context.Context, options *ACLOptions) error
+	// MakePublic gives everyone read access to the object and returns its PublicURL
+	MakePublic(ctx context.Context, options *DownloadOptions) (string, error)
+	// PublicURL returns the stable, unsigned URL of a public object
+	PublicURL(options *DownloadOptions) (string, error)
+	// BucketPolicy returns the IAM policy of the bucket
+	BucketPolicy(ctx context.Context) (*BucketPolicy, error)
+}
+
+// withOptional returns s along with the ObjectLister, ObjectReader and Admin
+// interfaces implemented by wrapped, for decorators of a Storage. The methods
+// of those interfaces are s's own when it implements them, e.g. to instrument
+// them, and wrapped's otherwise. s is always hidden behind a struct so that it
+// never exposes an optional interface which wrapped lacks.
+func withOptional(s Storage, wrapped Storage) Storage {
+	lister, lists := wrapped.(ObjectLister)
+	if own, ok := s.(ObjectLister); ok && lists {
+		lister = own
+	}
+	reader, reads := wrapped.(ObjectReader)
+	if own, ok := s.(ObjectReader); ok && reads {
+		reader = own
+	}
+	admin, administers := wrapped.(Admin)
+	if own, ok := s.(Admin); ok && administers {
+		admin = own
+	}
+	return withInterfaces(s, lister, reader, admin)
+}
+
+// withInterfaces returns s along with the given optional interfaces, nil
+// ones are left out
+func withInterfaces(s Storage, lister ObjectLister, reader ObjectReader, admin Admin) Storage {
+	lists, reads, administers := lister != nil, reader != nil, admin != nil
+	switch {
+	case lists && reads && administers:
+		return struct {
+			Storage
+			ObjectLister
+			ObjectReader
+			Admin
+		}{s, lister, reader, admin}
+	case lists && reads:
+		return struct {
+			Storage
+			ObjectLister
+			ObjectReader
+		}{s, lister, reader}
+	case lists && administers:
+		return struct {
+			Storage
+			ObjectLister
+			Admin
+		}{s, lister, admin}
+	case reads && administers:
+		return struct {
+			Storage
+			ObjectReader
+			Admin
+		}{s, reader, admin}
+	case lists:
+		return struct {
+			Storage
+			ObjectLister
+		}{s, lister}
+	case reads:
+		return struct {
+			Storage
+			ObjectReader
+		}{s, reader}
+	case administers:
+		return struct {
+			Storage
+			Admin
+		}{s, admin}
+	}
+	return struct{ Storage }{s}
+}
+
 // NewStorageClient returns new storage client
 func NewStorageClient(ctx context.Context, cloudProvider, bucketName string, logger log.Logger) (Storage, error) {
 
@@ -59,13 +220,21 @@ func NewStorageClient(ctx context.Context, cloudProvider, bucketName string, log
 		return newGCSClient(ctx, GCSBucketParams{
 			Bucket:         bucketName,
 			ServiceAccount: "",
-			Logger:         logger,
+			Logger:         &logger,
+		})
+	case "azure":
+		// bucketName is the storage account, its key is read from the environment.
+		return newAzureClient(AzureParams{
+			AccountName:      bucketName,
+			AccountKey:       os.Getenv("AZURE_STORAGE_KEY"),
+			ConnectionString: os.Getenv("AZURE_STORAGE_CONNECTION_STRING"),
+			Logger:           &logger,
 		})
 	default:
 		return newGCSClient(ctx, GCSBucketParams{
 			Bucket:         bucketName,
 			ServiceAccount: "",
-			Logger:         logger,
+			Logger:         &logger,
 		})
 	}
 }
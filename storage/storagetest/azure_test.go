@@ -0,0 +1,7 @@
+package storagetest
+
+import "testing"
+
+func TestAzureEmulator(t *testing.T) {
+	RunAzureEmulator(t)
+}
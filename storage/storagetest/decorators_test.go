@@ -0,0 +1,190 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+// decorate wraps s in every decorator of the storage package
+func decorate(t *testing.T, s storage.Storage) map[string]storage.Storage {
+	t.Helper()
+	instrumented, err := storage.NewInstrumentedStorage(storage.TelemetryParams{Storage: s, Provider: "test"})
+	if err != nil {
+		t.Fatalf("couldn't instrument storage: %+v", err)
+	}
+	index, err := storage.OpenMetadataIndex(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("couldn't open index: %+v", err)
+	}
+	t.Cleanup(func() { index.Close() })
+	indexed, err := storage.NewIndexedStorage(storage.IndexParams{Storage: s, Index: index})
+	if err != nil {
+		t.Fatalf("couldn't index storage: %+v", err)
+	}
+	decorated := map[string]storage.Storage{"instrumented": instrumented, "indexed": indexed}
+	// Quotas are computed from object listings.
+	if _, ok := s.(storage.ObjectLister); ok {
+		quota, err := storage.NewQuotaStorage(storage.QuotaParams{Storage: s})
+		if err != nil {
+			t.Fatalf("couldn't limit storage: %+v", err)
+		}
+		decorated["quota"] = quota
+	}
+	return decorated
+}
+
+// plainStorage is an in-memory Storage implementing none of the optional interfaces
+type plainStorage struct {
+	objects map[string][]byte
+}
+
+func newPlainStorage() *plainStorage {
+	return &plainStorage{objects: make(map[string][]byte)}
+}
+
+func (p *plainStorage) Download(ctx context.Context, options *storage.DownloadOptions) ([]byte, error) {
+	key, err := storage.ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := p.objects[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (p *plainStorage) Upload(ctx context.Context, options *storage.UploadOptions, r io.Reader) error {
+	key, err := storage.ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p.objects[key] = data
+	return nil
+}
+
+func (p *plainStorage) Exists(ctx context.Context, options *storage.ListOptions) (bool, error) {
+	key, err := storage.ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return false, err
+	}
+	_, ok := p.objects[key]
+	return ok, nil
+}
+
+func (p *plainStorage) ListKeys(ctx context.Context, options *storage.ListOptions) ([]string, error) {
+	prefix, err := storage.PrefixKey(options.Folder, options.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range p.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (p *plainStorage) GetTempTokenForDownload(ctx context.Context, options *storage.DownloadOptions) (string, error) {
+	return "", errors.New("signed URLs not supported")
+}
+
+func (p *plainStorage) DownloadFromCdn(ctx context.Context, options *storage.DownloadOptions) ([]byte, error) {
+	return p.Download(ctx, options)
+}
+
+func (p *plainStorage) Delete(ctx context.Context, options *storage.DeleteOptions) error {
+	key, err := storage.ObjectKey(options.Folder, options.Key)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.objects[key]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(p.objects, key)
+	return nil
+}
+
+func (p *plainStorage) IsNotFoundErr(err error) bool {
+	return errors.Is(err, storage.ErrNotFound)
+}
+
+func TestDecoratorsKeepOptionalInterfaces(t *testing.T) {
+	s, _ := NewFakeGCSStorage(t, "storagetest-bucket")
+	want, err := s.(storage.Admin).PublicURL(&storage.DownloadOptions{Folder: "a", Key: "b"})
+	if err != nil {
+		t.Fatalf("couldn't get public URL: %+v", err)
+	}
+	for name, decorated := range decorate(t, s) {
+		if _, ok := decorated.(storage.ObjectLister); !ok {
+			t.Errorf("%s storage dropped ObjectLister", name)
+		}
+		if _, ok := decorated.(storage.ObjectReader); !ok {
+			t.Errorf("%s storage dropped ObjectReader", name)
+		}
+		admin, ok := decorated.(storage.Admin)
+		if !ok {
+			t.Errorf("%s storage dropped Admin", name)
+			continue
+		}
+		if got, err := admin.PublicURL(&storage.DownloadOptions{Folder: "a", Key: "b"}); err != nil || got != want {
+			t.Errorf("%s storage returned public URL %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestDecoratorsDontAddOptionalInterfaces(t *testing.T) {
+	s, _ := NewFakeAzureStorage(t, defaultFolder)
+	for name, decorated := range decorate(t, s) {
+		if _, ok := decorated.(storage.Admin); ok {
+			t.Errorf("%s storage implements Admin over Azure", name)
+		}
+	}
+}
+
+func TestDecoratorsWithoutOptionalInterfaces(t *testing.T) {
+	for name, decorated := range decorate(t, newPlainStorage()) {
+		if _, ok := decorated.(storage.ObjectLister); ok {
+			t.Errorf("%s storage implements ObjectLister over a plain storage", name)
+		}
+		if _, ok := decorated.(storage.ObjectReader); ok {
+			t.Errorf("%s storage implements ObjectReader over a plain storage", name)
+		}
+		if _, ok := decorated.(storage.Admin); ok {
+			t.Errorf("%s storage implements Admin over a plain storage", name)
+		}
+
+		// Archives fall back to plain downloads instead of range reads.
+		src := t.TempDir()
+		if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		options := &storage.UploadOptions{Folder: "archives", Key: name + ".tar.gz"}
+		if err := storage.UploadDirectory(context.Background(), decorated, src, options, storage.ArchiveTarGz); err != nil {
+			t.Fatalf("%s storage couldn't upload archive: %+v", name, err)
+		}
+		dst := t.TempDir()
+		err := storage.DownloadAndExtract(context.Background(), decorated,
+			&storage.DownloadOptions{Folder: "archives", Key: name + ".tar.gz"}, dst, storage.ArchiveTarGz)
+		if err != nil {
+			t.Fatalf("%s storage couldn't extract archive: %+v", name, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(data) != "a" {
+			t.Fatalf("%s storage extracted %q, %v, want %q", name, data, err, "a")
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+// TestGCSCorruptedDownload pins the error of the storage package's readers
+// for downloads whose CRC32C doesn't match.
+func TestGCSCorruptedDownload(t *testing.T) {
+	s, server := NewFakeGCSStorage(t, "bucket")
+	if err := upload(t, s, "folder", "a", "data"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	if !server.CorruptObject("bucket", "folder/a") {
+		t.Fatal("object missing from the fake server")
+	}
+	ctx := context.Background()
+	if _, err := s.Download(ctx, &storage.DownloadOptions{Folder: "folder", Key: "a"}); !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("Download of corrupted object returned %v, want ErrChecksumMismatch", err)
+	}
+	reader, err := s.(storage.ObjectReader).NewRangeReader(ctx, &storage.DownloadOptions{Folder: "folder", Key: "a"}, 0, -1)
+	if err != nil {
+		t.Fatalf("NewRangeReader: %+v", err)
+	}
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("reading corrupted object returned %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestNotFoundErrors(t *testing.T) {
+	gcs, _ := NewFakeGCSStorage(t, "bucket")
+	azure, _ := NewFakeAzureStorage(t, "container")
+	for name, s := range map[string]storage.Storage{"gcs": gcs, "azure": azure} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_, err := s.Download(ctx, &storage.DownloadOptions{Folder: "folder", Key: "missing"})
+			if !errors.Is(err, storage.ErrNotFound) || !s.IsNotFoundErr(err) {
+				t.Fatalf("Download of missing object returned %v, want ErrNotFound", err)
+			}
+			_, err = s.(storage.ObjectLister).StatObject(ctx, &storage.ListOptions{Folder: "folder", Key: "missing"})
+			if !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("StatObject of missing object returned %v, want ErrNotFound", err)
+			}
+			var storageErr *storage.Error
+			if !errors.As(err, &storageErr) || storageErr.Key == "" {
+				t.Fatalf("StatObject returned %#v, want a *storage.Error naming the key", err)
+			}
+		})
+	}
+}
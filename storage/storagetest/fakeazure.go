@@ -0,0 +1,368 @@
+package storagetest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FakeAzureAccount and FakeAzureKey are the well known credentials of
+	// the Azurite emulator, accepted but not verified by FakeAzureServer.
+	FakeAzureAccount = "devstoreaccount1"
+	FakeAzureKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// FakeAzureServer is an in-memory stand-in for the parts of the Azure Blob
+// service used by the storage package, addressed path-style like Azurite:
+// containers, block blob uploads, downloads with ranges, properties, flat
+// and hierarchical listing and deletes. Requests aren't authenticated.
+type FakeAzureServer struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	containers map[string]map[string]*fakeObject
+	// blocks holds the staged blocks of each container/blob by block id
+	blocks map[string]map[string][]byte
+}
+
+// NewFakeAzureServer starts a fake Azure Blob server hosting the given
+// containers. Its service URL is ServiceURL and it must be closed when done.
+func NewFakeAzureServer(containers ...string) *FakeAzureServer {
+	f := &FakeAzureServer{
+		containers: make(map[string]map[string]*fakeObject),
+		blocks:     make(map[string]map[string][]byte),
+	}
+	for _, container := range containers {
+		f.containers[container] = make(map[string]*fakeObject)
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// ServiceURL returns the blob service URL of the fake account
+func (f *FakeAzureServer) ServiceURL() string {
+	return f.URL + "/" + FakeAzureAccount + "/"
+}
+
+// Blobs returns the names of all blobs stored in container
+func (f *FakeAzureServer) Blobs(container string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	names := make([]string, 0, len(f.containers[container]))
+	for name := range f.containers[container] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *FakeAzureServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.Path, "/"+FakeAzureAccount+"/")
+	if !ok {
+		writeAzureError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	container, name, _ := strings.Cut(path, "/")
+	query := r.URL.Query()
+	switch {
+	case name == "" && query.Get("restype") == "container" && query.Get("comp") == "list":
+		f.handleList(w, r, container)
+	case name == "" && query.Get("restype") == "container" && r.Method == http.MethodPut:
+		f.handleCreateContainer(w, container)
+	case name == "":
+		writeAzureError(w, http.StatusNotImplemented, "UnsupportedRequest")
+	case r.Method == http.MethodPut:
+		f.handlePut(w, r, container, name)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.handleGet(w, r, container, name)
+	case r.Method == http.MethodDelete:
+		f.handleDelete(w, r, container, name)
+	default:
+		writeAzureError(w, http.StatusMethodNotAllowed, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *FakeAzureServer) handleCreateContainer(w http.ResponseWriter, container string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.containers[container]; ok {
+		writeAzureError(w, http.StatusConflict, "ContainerAlreadyExists")
+		return
+	}
+	f.containers[container] = make(map[string]*fakeObject)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *FakeAzureServer) handlePut(w http.ResponseWriter, r *http.Request, container, name string) {
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+	query := r.URL.Query()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	objects, ok := f.containers[container]
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	blobKey := container + "/" + name
+	switch query.Get("comp") {
+	case "block":
+		if f.blocks[blobKey] == nil {
+			f.blocks[blobKey] = make(map[string][]byte)
+		}
+		f.blocks[blobKey][query.Get("blockid")] = body.Bytes()
+		w.WriteHeader(http.StatusCreated)
+		return
+	case "blocklist":
+		var list struct {
+			Latest      []string `xml:"Latest"`
+			Uncommitted []string `xml:"Uncommitted"`
+		}
+		if err := xml.Unmarshal(body.Bytes(), &list); err != nil {
+			writeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range append(list.Latest, list.Uncommitted...) {
+			block, ok := f.blocks[blobKey][id]
+			if !ok {
+				writeAzureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(f.blocks, blobKey)
+		objects[name] = newAzureObject(r, container, name, data, objects[name])
+	case "":
+		objects[name] = newAzureObject(r, container, name, body.Bytes(), objects[name])
+	default:
+		writeAzureError(w, http.StatusNotImplemented, "UnsupportedQueryParameter")
+		return
+	}
+	w.Header().Set("ETag", azureETag(objects[name]))
+	w.Header().Set("Last-Modified", objects[name].Updated.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newAzureObject(r *http.Request, container, name string, data []byte, previous *fakeObject) *fakeObject {
+	now := time.Now().UTC().Truncate(time.Second)
+	object := &fakeObject{
+		Bucket:      container,
+		Name:        name,
+		Data:        data,
+		ContentType: r.Header.Get("X-Ms-Blob-Content-Type"),
+		Created:     now,
+		Updated:     now,
+	}
+	if object.ContentType == "" {
+		object.ContentType = "application/octet-stream"
+	}
+	if previous != nil {
+		object.Created = previous.Created
+		object.Generation = previous.Generation + 1
+	}
+	for header, values := range r.Header {
+		if metaName, ok := strings.CutPrefix(strings.ToLower(header), "x-ms-meta-"); ok && len(values) > 0 {
+			if object.Metadata == nil {
+				object.Metadata = make(map[string]string)
+			}
+			object.Metadata[metaName] = values[0]
+		}
+	}
+	return object
+}
+
+func azureETag(object *fakeObject) string {
+	return `"0x` + strconv.FormatInt(object.Updated.UnixNano()+object.Generation, 16) + `"`
+}
+
+func (f *FakeAzureServer) handleGet(w http.ResponseWriter, r *http.Request, container, name string) {
+	f.mutex.Lock()
+	objects, ok := f.containers[container]
+	var object *fakeObject
+	if ok {
+		object = objects[name]
+	}
+	f.mutex.Unlock()
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	if object == nil {
+		writeAzureError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", object.ContentType)
+	header.Set("ETag", azureETag(object))
+	header.Set("X-Ms-Blob-Type", "BlockBlob")
+	header.Set("X-Ms-Creation-Time", object.Created.Format(http.TimeFormat))
+	for metaName, value := range object.Metadata {
+		header.Set("X-Ms-Meta-"+metaName, value)
+	}
+	// The blob range is sent in x-ms-range, served like a standard Range header.
+	if blobRange := r.Header.Get("X-Ms-Range"); blobRange != "" {
+		r.Header.Set("Range", blobRange)
+	}
+	http.ServeContent(w, r, object.Name, object.Updated, bytes.NewReader(object.Data))
+}
+
+func (f *FakeAzureServer) handleDelete(w http.ResponseWriter, r *http.Request, container, name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	objects, ok := f.containers[container]
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	object, ok := objects[name]
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != azureETag(object) {
+		writeAzureError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+		return
+	}
+	delete(objects, name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// blobListResponse is the XML representation of a blob listing
+type blobListResponse struct {
+	XMLName       xml.Name         `xml:"EnumerationResults"`
+	ContainerName string           `xml:"ContainerName,attr"`
+	Prefix        string           `xml:"Prefix"`
+	Delimiter     string           `xml:"Delimiter,omitempty"`
+	Blobs         []blobResource   `xml:"Blobs>Blob"`
+	Prefixes      []prefixResource `xml:"Blobs>BlobPrefix"`
+	NextMarker    string           `xml:"NextMarker"`
+}
+
+type blobResource struct {
+	Name       string             `xml:"Name"`
+	Properties blobProperties     `xml:"Properties"`
+	Metadata   blobMetadataValues `xml:"Metadata"`
+}
+
+type blobProperties struct {
+	CreationTime  string `xml:"Creation-Time"`
+	LastModified  string `xml:"Last-Modified"`
+	Etag          string `xml:"Etag"`
+	ContentLength int64  `xml:"Content-Length"`
+	ContentType   string `xml:"Content-Type"`
+	ContentMD5    string `xml:"Content-MD5,omitempty"`
+	BlobType      string `xml:"BlobType"`
+}
+
+type prefixResource struct {
+	Name string `xml:"Name"`
+}
+
+// blobMetadataValues encodes metadata as one element per name
+type blobMetadataValues map[string]string
+
+func (m blobMetadataValues) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := enc.EncodeElement(m[name], xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func (f *FakeAzureServer) handleList(w http.ResponseWriter, r *http.Request, container string) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	withMetadata := strings.Contains(query.Get("include"), "metadata")
+
+	f.mutex.Lock()
+	objects, ok := f.containers[container]
+	if !ok {
+		f.mutex.Unlock()
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	response := blobListResponse{ContainerName: f.ServiceURL() + container, Prefix: prefix, Delimiter: delimiter}
+	prefixSet := map[string]bool{}
+	for name, object := range objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if idx := strings.Index(name[len(prefix):], delimiter); idx >= 0 {
+				prefixSet[name[:len(prefix)+idx+len(delimiter)]] = true
+				continue
+			}
+		}
+		blob := blobResource{
+			Name: name,
+			Properties: blobProperties{
+				CreationTime:  object.Created.Format(http.TimeFormat),
+				LastModified:  object.Updated.Format(http.TimeFormat),
+				Etag:          azureETag(object),
+				ContentLength: int64(len(object.Data)),
+				ContentType:   object.ContentType,
+				BlobType:      "BlockBlob",
+			},
+		}
+		if withMetadata {
+			blob.Metadata = object.Metadata
+		}
+		response.Blobs = append(response.Blobs, blob)
+	}
+	f.mutex.Unlock()
+
+	sort.Slice(response.Blobs, func(i, j int) bool { return response.Blobs[i].Name < response.Blobs[j].Name })
+	prefixes := make([]string, 0, len(prefixSet))
+	for p := range prefixSet {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		response.Prefixes = append(response.Prefixes, prefixResource{Name: p})
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+func writeXML(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(body)
+}
+
+// writeAzureError writes an error response, the code is sent in the
+// x-ms-error-code header as well since HEAD responses have no body.
+func writeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: http.StatusText(status)})
+}
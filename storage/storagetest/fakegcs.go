@@ -0,0 +1,440 @@
+package storagetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeGCSServer is an in-memory stand-in for the parts of the GCS JSON and
+// XML APIs used by the storage package: uploads (multipart and resumable),
+// media downloads with ranges, object attributes, listing and deletes.
+type FakeGCSServer struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	buckets    map[string]map[string]*fakeObject
+	uploads    map[string]*fakeUpload
+	generation int64
+}
+
+type fakeObject struct {
+	Bucket      string
+	Name        string
+	Data        []byte
+	ContentType string
+	Metadata    map[string]string
+	Created     time.Time
+	Updated     time.Time
+	Generation  int64
+	// CRC32C is computed on upload, CorruptObject leaves it unchanged
+	CRC32C string
+}
+
+type fakeUpload struct {
+	bucket   string
+	metadata objectResource
+	data     bytes.Buffer
+}
+
+// objectResource is the JSON representation of an object
+type objectResource struct {
+	Kind           string            `json:"kind,omitempty"`
+	ID             string            `json:"id,omitempty"`
+	Bucket         string            `json:"bucket,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Size           string            `json:"size,omitempty"`
+	ContentType    string            `json:"contentType,omitempty"`
+	Generation     string            `json:"generation,omitempty"`
+	Metageneration string            `json:"metageneration,omitempty"`
+	TimeCreated    string            `json:"timeCreated,omitempty"`
+	Updated        string            `json:"updated,omitempty"`
+	MD5Hash        string            `json:"md5Hash,omitempty"`
+	CRC32C         string            `json:"crc32c,omitempty"`
+	Etag           string            `json:"etag,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+// NewFakeGCSServer starts a fake GCS server hosting the given buckets. Point
+// clients to it with STORAGE_EMULATOR_HOST set to its URL and close it when done.
+func NewFakeGCSServer(buckets ...string) *FakeGCSServer {
+	f := &FakeGCSServer{
+		buckets: make(map[string]map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = make(map[string]*fakeObject)
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// Objects returns the names of all objects stored in bucket
+func (f *FakeGCSServer) Objects(bucket string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	names := make([]string, 0, len(f.buckets[bucket]))
+	for name := range f.buckets[bucket] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CorruptObject flips a bit of the object's data without updating its
+// checksum, as if it was corrupted in transit
+func (f *FakeGCSServer) CorruptObject(bucket, name string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	object, ok := f.buckets[bucket][name]
+	if !ok || len(object.Data) == 0 {
+		return false
+	}
+	data := append([]byte(nil), object.Data...)
+	data[0] ^= 1
+	object.Data = data
+	return true
+}
+
+func (f *FakeGCSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/")
+		f.handleUpload(w, r, bucket)
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		bucket, rest, _ := strings.Cut(strings.TrimPrefix(path, "/storage/v1/b/"), "/")
+		switch {
+		case rest == "o":
+			f.handleList(w, r, bucket)
+		case strings.HasPrefix(rest, "o/"):
+			f.handleObject(w, r, bucket, strings.TrimPrefix(rest, "o/"))
+		default:
+			writeError(w, http.StatusNotImplemented, "unsupported request")
+		}
+	default:
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		f.handleMedia(w, r, bucket, name)
+	}
+}
+
+func (f *FakeGCSServer) lookup(bucket, name string) (*fakeObject, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		return nil, http.StatusNotFound
+	}
+	object, ok := objects[name]
+	if !ok {
+		return nil, http.StatusNotFound
+	}
+	return object, http.StatusOK
+}
+
+func (f *FakeGCSServer) handleMedia(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	object, status := f.lookup(bucket, name)
+	if object == nil {
+		writeError(w, status, "No such object: "+bucket+"/"+name)
+		return
+	}
+	serveContent(w, r, object)
+}
+
+func serveContent(w http.ResponseWriter, r *http.Request, object *fakeObject) {
+	w.Header().Set("Content-Type", object.ContentType)
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.Generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("X-Goog-Hash", "crc32c="+object.CRC32C)
+	}
+	http.ServeContent(w, r, object.Name, object.Updated, bytes.NewReader(object.Data))
+}
+
+func (f *FakeGCSServer) handleObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		object, status := f.lookup(bucket, name)
+		if object == nil {
+			writeError(w, status, "No such object: "+bucket+"/"+name)
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" {
+			serveContent(w, r, object)
+			return
+		}
+		writeJSON(w, http.StatusOK, object.resource())
+	case http.MethodDelete:
+		f.mutex.Lock()
+		object, ok := f.buckets[bucket][name]
+		match := r.URL.Query().Get("ifGenerationMatch")
+		if ok && match != "" && match != strconv.FormatInt(object.Generation, 10) {
+			f.mutex.Unlock()
+			writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+		delete(f.buckets[bucket], name)
+		f.mutex.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+func (f *FakeGCSServer) handleList(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	f.mutex.Lock()
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		f.mutex.Unlock()
+		writeError(w, http.StatusNotFound, "No such bucket: "+bucket)
+		return
+	}
+	items := []objectResource{}
+	prefixSet := map[string]bool{}
+	for name, object := range objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if idx := strings.Index(name[len(prefix):], delimiter); idx >= 0 {
+				prefixSet[name[:len(prefix)+idx+len(delimiter)]] = true
+				continue
+			}
+		}
+		items = append(items, object.resource())
+	}
+	f.mutex.Unlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	prefixes := make([]string, 0, len(prefixSet))
+	for p := range prefixSet {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":     "storage#objects",
+		"items":    items,
+		"prefixes": prefixes,
+	})
+}
+
+func (f *FakeGCSServer) handleUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	if uploadID := query.Get("upload_id"); uploadID != "" {
+		f.handleResumableChunk(w, r, uploadID)
+		return
+	}
+
+	switch query.Get("uploadType") {
+	case "multipart":
+		metadata, data, err := readMultipart(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if metadata.Name == "" {
+			metadata.Name = query.Get("name")
+		}
+		f.finishUpload(w, r, bucket, metadata, data)
+	case "resumable":
+		var metadata objectResource
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if metadata.Name == "" {
+			metadata.Name = query.Get("name")
+		}
+		f.mutex.Lock()
+		f.generation++
+		uploadID := strconv.FormatInt(f.generation, 10)
+		f.uploads[uploadID] = &fakeUpload{bucket: bucket, metadata: metadata}
+		f.mutex.Unlock()
+
+		w.Header().Set("Location", fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&upload_id=%s",
+			f.URL, bucket, uploadID))
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported upload type")
+	}
+}
+
+func (f *FakeGCSServer) handleResumableChunk(w http.ResponseWriter, r *http.Request, uploadID string) {
+	f.mutex.Lock()
+	upload, ok := f.uploads[uploadID]
+	f.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such upload: "+uploadID)
+		return
+	}
+	if _, err := io.Copy(&upload.data, r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Content-Range is "bytes a-b/total" for the last chunk and "bytes a-b/*" otherwise.
+	contentRange := r.Header.Get("Content-Range")
+	total := contentRange[strings.LastIndex(contentRange, "/")+1:]
+	if total == "*" {
+		if upload.data.Len() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", upload.data.Len()-1))
+		}
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f.mutex.Lock()
+	delete(f.uploads, uploadID)
+	f.mutex.Unlock()
+	f.finishUpload(w, r, upload.bucket, upload.metadata, upload.data.Bytes())
+}
+
+func (f *FakeGCSServer) finishUpload(w http.ResponseWriter, r *http.Request, bucket string, metadata objectResource, data []byte) {
+	if metadata.Name == "" {
+		writeError(w, http.StatusBadRequest, "missing object name")
+		return
+	}
+
+	f.mutex.Lock()
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		f.mutex.Unlock()
+		writeError(w, http.StatusNotFound, "No such bucket: "+bucket)
+		return
+	}
+	existing := objects[metadata.Name]
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" {
+		var current int64
+		if existing != nil {
+			current = existing.Generation
+		}
+		if match != strconv.FormatInt(current, 10) {
+			f.mutex.Unlock()
+			writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	f.generation++
+	object := &fakeObject{
+		Bucket:      bucket,
+		Name:        metadata.Name,
+		Data:        append([]byte(nil), data...),
+		ContentType: metadata.ContentType,
+		Metadata:    metadata.Metadata,
+		Created:     now,
+		Updated:     now,
+		Generation:  f.generation,
+		CRC32C:      crc32cHash(data),
+	}
+	if object.ContentType == "" {
+		object.ContentType = "application/octet-stream"
+	}
+	if existing != nil {
+		object.Created = existing.Created
+	}
+	objects[metadata.Name] = object
+	f.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, object.resource())
+}
+
+// readMultipart parses a multipart/related upload into its metadata and media parts
+func readMultipart(r *http.Request) (metadata objectResource, data []byte, err error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return metadata, nil, err
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		return metadata, nil, err
+	}
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		return metadata, nil, err
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		return metadata, nil, err
+	}
+	if metadata.ContentType == "" {
+		metadata.ContentType = part.Header.Get("Content-Type")
+	}
+	data, err = io.ReadAll(part)
+	return metadata, data, err
+}
+
+func (o *fakeObject) resource() objectResource {
+	sum := md5.Sum(o.Data)
+	return objectResource{
+		Kind:           "storage#object",
+		ID:             fmt.Sprintf("%s/%s/%d", o.Bucket, o.Name, o.Generation),
+		Bucket:         o.Bucket,
+		Name:           o.Name,
+		Size:           strconv.Itoa(len(o.Data)),
+		ContentType:    o.ContentType,
+		Generation:     strconv.FormatInt(o.Generation, 10),
+		Metageneration: "1",
+		TimeCreated:    o.Created.Format(time.RFC3339Nano),
+		Updated:        o.Updated.Format(time.RFC3339Nano),
+		MD5Hash:        base64.StdEncoding.EncodeToString(sum[:]),
+		CRC32C:         o.CRC32C,
+		Etag:           strconv.FormatInt(o.Generation, 10),
+		Metadata:       o.Metadata,
+	}
+}
+
+func crc32cHash(data []byte) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"errors": []map[string]string{{
+				"message": message,
+				"reason":  strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", ""),
+			}},
+		},
+	})
+}
@@ -0,0 +1,171 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+// conditionalBackends returns backends storing the objects of folder, which
+// is the container of Azure
+func conditionalBackends(t *testing.T, folder string) map[string]storage.Storage {
+	gcs, _ := NewFakeGCSStorage(t, "bucket")
+	azure, _ := NewFakeAzureStorage(t, folder)
+	return map[string]storage.Storage{"gcs": gcs, "azure": azure}
+}
+
+func stat(t *testing.T, s storage.Storage, key string) storage.ObjectInfo {
+	t.Helper()
+	info, err := s.(storage.ObjectLister).StatObject(context.Background(), &storage.ListOptions{Key: key})
+	if err != nil {
+		t.Fatalf("StatObject: %+v", err)
+	}
+	return info
+}
+
+func TestConditionalDelete(t *testing.T) {
+	for name, s := range conditionalBackends(t, "folder") {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := upload(t, s, "folder", "a", "old"); err != nil {
+				t.Fatalf("Upload: %+v", err)
+			}
+			old := stat(t, s, "folder/a")
+			if old.Version == "" {
+				t.Fatal("StatObject returned no version")
+			}
+			if err := upload(t, s, "folder", "a", "new"); err != nil {
+				t.Fatalf("Upload: %+v", err)
+			}
+			current := stat(t, s, "folder/a")
+			if current.Version == old.Version {
+				t.Fatalf("update kept version %q", old.Version)
+			}
+
+			err := s.Delete(ctx, &storage.DeleteOptions{Key: "folder/a", IfVersion: old.Version})
+			if !errors.Is(err, storage.ErrPreconditionFailed) {
+				t.Fatalf("Delete of stale version returned %v, want ErrPreconditionFailed", err)
+			}
+			assertObject(t, name, s, "folder/a", "new")
+			if err := s.Delete(ctx, &storage.DeleteOptions{Key: "folder/a", IfVersion: current.Version}); err != nil {
+				t.Fatalf("Delete of current version: %+v", err)
+			}
+			assertMissing(t, name, s, "folder/a")
+		})
+	}
+}
+
+func newGarbageCollector(t *testing.T, params storage.GCParams) *storage.GarbageCollector {
+	t.Helper()
+	params.Logger = log.New(io.Discard, "", 0)
+	gc, err := storage.NewGarbageCollector(params)
+	if err != nil {
+		t.Fatalf("NewGarbageCollector: %+v", err)
+	}
+	return gc
+}
+
+func TestGarbageCollector(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "bucket")
+	archive, _ := NewFakeGCSStorage(t, "archive")
+	for _, key := range []string{"1", "2", "3", "4"} {
+		if err := upload(t, backend, "builds/app", key, "build "+key); err != nil {
+			t.Fatalf("Upload: %+v", err)
+		}
+	}
+	if err := upload(t, backend, "builds/other", "1", "other"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	params := storage.GCParams{
+		Storage:     backend,
+		Folder:      "builds",
+		MaxVersions: 2,
+		Referenced: func(ctx context.Context, keys []string) (map[string]bool, error) {
+			return map[string]bool{"builds/app/1": true}, nil
+		},
+		Archive:       archive,
+		ArchiveFolder: "archive",
+		DryRun:        true,
+	}
+	ctx := context.Background()
+
+	report, err := newGarbageCollector(t, params).Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %+v", err)
+	}
+	if report.Scanned != 5 || report.Candidates != 2 || report.Referenced != 1 || report.Deleted != 0 {
+		t.Fatalf("dry run report = %+v", report)
+	}
+	assertKeys(t, "dry run", report.DeletedKeys, []string{"builds/app/2"})
+	assertObject(t, "backend", backend, "builds/app/2", "build 2")
+
+	params.DryRun = false
+	report, err = newGarbageCollector(t, params).Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %+v", err)
+	}
+	if report.Deleted != 1 || report.Archived != 1 || report.Failed != 0 || report.FreedBytes != int64(len("build 2")) {
+		t.Fatalf("report = %+v", report)
+	}
+	assertKeys(t, "deleted", report.DeletedKeys, []string{"builds/app/2"})
+	assertMissing(t, "backend", backend, "builds/app/2")
+	assertObject(t, "archive", archive, "archive/builds/app/2", "build 2")
+	assertObject(t, "backend", backend, "builds/app/1", "build 1")
+}
+
+func TestGarbageCollectorSkipsChangedObjects(t *testing.T) {
+	for name, backend := range conditionalBackends(t, "tmp") {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"a", "b", "c"} {
+				if err := upload(t, backend, "tmp", key, key); err != nil {
+					t.Fatalf("Upload: %+v", err)
+				}
+			}
+			// Objects are updated and deleted right after the scan.
+			hook := &listHook{Storage: backend, lister: backend.(storage.ObjectLister), after: func() {
+				if err := upload(t, backend, "tmp", "a", "updated"); err != nil {
+					t.Errorf("Upload: %+v", err)
+				}
+				if err := backend.Delete(context.Background(), &storage.DeleteOptions{Key: "tmp/c"}); err != nil {
+					t.Errorf("Delete: %+v", err)
+				}
+			}}
+			gc := newGarbageCollector(t, storage.GCParams{
+				Storage: hook,
+				Folder:  "tmp",
+				Referenced: func(ctx context.Context, keys []string) (map[string]bool, error) {
+					return nil, nil
+				},
+			})
+			report, err := gc.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run: %+v", err)
+			}
+			if report.Changed != 2 || report.Deleted != 1 || report.Failed != 0 {
+				t.Fatalf("report = %+v", report)
+			}
+			assertKeys(t, "deleted", report.DeletedKeys, []string{"tmp/b"})
+			assertObject(t, name, backend, "tmp/a", "updated")
+		})
+	}
+}
+
+func TestGarbageCollectorInvalidParams(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "bucket")
+	tests := map[string]storage.GCParams{
+		"missing storage":  {MaxVersions: 1},
+		"missing lister":   {Storage: newPlainStorage(), MaxVersions: 1},
+		"missing any rule": {Storage: backend},
+	}
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := storage.NewGarbageCollector(params); err == nil {
+				t.Fatal("NewGarbageCollector returned no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package storagetest
+
+import "testing"
+
+func TestGCSEmulator(t *testing.T) {
+	RunGCSEmulator(t)
+}
@@ -0,0 +1,199 @@
+package storagetest
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+func openIndex(t *testing.T, path string) *storage.MetadataIndex {
+	t.Helper()
+	index, err := storage.OpenMetadataIndex(path)
+	if err != nil {
+		t.Fatalf("OpenMetadataIndex: %+v", err)
+	}
+	t.Cleanup(func() { index.Close() })
+	return index
+}
+
+func findKeys(t *testing.T, index *storage.MetadataIndex, query map[string]string) []string {
+	t.Helper()
+	entries, err := index.Find(query)
+	if err != nil {
+		t.Fatalf("Find: %+v", err)
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func TestMetadataIndex(t *testing.T) {
+	index := openIndex(t, filepath.Join(t.TempDir(), "index.db"))
+	entries := []storage.IndexEntry{
+		{Key: "jobs/1/a", Size: 1, Metadata: map[string]string{"job": "1", "kind": "log"}},
+		{Key: "jobs/1/b", Size: 2, Metadata: map[string]string{"job": "1", "kind": "artifact"}},
+		{Key: "jobs/2/a", Size: 3, Metadata: map[string]string{"job": "2", "kind": "log"}},
+		// Values may hold any bytes, including ones which used to separate tags.
+		{Key: "jobs/3/a", Metadata: map[string]string{"job": "1\x00jobs/1/a"}},
+		{Key: "jobs/4/a", Metadata: map[string]string{"job\x001": "jobs/1/a"}},
+		{Key: "untagged"},
+	}
+	for _, entry := range entries {
+		if err := index.Put(entry); err != nil {
+			t.Fatalf("Put: %+v", err)
+		}
+	}
+	if err := index.Put(storage.IndexEntry{}); err == nil {
+		t.Fatal("Put of entry without key returned no error")
+	}
+
+	tests := []struct {
+		query map[string]string
+		want  []string
+	}{
+		{map[string]string{"job": "1"}, []string{"jobs/1/a", "jobs/1/b"}},
+		{map[string]string{"job": "1", "kind": "log"}, []string{"jobs/1/a"}},
+		{map[string]string{"kind": "log"}, []string{"jobs/1/a", "jobs/2/a"}},
+		{map[string]string{"job": "1\x00jobs/1/a"}, []string{"jobs/3/a"}},
+		{map[string]string{"job\x001": "jobs/1/a"}, []string{"jobs/4/a"}},
+		{map[string]string{"job": "5"}, []string{}},
+		{nil, []string{"jobs/1/a", "jobs/1/b", "jobs/2/a", "jobs/3/a", "jobs/4/a", "untagged"}},
+	}
+	for _, test := range tests {
+		if got := findKeys(t, index, test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Find(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	// Replacing an entry drops its previous tags.
+	if err := index.Put(storage.IndexEntry{Key: "jobs/1/a", Metadata: map[string]string{"job": "2"}}); err != nil {
+		t.Fatalf("Put: %+v", err)
+	}
+	assertKeys(t, "job 1 after replace", findKeys(t, index, map[string]string{"job": "1"}), []string{"jobs/1/b"})
+	assertKeys(t, "job 2 after replace", findKeys(t, index, map[string]string{"job": "2"}), []string{"jobs/1/a", "jobs/2/a"})
+
+	if err := index.Remove("jobs/1/a"); err != nil {
+		t.Fatalf("Remove: %+v", err)
+	}
+	if err := index.Remove("jobs/1/a"); err != nil {
+		t.Fatalf("Remove of missing entry: %+v", err)
+	}
+	assertKeys(t, "job 2 after remove", findKeys(t, index, map[string]string{"job": "2"}), []string{"jobs/2/a"})
+	if _, found, err := index.Get("jobs/1/a"); err != nil || found {
+		t.Fatalf("Get of removed entry = %v, %v", found, err)
+	}
+	entry, found, err := index.Get("jobs/2/a")
+	if err != nil || !found || entry.Size != 3 {
+		t.Fatalf("Get = %+v, %v, %v", entry, found, err)
+	}
+}
+
+func TestMetadataIndexRebuild(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "bucket")
+	ctx := context.Background()
+	for key, job := range map[string]string{"jobs/1/a": "1", "jobs/1/b": "1", "other/a": "2"} {
+		err := backend.Upload(ctx, &storage.UploadOptions{Key: key, Metadata: map[string]string{"job": job}}, strings.NewReader(key))
+		if err != nil {
+			t.Fatalf("Upload: %+v", err)
+		}
+	}
+	index := openIndex(t, filepath.Join(t.TempDir(), "index.db"))
+	// Entries of objects which no longer exist are dropped, the ones outside the prefix are kept.
+	for _, entry := range []storage.IndexEntry{
+		{Key: "jobs/1/deleted", Metadata: map[string]string{"job": "1"}},
+		{Key: "elsewhere/a", Metadata: map[string]string{"job": "1"}},
+	} {
+		if err := index.Put(entry); err != nil {
+			t.Fatalf("Put: %+v", err)
+		}
+	}
+
+	count, err := index.Rebuild(ctx, backend, &storage.ListOptions{Folder: "jobs"})
+	if err != nil {
+		t.Fatalf("Rebuild: %+v", err)
+	}
+	if count != 2 {
+		t.Fatalf("Rebuild indexed %d objects, want 2", count)
+	}
+	assertKeys(t, "job 1", findKeys(t, index, map[string]string{"job": "1"}), []string{"elsewhere/a", "jobs/1/a", "jobs/1/b"})
+	assertKeys(t, "job 2", findKeys(t, index, map[string]string{"job": "2"}), []string{})
+	entry, found, err := index.Get("jobs/1/a")
+	if err != nil || !found || entry.Size != int64(len("jobs/1/a")) || entry.Updated.IsZero() {
+		t.Fatalf("Get = %+v, %v, %v", entry, found, err)
+	}
+
+	if _, err := index.Rebuild(ctx, newPlainStorage(), &storage.ListOptions{}); err == nil {
+		t.Fatal("Rebuild from a storage without ObjectLister returned no error")
+	}
+}
+
+func TestIndexedStorage(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "bucket")
+	index := openIndex(t, filepath.Join(t.TempDir(), "index.db"))
+	s, err := storage.NewIndexedStorage(storage.IndexParams{Storage: backend, Index: index})
+	if err != nil {
+		t.Fatalf("NewIndexedStorage: %+v", err)
+	}
+	ctx := context.Background()
+	before := time.Now()
+	err = s.Upload(ctx, &storage.UploadOptions{Folder: "jobs", Key: "a", Metadata: map[string]string{"job": "1"}}, strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	entry, found, err := index.Get("jobs/a")
+	if err != nil || !found || entry.Size != 4 || entry.Updated.Before(before) {
+		t.Fatalf("Get = %+v, %v, %v", entry, found, err)
+	}
+	assertKeys(t, "job 1", findKeys(t, index, map[string]string{"job": "1"}), []string{"jobs/a"})
+
+	if err := s.Delete(ctx, &storage.DeleteOptions{Folder: "jobs", Key: "a"}); err != nil {
+		t.Fatalf("Delete: %+v", err)
+	}
+	assertKeys(t, "job 1 after delete", findKeys(t, index, map[string]string{"job": "1"}), []string{})
+}
+
+func TestMetadataIndexMigratesTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	index, err := storage.OpenMetadataIndex(path)
+	if err != nil {
+		t.Fatalf("OpenMetadataIndex: %+v", err)
+	}
+	if err := index.Put(storage.IndexEntry{Key: "jobs/a", Metadata: map[string]string{"job": "1"}}); err != nil {
+		t.Fatalf("Put: %+v", err)
+	}
+	index.Close()
+
+	// Indexes of the previous format have no version and NUL separated tags.
+	db, err := bbolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("couldn't open index database: %+v", err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("meta")); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte("tags")); err != nil {
+			return err
+		}
+		tags, err := tx.CreateBucket([]byte("tags"))
+		if err != nil {
+			return err
+		}
+		return tags.Put([]byte("job\x001\x00jobs/a"), nil)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("couldn't downgrade index: %+v", err)
+	}
+
+	assertKeys(t, "job 1", findKeys(t, openIndex(t, path), map[string]string{"job": "1"}), []string{"jobs/a"})
+}
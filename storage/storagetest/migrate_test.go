@@ -0,0 +1,61 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+func TestMigrateFolderKeys(t *testing.T) {
+	s, _ := NewFakeGCSStorage(t, "migrate-bucket")
+	ctx := context.Background()
+	// Objects written by clients which repeated the folder of folder prefixed keys.
+	objects := map[string]string{
+		"jobs/jobs/a.txt":     "legacy a",
+		"jobs/jobs/sub/b.txt": "legacy b",
+		"jobs/jobs/c.txt":     "legacy c",
+		"jobs/c.txt":          "current c",
+		"jobs/d.txt":          "current d",
+	}
+	for key, data := range objects {
+		if err := s.Upload(ctx, &storage.UploadOptions{Key: key}, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("Upload(%s): %+v", key, err)
+		}
+	}
+
+	moved, err := storage.MigrateFolderKeys(ctx, s, "jobs")
+	if err != nil {
+		t.Fatalf("MigrateFolderKeys: %+v", err)
+	}
+	if moved != 2 {
+		t.Fatalf("MigrateFolderKeys moved %d objects, want 2", moved)
+	}
+
+	want := map[string]string{
+		"jobs/a.txt":      "legacy a",
+		"jobs/sub/b.txt":  "legacy b",
+		"jobs/c.txt":      "current c",
+		"jobs/d.txt":      "current d",
+		"jobs/jobs/c.txt": "legacy c",
+	}
+	keys, err := s.ListKeys(ctx, &storage.ListOptions{Folder: "jobs", Recursive: true})
+	if err != nil {
+		t.Fatalf("ListKeys: %+v", err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("ListKeys = %v, want %d keys", keys, len(want))
+	}
+	for key, data := range want {
+		// Folder prefixed keys address the migrated objects.
+		got, err := s.Download(ctx, &storage.DownloadOptions{Folder: "jobs", Key: key})
+		if err != nil || string(got) != data {
+			t.Errorf("Download(%s) = %q, %v, want %q", key, got, err, data)
+		}
+	}
+
+	if _, err := storage.MigrateFolderKeys(ctx, s, ""); err == nil {
+		t.Fatal("MigrateFolderKeys without folder returned no error")
+	}
+}
@@ -0,0 +1,171 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+func upload(t *testing.T, s storage.Storage, folder, key, data string) error {
+	t.Helper()
+	return s.Upload(context.Background(), &storage.UploadOptions{Folder: folder, Key: key}, strings.NewReader(data))
+}
+
+func TestQuotaStorage(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "quota-bucket")
+	s, err := storage.NewQuotaStorage(storage.QuotaParams{
+		Storage: backend,
+		Quotas: map[string]storage.Quota{
+			"tenants/small": {MaxObjects: 2},
+			"tenants/tiny":  {MaxBytes: 10},
+		},
+		DefaultQuota: storage.Quota{MaxObjects: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewQuotaStorage: %+v", err)
+	}
+	ctx := context.Background()
+
+	if err := upload(t, s, "tenants/small", "a", "a"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	// Folder prefixed keys count against the quota of their folder.
+	if err := upload(t, s, "", "tenants/small/b", "b"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	if err := upload(t, s, "tenants", "small/c", "c"); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Upload over the object quota returned %v, want ErrQuotaExceeded", err)
+	}
+	// Overwrites don't add objects.
+	if err := upload(t, s, "tenants/small", "a", "aa"); err != nil {
+		t.Fatalf("Upload overwrite: %+v", err)
+	}
+	if err := s.Delete(ctx, &storage.DeleteOptions{Key: "tenants/small/a"}); err != nil {
+		t.Fatalf("Delete: %+v", err)
+	}
+	if err := upload(t, s, "tenants/small", "c", "c"); err != nil {
+		t.Fatalf("Upload after delete: %+v", err)
+	}
+
+	if err := upload(t, s, "tenants/tiny", "a", "0123456789"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	if err := upload(t, s, "", "tenants/tiny/b", "x"); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Upload over the byte quota returned %v, want ErrQuotaExceeded", err)
+	}
+	// Growing an object counts the difference against the quota.
+	if err := upload(t, s, "tenants/tiny", "a", "01234567890"); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Upload over the byte quota returned %v, want ErrQuotaExceeded", err)
+	}
+	// Readers of unknown size are aborted once they exceed the quota.
+	err = s.Upload(ctx, &storage.UploadOptions{Folder: "tenants/tiny", Key: "a"}, struct{ *bytes.Reader }{bytes.NewReader([]byte("01234567890"))})
+	if !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("streamed Upload over the byte quota returned %v, want ErrQuotaExceeded", err)
+	}
+
+	if err := upload(t, s, "other", "a", "a"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	if err := upload(t, s, "other", "b", "b"); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Upload over the default quota returned %v, want ErrQuotaExceeded", err)
+	}
+}
+
+// listHook calls hook around the listings of the wrapped storage
+type listHook struct {
+	storage.Storage
+	lister storage.ObjectLister
+	before func()
+	after  func()
+}
+
+func (l *listHook) ListObjects(ctx context.Context, options *storage.ListOptions) ([]storage.ObjectInfo, error) {
+	if l.before != nil {
+		l.before()
+	}
+	objects, err := l.lister.ListObjects(ctx, options)
+	if l.after != nil {
+		l.after()
+	}
+	return objects, err
+}
+
+func (l *listHook) StatObject(ctx context.Context, options *storage.ListOptions) (storage.ObjectInfo, error) {
+	return l.lister.StatObject(ctx, options)
+}
+
+func TestUsageTrackerRefreshKeepsConcurrentAdds(t *testing.T) {
+	for _, listed := range []bool{true, false} {
+		name := "change missing from listing"
+		if listed {
+			name = "change included in listing"
+		}
+		t.Run(name, func(t *testing.T) {
+			backend, _ := NewFakeGCSStorage(t, "usage-bucket")
+			hook := &listHook{Storage: backend, lister: backend.(storage.ObjectLister)}
+			tracker, err := storage.NewUsageTracker(hook, 0)
+			if err != nil {
+				t.Fatalf("NewUsageTracker: %+v", err)
+			}
+			ctx := context.Background()
+			if err := upload(t, backend, "tenant", "a", "a"); err != nil {
+				t.Fatalf("Upload: %+v", err)
+			}
+			if usage, err := tracker.Usage(ctx, "tenant"); err != nil || usage != (storage.Usage{Objects: 1, Bytes: 1}) {
+				t.Fatalf("Usage = %+v, %v", usage, err)
+			}
+
+			// An upload completes while the usage is being listed.
+			concurrent := func() {
+				if err := upload(t, backend, "tenant", "b", "bb"); err != nil {
+					t.Errorf("Upload: %+v", err)
+				}
+				tracker.Add("tenant", 1, 2)
+			}
+			if listed {
+				hook.before = concurrent
+			} else {
+				hook.after = concurrent
+			}
+			want := storage.Usage{Objects: 2, Bytes: 3}
+			usage, err := tracker.Refresh(ctx, "tenant")
+			if err != nil || usage != want {
+				t.Fatalf("Refresh = %+v, %v, want %+v", usage, err, want)
+			}
+			hook.before, hook.after = nil, nil
+			if usage, err := tracker.Usage(ctx, "tenant"); err != nil || usage != want {
+				t.Fatalf("Usage = %+v, %v, want %+v", usage, err, want)
+			}
+			if usage, err := tracker.Refresh(ctx, "tenant"); err != nil || usage != want {
+				t.Fatalf("Refresh = %+v, %v, want %+v", usage, err, want)
+			}
+		})
+	}
+}
+
+func TestUsageTrackerInvalidate(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "usage-bucket")
+	tracker, err := storage.NewUsageTracker(backend, 0)
+	if err != nil {
+		t.Fatalf("NewUsageTracker: %+v", err)
+	}
+	ctx := context.Background()
+	if usage, err := tracker.Usage(ctx, "tenant"); err != nil || usage != (storage.Usage{}) {
+		t.Fatalf("Usage = %+v, %v", usage, err)
+	}
+	if err := upload(t, backend, "tenant", "a", "abc"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	// Changes made behind the tracker's back are only seen once invalidated.
+	if usage, _ := tracker.Usage(ctx, "tenant"); usage != (storage.Usage{}) {
+		t.Fatalf("cached Usage = %+v", usage)
+	}
+	tracker.Invalidate("tenant")
+	if usage, err := tracker.Usage(ctx, "tenant"); err != nil || usage != (storage.Usage{Objects: 1, Bytes: 3}) {
+		t.Fatalf("Usage after Invalidate = %+v, %v", usage, err)
+	}
+}
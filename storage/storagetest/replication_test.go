@@ -0,0 +1,241 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+var errReplicaDown = errors.New("replica down")
+
+// flakyStorage fails every operation while down is set
+type flakyStorage struct {
+	storage.Storage
+	down atomic.Bool
+}
+
+func (f *flakyStorage) Upload(ctx context.Context, options *storage.UploadOptions, r io.Reader) error {
+	if f.down.Load() {
+		return errReplicaDown
+	}
+	return f.Storage.Upload(ctx, options, r)
+}
+
+func (f *flakyStorage) Download(ctx context.Context, options *storage.DownloadOptions) ([]byte, error) {
+	if f.down.Load() {
+		return nil, errReplicaDown
+	}
+	return f.Storage.Download(ctx, options)
+}
+
+func (f *flakyStorage) Delete(ctx context.Context, options *storage.DeleteOptions) error {
+	if f.down.Load() {
+		return errReplicaDown
+	}
+	return f.Storage.Delete(ctx, options)
+}
+
+func newReplicated(t *testing.T, mode storage.ReplicationMode, primary storage.Storage, secondaries ...storage.Storage) *storage.ReplicatedStorage {
+	t.Helper()
+	params := storage.ReplicationParams{
+		Primary:     storage.Replica{Name: "primary", Storage: primary},
+		Mode:        mode,
+		RepairRetry: &storage.RetryPolicy{MaxAttempts: 1},
+		Logger:      log.New(io.Discard, "", 0),
+	}
+	for i, secondary := range secondaries {
+		params.Secondaries = append(params.Secondaries, storage.Replica{Name: "secondary" + string(rune('a'+i)), Storage: secondary})
+	}
+	s, err := storage.NewReplicatedStorage(params)
+	if err != nil {
+		t.Fatalf("NewReplicatedStorage: %+v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func assertObject(t *testing.T, name string, s storage.Storage, key, want string) {
+	t.Helper()
+	data, err := s.Download(context.Background(), &storage.DownloadOptions{Key: key})
+	if err != nil {
+		t.Fatalf("%s: Download: %+v", name, err)
+	}
+	if string(data) != want {
+		t.Fatalf("%s: Download = %q, want %q", name, data, want)
+	}
+}
+
+func assertMissing(t *testing.T, name string, s storage.Storage, key string) {
+	t.Helper()
+	exists, err := s.Exists(context.Background(), &storage.ListOptions{Key: key})
+	if err != nil {
+		t.Fatalf("%s: Exists: %+v", name, err)
+	}
+	if exists {
+		t.Fatalf("%s: object %s still exists", name, key)
+	}
+}
+
+func TestReplicatedSyncFanOut(t *testing.T) {
+	primary, _ := NewFakeGCSStorage(t, "primary")
+	secondary, _ := NewFakeGCSStorage(t, "secondary")
+	s := newReplicated(t, storage.ReplicateSync, primary, secondary)
+	ctx := context.Background()
+
+	// Readers which can't seek are spooled for the secondaries.
+	reader := struct{ io.Reader }{strings.NewReader("data")}
+	if err := s.Upload(ctx, &storage.UploadOptions{Folder: "folder", Key: "a"}, reader); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	assertObject(t, "primary", primary, "folder/a", "data")
+	assertObject(t, "secondary", secondary, "folder/a", "data")
+
+	// Seekable readers are written from their current offset.
+	seeker := bytes.NewReader([]byte("skip:seek"))
+	seeker.Seek(5, io.SeekStart)
+	if err := s.Upload(ctx, &storage.UploadOptions{Key: "folder/b"}, seeker); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	assertObject(t, "primary", primary, "folder/b", "seek")
+	assertObject(t, "secondary", secondary, "folder/b", "seek")
+
+	if err := s.Delete(ctx, &storage.DeleteOptions{Folder: "folder", Key: "a"}); err != nil {
+		t.Fatalf("Delete: %+v", err)
+	}
+	assertMissing(t, "primary", primary, "folder/a")
+	assertMissing(t, "secondary", secondary, "folder/a")
+	if stats := s.RepairStats(); stats != (storage.RepairStats{}) {
+		t.Fatalf("RepairStats = %+v, want none", stats)
+	}
+}
+
+func TestReplicatedAsyncRepairs(t *testing.T) {
+	primary, _ := NewFakeGCSStorage(t, "primary")
+	secondary, _ := NewFakeGCSStorage(t, "secondary")
+	s := newReplicated(t, storage.ReplicateAsync, primary, secondary)
+	if err := upload(t, s, "folder", "a", "data"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	s.Close()
+	assertObject(t, "secondary", secondary, "folder/a", "data")
+	if stats := s.RepairStats(); stats.Repaired != 1 || stats.Pending != 0 {
+		t.Fatalf("RepairStats = %+v, want one repair", stats)
+	}
+}
+
+func TestReplicatedReadFallback(t *testing.T) {
+	primaryBackend, _ := NewFakeGCSStorage(t, "primary")
+	primary := &flakyStorage{Storage: primaryBackend}
+	secondary, _ := NewFakeGCSStorage(t, "secondary")
+	s := newReplicated(t, storage.ReplicateSync, primary, secondary)
+	if err := upload(t, s, "folder", "a", "data"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+
+	// Objects missing from a replica are read from the next one.
+	if err := upload(t, secondary, "folder", "b", "lagging"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	assertObject(t, "replicated", s, "folder/b", "lagging")
+
+	primary.down.Store(true)
+	assertObject(t, "replicated", s, "folder/a", "data")
+	if _, err := s.Download(context.Background(), &storage.DownloadOptions{Key: "folder/missing"}); !s.IsNotFoundErr(err) {
+		t.Fatalf("Download of missing object returned %v, want not found", err)
+	}
+}
+
+func TestReplicatedFailures(t *testing.T) {
+	primaryBackend, _ := NewFakeGCSStorage(t, "primary")
+	primary := &flakyStorage{Storage: primaryBackend}
+	secondaryBackend, _ := NewFakeGCSStorage(t, "secondary")
+	secondary := &flakyStorage{Storage: secondaryBackend}
+	s := newReplicated(t, storage.ReplicateSync, primary, secondary)
+
+	// Failures of the primary fail the write.
+	primary.down.Store(true)
+	if err := upload(t, s, "folder", "a", "data"); !errors.Is(err, errReplicaDown) {
+		t.Fatalf("Upload with the primary down returned %v, want %v", err, errReplicaDown)
+	}
+	assertMissing(t, "secondary", secondaryBackend, "folder/a")
+	primary.down.Store(false)
+
+	// Failures of a secondary are repaired in the background. The repair
+	// retries until the secondary is back.
+	secondary.down.Store(true)
+	s2 := newReplicatedWithRetry(t, primary, secondary)
+	if err := upload(t, s2, "folder", "a", "data"); err != nil {
+		t.Fatalf("Upload with a secondary down: %+v", err)
+	}
+	secondary.down.Store(false)
+	s2.Close()
+	assertObject(t, "secondary", secondaryBackend, "folder/a", "data")
+	if stats := s2.RepairStats(); stats.Repaired != 1 || stats.Failed != 0 {
+		t.Fatalf("RepairStats = %+v, want one repair", stats)
+	}
+
+	// Failed repairs are counted.
+	secondary.down.Store(true)
+	if err := s.Delete(context.Background(), &storage.DeleteOptions{Folder: "folder", Key: "a"}); err != nil {
+		t.Fatalf("Delete with a secondary down: %+v", err)
+	}
+	s.Close()
+	if stats := s.RepairStats(); stats.Failed != 1 {
+		t.Fatalf("RepairStats = %+v, want one failed repair", stats)
+	}
+}
+
+func newReplicatedWithRetry(t *testing.T, primary, secondary storage.Storage) *storage.ReplicatedStorage {
+	t.Helper()
+	s, err := storage.NewReplicatedStorage(storage.ReplicationParams{
+		Primary:     storage.Replica{Name: "primary", Storage: primary},
+		Secondaries: []storage.Replica{{Name: "secondary", Storage: secondary}},
+		RepairRetry: &storage.RetryPolicy{
+			MaxAttempts:    100,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Retryable:      func(err error) bool { return errors.Is(err, errReplicaDown) },
+		},
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewReplicatedStorage: %+v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestReplicatedOptionalInterfaces(t *testing.T) {
+	primary, _ := NewFakeGCSStorage(t, "primary")
+	secondary, _ := NewFakeGCSStorage(t, "secondary")
+	s := newReplicated(t, storage.ReplicateSync, primary, secondary).Storage()
+	if _, ok := s.(storage.ObjectLister); !ok {
+		t.Error("replicas implementing ObjectLister aren't listed")
+	}
+	if _, ok := s.(storage.ObjectReader); !ok {
+		t.Error("replicas implementing ObjectReader aren't read")
+	}
+
+	// Interfaces missing from a replica aren't exposed.
+	s = newReplicated(t, storage.ReplicateSync, primary, newPlainStorage()).Storage()
+	if _, ok := s.(storage.ObjectLister); ok {
+		t.Error("exposes ObjectLister though a replica lacks it")
+	}
+	if _, ok := s.(storage.ObjectReader); ok {
+		t.Error("exposes ObjectReader though a replica lacks it")
+	}
+	if _, ok := s.(storage.Admin); ok {
+		t.Error("exposes Admin though a replica lacks it")
+	}
+	if _, ok := storage.Storage(&storage.ReplicatedStorage{}).(storage.ObjectLister); ok {
+		t.Error("ReplicatedStorage implements ObjectLister itself")
+	}
+}
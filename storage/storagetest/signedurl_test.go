@@ -0,0 +1,208 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+const signedURLBase = "https://artifacts.example.com/download"
+
+func newSignedURLServer(t *testing.T, s storage.Storage, audit func(storage.AuditEvent)) *storage.SignedURLServer {
+	t.Helper()
+	server, err := storage.NewSignedURLServer(storage.SignedURLServerParams{
+		Storage: s,
+		BaseURL: signedURLBase,
+		Key:     []byte("signing-key"),
+		Audit:   audit,
+		Logger:  log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewSignedURLServer: %+v", err)
+	}
+	return server
+}
+
+func signURL(t *testing.T, server *storage.SignedURLServer, key string, expires time.Time) *url.URL {
+	t.Helper()
+	signed, err := server.SignURL(&storage.DownloadOptions{Key: key}, expires)
+	if err != nil {
+		t.Fatalf("SignURL: %+v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("couldn't parse signed URL: %+v", err)
+	}
+	return u
+}
+
+// withQuery returns u with the query parameter replaced
+func withQuery(u *url.URL, name, value string) *url.URL {
+	tampered := *u
+	query := u.Query()
+	query.Set(name, value)
+	tampered.RawQuery = query.Encode()
+	return &tampered
+}
+
+func TestSignedURLVerify(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "bucket")
+	server := newSignedURLServer(t, backend, nil)
+	hour := time.Now().Add(time.Hour)
+	valid := signURL(t, server, "folder/a", hour)
+	other := signURL(t, server, "folder/b", hour)
+
+	tampered := *valid
+	tampered.Path = strings.Replace(valid.Path, "folder/a", "folder/b", 1)
+	outside := *valid
+	outside.Path = "/elsewhere/folder/a"
+
+	tests := []struct {
+		name    string
+		url     *url.URL
+		wantKey string
+		wantErr error
+	}{
+		{"valid", valid, "folder/a", nil},
+		{"expired", signURL(t, server, "folder/a", time.Now().Add(-time.Minute)), "", storage.ErrSignatureExpired},
+		{"tampered key", &tampered, "", storage.ErrInvalidSignature},
+		{"signature of another key", withQuery(valid, "Signature", other.Query().Get("Signature")), "", storage.ErrInvalidSignature},
+		{"extended expiry", withQuery(valid, "Expires", "99999999999"), "", storage.ErrInvalidSignature},
+		{"malformed signature", withQuery(valid, "Signature", "not base64!"), "", storage.ErrInvalidSignature},
+		{"missing signature", withQuery(valid, "Signature", ""), "", storage.ErrInvalidSignature},
+		{"missing expiry", withQuery(valid, "Expires", ""), "", storage.ErrInvalidSignature},
+		{"outside base path", &outside, "", storage.ErrInvalidSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := server.Verify(httptest.NewRequest(http.MethodGet, test.url.String(), nil))
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Fatalf("Verify returned %v, want %v", err, test.wantErr)
+			}
+			if key != test.wantKey {
+				t.Fatalf("Verify returned key %q, want %q", key, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestSignedURLServeHTTP(t *testing.T) {
+	gcs, _ := NewFakeGCSStorage(t, "bucket")
+	backends := map[string]storage.Storage{
+		// Range reads through the optional interfaces.
+		"gcs": gcs,
+		// Downloads in memory.
+		"plain": newPlainStorage(),
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			if err := upload(t, backend, "folder", "a", "0123456789"); err != nil {
+				t.Fatalf("Upload: %+v", err)
+			}
+			var events []storage.AuditEvent
+			server := newSignedURLServer(t, backend, func(event storage.AuditEvent) {
+				events = append(events, event)
+			})
+			hour := time.Now().Add(time.Hour)
+			valid := signURL(t, server, "folder/a", hour)
+			tampered := *valid
+			tampered.Path += "b"
+
+			tests := []struct {
+				name       string
+				method     string
+				url        *url.URL
+				header     http.Header
+				wantStatus int
+				wantBody   string
+				wantErr    bool
+			}{
+				{name: "get", method: http.MethodGet, url: valid, wantStatus: http.StatusOK, wantBody: "0123456789"},
+				{name: "head", method: http.MethodHead, url: valid, wantStatus: http.StatusOK},
+				{
+					name: "range", method: http.MethodGet, url: valid, header: http.Header{"Range": {"bytes=2-4"}},
+					wantStatus: http.StatusPartialContent, wantBody: "234",
+				},
+				{name: "post", method: http.MethodPost, url: valid, wantStatus: http.StatusMethodNotAllowed},
+				{
+					name: "expired", method: http.MethodGet, url: signURL(t, server, "folder/a", time.Now().Add(-time.Minute)),
+					wantStatus: http.StatusForbidden, wantErr: true,
+				},
+				{name: "tampered key", method: http.MethodGet, url: &tampered, wantStatus: http.StatusForbidden, wantErr: true},
+				{
+					name: "bad signature", method: http.MethodGet, url: withQuery(valid, "Signature", "AAAA"),
+					wantStatus: http.StatusForbidden, wantErr: true,
+				},
+				{
+					name: "missing object", method: http.MethodGet, url: signURL(t, server, "folder/missing", hour),
+					wantStatus: http.StatusNotFound, wantErr: true,
+				},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					events = nil
+					req := httptest.NewRequest(test.method, test.url.String(), nil)
+					for name, values := range test.header {
+						req.Header[name] = values
+					}
+					recorder := httptest.NewRecorder()
+					server.ServeHTTP(recorder, req)
+					if recorder.Code != test.wantStatus {
+						t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body)
+					}
+					if test.wantBody != "" && recorder.Body.String() != test.wantBody {
+						t.Fatalf("body = %q, want %q", recorder.Body, test.wantBody)
+					}
+					if len(events) != 1 {
+						t.Fatalf("got %d audit events, want 1", len(events))
+					}
+					if event := events[0]; event.Status != test.wantStatus || (event.Err != nil) != test.wantErr {
+						t.Fatalf("audit event = %+v, want status %d", event, test.wantStatus)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSignedURLDownloadFromCdn(t *testing.T) {
+	backend, _ := NewFakeGCSStorage(t, "bucket")
+	if err := upload(t, backend, "folder", "a", "data"); err != nil {
+		t.Fatalf("Upload: %+v", err)
+	}
+	var server *storage.SignedURLServer
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	server, err := storage.NewSignedURLServer(storage.SignedURLServerParams{
+		Storage:    backend,
+		BaseURL:    httpServer.URL + "/download",
+		Key:        []byte("signing-key"),
+		HTTPClient: httpServer.Client(),
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewSignedURLServer: %+v", err)
+	}
+	data, err := server.DownloadFromCdn(context.Background(), &storage.DownloadOptions{Folder: "folder", Key: "a"})
+	if err != nil {
+		t.Fatalf("DownloadFromCdn: %+v", err)
+	}
+	if string(data) != "data" {
+		t.Fatalf("DownloadFromCdn = %q, want %q", data, "data")
+	}
+	_, err = server.DownloadFromCdn(context.Background(), &storage.DownloadOptions{Folder: "folder", Key: "missing"})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("DownloadFromCdn of missing object returned %v, want ErrNotFound", err)
+	}
+}
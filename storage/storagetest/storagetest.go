@@ -0,0 +1,368 @@
+// Package storagetest provides fake GCS and Azure servers and a behavioral suite to
+// run against storage.Storage implementations, so that every backend
+// behaves the same as the GCS one.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"testing"
+
+	"google.golang.org/api/option"
+
+	"pranjalmohansaxena10/gcp-golang-js/storage"
+)
+
+const defaultFolder = "storagetest"
+
+// Options tunes the suite to the capabilities of a backend
+type Options struct {
+	// Folder holds every object created by the suite. Defaults to "storagetest".
+	Folder string
+	// SkipSignedURL skips GetTempTokenForDownload and DownloadFromCdn checks
+	// for backends which can't sign URLs in the test environment.
+	SkipSignedURL bool
+	// HTTPClient fetches signed URLs. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// NewFakeGCSStorage starts a FakeGCSServer hosting bucket and returns a GCS
+// storage client using it, signing URLs with a throwaway key. It sets
+// STORAGE_EMULATOR_HOST so that signed URLs point to the fake server, hence
+// can't be used in parallel tests. The server is closed when the test finishes.
+func NewFakeGCSStorage(t testing.TB, bucket string) (storage.Storage, *FakeGCSServer) {
+	t.Helper()
+	server := NewFakeGCSServer(bucket)
+	t.Cleanup(server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+
+	client, err := storage.NewGCSClient(context.Background(), storage.GCSBucketParams{
+		Bucket:         bucket,
+		Logger:         log.New(io.Discard, "", 0),
+		Endpoint:       server.URL,
+		ClientOptions:  []option.ClientOption{option.WithoutAuthentication()},
+		GoogleAccessID: "storagetest@storagetest.iam.gserviceaccount.com",
+		PrivateKey:     newPrivateKey(t),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create GCS client for fake server: %+v", err)
+	}
+	return client, server
+}
+
+// RunGCSEmulator runs the storage suite against the GCS backend talking to a FakeGCSServer
+func RunGCSEmulator(t *testing.T) {
+	s, _ := NewFakeGCSStorage(t, "storagetest-bucket")
+	Run(t, s, Options{})
+}
+
+// NewFakeAzureStorage starts a FakeAzureServer hosting container and returns
+// an Azure storage client using it. The server is closed when the test finishes.
+func NewFakeAzureStorage(t testing.TB, container string) (storage.Storage, *FakeAzureServer) {
+	t.Helper()
+	server := NewFakeAzureServer(container)
+	t.Cleanup(server.Close)
+
+	client, err := storage.NewAzureClient(storage.AzureParams{
+		AccountName: FakeAzureAccount,
+		AccountKey:  FakeAzureKey,
+		ServiceURL:  server.ServiceURL(),
+		Logger:      log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create Azure client for fake server: %+v", err)
+	}
+	return client, server
+}
+
+// RunAzureEmulator runs the storage suite against the Azure backend talking
+// to a FakeAzureServer, the suite's folder being the container.
+func RunAzureEmulator(t *testing.T) {
+	s, _ := NewFakeAzureStorage(t, defaultFolder)
+	Run(t, s, Options{})
+}
+
+// newPrivateKey returns a PEM encoded RSA key for signing URLs
+func newPrivateKey(t testing.TB) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate signing key: %+v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// Run checks the behavioral contract of a Storage implementation
+func Run(t *testing.T, s storage.Storage, opts Options) {
+	if opts.Folder == "" {
+		opts.Folder = defaultFolder
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	suite := &suite{s: s, opts: opts}
+
+	t.Run("RoundTrip", suite.testRoundTrip)
+	t.Run("Overwrite", suite.testOverwrite)
+	t.Run("FullKey", suite.testFullKey)
+	t.Run("NotFound", suite.testNotFound)
+	t.Run("ListKeys", suite.testListKeys)
+	t.Run("ListKeysRecursive", suite.testListKeysRecursive)
+	t.Run("ListKeysEmpty", suite.testListKeysEmpty)
+	t.Run("Delete", suite.testDelete)
+	t.Run("CanceledContext", suite.testCanceledContext)
+	if !opts.SkipSignedURL {
+		t.Run("SignedURL", suite.testSignedURL)
+		t.Run("DownloadFromCdn", suite.testDownloadFromCdn)
+	}
+}
+
+type suite struct {
+	s    storage.Storage
+	opts Options
+}
+
+// folder returns the folder used by a single test
+func (s *suite) folder(name string) string {
+	return s.opts.Folder + storage.DirDelim + name
+}
+
+func (s *suite) upload(t *testing.T, folder, key string, data []byte) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.s.Upload(ctx, &storage.UploadOptions{Folder: folder, Key: key}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Upload(%s, %s): %+v", folder, key, err)
+	}
+	t.Cleanup(func() {
+		s.s.Delete(ctx, &storage.DeleteOptions{Folder: folder, Key: key})
+	})
+}
+
+func (s *suite) download(t *testing.T, folder, key string) []byte {
+	t.Helper()
+	data, err := s.s.Download(context.Background(), &storage.DownloadOptions{Folder: folder, Key: key})
+	if err != nil {
+		t.Fatalf("Download(%s, %s): %+v", folder, key, err)
+	}
+	return data
+}
+
+func (s *suite) exists(t *testing.T, folder, key string) bool {
+	t.Helper()
+	exists, err := s.s.Exists(context.Background(), &storage.ListOptions{Folder: folder, Key: key})
+	if err != nil {
+		t.Fatalf("Exists(%s, %s): %+v", folder, key, err)
+	}
+	return exists
+}
+
+func (s *suite) listKeys(t *testing.T, options *storage.ListOptions) []string {
+	t.Helper()
+	keys, err := s.s.ListKeys(context.Background(), options)
+	if err != nil {
+		t.Fatalf("ListKeys(%+v): %+v", *options, err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *suite) testRoundTrip(t *testing.T) {
+	folder := s.folder("roundtrip")
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	cases := map[string][]byte{
+		"empty.txt":        {},
+		"text.txt":         []byte("storagetest data"),
+		"binary.bin":       binary,
+		"large.bin":        bytes.Repeat([]byte("0123456789abcdef"), 64<<10),
+		"nested/dir/a.txt": []byte("nested"),
+		"with space.txt":   []byte("space"),
+	}
+	for key, data := range cases {
+		s.upload(t, folder, key, data)
+		if got := s.download(t, folder, key); !bytes.Equal(got, data) {
+			t.Errorf("Download(%s) returned %d bytes, want %d", key, len(got), len(data))
+		}
+		if !s.exists(t, folder, key) {
+			t.Errorf("Exists(%s) = false after Upload", key)
+		}
+	}
+}
+
+func (s *suite) testOverwrite(t *testing.T) {
+	folder := s.folder("overwrite")
+	s.upload(t, folder, "object.txt", []byte("first"))
+	s.upload(t, folder, "object.txt", []byte("second"))
+	if got := s.download(t, folder, "object.txt"); string(got) != "second" {
+		t.Errorf("Download after overwrite = %q, want %q", got, "second")
+	}
+}
+
+// testFullKey checks that keys returned by ListKeys address the same object
+func (s *suite) testFullKey(t *testing.T) {
+	folder := s.folder("fullkey")
+	s.upload(t, folder, "object.txt", []byte("full key"))
+	keys := s.listKeys(t, &storage.ListOptions{Folder: folder})
+	if len(keys) != 1 {
+		t.Fatalf("ListKeys = %q, want a single key", keys)
+	}
+	if got := s.download(t, folder, keys[0]); string(got) != "full key" {
+		t.Errorf("Download(%s) = %q, want %q", keys[0], got, "full key")
+	}
+	if !s.exists(t, folder, keys[0]) {
+		t.Errorf("Exists(%s) = false", keys[0])
+	}
+}
+
+func (s *suite) testNotFound(t *testing.T) {
+	ctx := context.Background()
+	folder := s.folder("notfound")
+
+	_, err := s.s.Download(ctx, &storage.DownloadOptions{Folder: folder, Key: "missing.txt"})
+	if err == nil {
+		t.Fatal("Download of missing object returned no error")
+	}
+	if !s.s.IsNotFoundErr(err) {
+		t.Errorf("IsNotFoundErr(%+v) = false for missing object", err)
+	}
+	if s.exists(t, folder, "missing.txt") {
+		t.Error("Exists = true for missing object")
+	}
+	if s.s.IsNotFoundErr(nil) {
+		t.Error("IsNotFoundErr(nil) = true")
+	}
+	if s.s.IsNotFoundErr(errors.New("some error")) {
+		t.Error("IsNotFoundErr of an unrelated error = true")
+	}
+}
+
+func (s *suite) testListKeys(t *testing.T) {
+	folder := s.folder("list")
+	s.upload(t, folder, "dir/a.txt", []byte("a"))
+	s.upload(t, folder, "dir/b.txt", []byte("b"))
+	s.upload(t, folder, "dir/sub/c.txt", []byte("c"))
+	s.upload(t, folder, "other/d.txt", []byte("d"))
+
+	keys := s.listKeys(t, &storage.ListOptions{Folder: folder, Prefix: "dir"})
+	want := []string{folder + "/dir/a.txt", folder + "/dir/b.txt", folder + "/dir/sub/"}
+	assertKeys(t, "ListKeys", keys, want)
+
+	keys = s.listKeys(t, &storage.ListOptions{Folder: folder})
+	assertKeys(t, "ListKeys of folder", keys, []string{folder + "/dir/", folder + "/other/"})
+}
+
+func (s *suite) testListKeysRecursive(t *testing.T) {
+	folder := s.folder("recursive")
+	s.upload(t, folder, "dir/a.txt", []byte("a"))
+	s.upload(t, folder, "dir/sub/b.txt", []byte("b"))
+	s.upload(t, folder, "dir/sub/deeper/c.txt", []byte("c"))
+	s.upload(t, folder, "other/d.txt", []byte("d"))
+
+	keys := s.listKeys(t, &storage.ListOptions{Folder: folder, Prefix: "dir", Recursive: true})
+	want := []string{folder + "/dir/a.txt", folder + "/dir/sub/b.txt", folder + "/dir/sub/deeper/c.txt"}
+	assertKeys(t, "ListKeys recursive", keys, want)
+}
+
+func (s *suite) testListKeysEmpty(t *testing.T) {
+	keys := s.listKeys(t, &storage.ListOptions{Folder: s.folder("empty"), Recursive: true})
+	if len(keys) != 0 {
+		t.Errorf("ListKeys of empty folder = %q, want none", keys)
+	}
+}
+
+func (s *suite) testDelete(t *testing.T) {
+	ctx := context.Background()
+	folder := s.folder("delete")
+	s.upload(t, folder, "object.txt", []byte("delete me"))
+	s.upload(t, folder, "kept.txt", []byte("keep me"))
+
+	options := &storage.DeleteOptions{Folder: folder, Key: "object.txt"}
+	if err := s.s.Delete(ctx, options); err != nil {
+		t.Fatalf("Delete: %+v", err)
+	}
+	if s.exists(t, folder, "object.txt") {
+		t.Error("Exists = true after Delete")
+	}
+	if !s.exists(t, folder, "kept.txt") {
+		t.Error("Delete removed another object")
+	}
+	// Deleting again must either succeed or report not found.
+	if err := s.s.Delete(ctx, options); err != nil && !s.s.IsNotFoundErr(err) {
+		t.Errorf("second Delete = %+v, want nil or a not found error", err)
+	}
+}
+
+func (s *suite) testCanceledContext(t *testing.T) {
+	folder := s.folder("canceled")
+	s.upload(t, folder, "object.txt", []byte("canceled"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.s.Download(ctx, &storage.DownloadOptions{Folder: folder, Key: "object.txt"}); err == nil {
+		t.Error("Download with canceled context returned no error")
+	}
+}
+
+func (s *suite) testSignedURL(t *testing.T) {
+	folder := s.folder("signed")
+	s.upload(t, folder, "object.txt", []byte("signed"))
+
+	signedURL, err := s.s.GetTempTokenForDownload(context.Background(), &storage.DownloadOptions{Folder: folder, Key: "object.txt"})
+	if err != nil {
+		t.Fatalf("GetTempTokenForDownload: %+v", err)
+	}
+	res, err := s.opts.HTTPClient.Get(signedURL)
+	if err != nil {
+		t.Fatalf("GET signed url: %+v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading signed url response: %+v", err)
+	}
+	if res.StatusCode != http.StatusOK || string(body) != "signed" {
+		t.Errorf("GET signed url = %d %q, want 200 %q", res.StatusCode, body, "signed")
+	}
+}
+
+func (s *suite) testDownloadFromCdn(t *testing.T) {
+	ctx := context.Background()
+	folder := s.folder("cdn")
+	s.upload(t, folder, "object.txt", []byte("cdn"))
+
+	data, err := s.s.DownloadFromCdn(ctx, &storage.DownloadOptions{Folder: folder, Key: "object.txt"})
+	if err != nil {
+		t.Fatalf("DownloadFromCdn: %+v", err)
+	}
+	if string(data) != "cdn" {
+		t.Errorf("DownloadFromCdn = %q, want %q", data, "cdn")
+	}
+	if _, err := s.s.DownloadFromCdn(ctx, &storage.DownloadOptions{Folder: folder, Key: "missing.txt"}); err == nil {
+		t.Error("DownloadFromCdn of missing object returned no error")
+	}
+}
+
+func assertKeys(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %q, want %q", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s = %q, want %q", name, got, want)
+			return
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "pranjalmohansaxena10/gcp-golang-js/storage"
+
+type TelemetryParams struct {
+	// Storage is the instrumented client
+	Storage Storage
+	// Provider is reported with every span and metric, e.g. "gcs"
+	Provider string
+	// TracerProvider and MeterProvider default to the global otel providers
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+}
+
+type instrumentedStorage struct {
+	storage     Storage
+	provider    attribute.KeyValue
+	tracer      trace.Tracer
+	duration    metric.Float64Histogram
+	transferred metric.Int64Counter
+	errors      metric.Int64Counter
+}
+
+// NewInstrumentedStorage returns a Storage which records an OpenTelemetry
+// span, the latency, bytes transferred and errors of every operation. The
+// ObjectLister, ObjectReader and Admin interfaces are kept when the wrapped
+// client implements them.
+func NewInstrumentedStorage(params TelemetryParams) (Storage, error) {
+	if params.Storage == nil {
+		return nil, errors.New("missing storage client")
+	}
+	tracerProvider := params.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	meterProvider := params.MeterProvider
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+	meter := meterProvider.Meter(instrumentationName)
+
+	duration, err := meter.Float64Histogram("storage.operation.duration",
+		metric.WithDescription("Duration of storage operations"), metric.WithUnit("s"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create storage duration histogram since: %+v", err)
+	}
+	transferred, err := meter.Int64Counter("storage.transferred",
+		metric.WithDescription("Bytes uploaded and downloaded by storage operations"), metric.WithUnit("By"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create storage transferred counter since: %+v", err)
+	}
+	errorCount, err := meter.Int64Counter("storage.errors",
+		metric.WithDescription("Failed storage operations"), metric.WithUnit("{error}"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create storage errors counter since: %+v", err)
+	}
+
+	s := &instrumentedStorage{
+		storage:     params.Storage,
+		provider:    attribute.String("storage.provider", params.Provider),
+		tracer:      tracerProvider.Tracer(instrumentationName),
+		duration:    duration,
+		transferred: transferred,
+		errors:      errorCount,
+	}
+	return withOptional(s, params.Storage), nil
+}
+
+// operation is a single instrumented storage call
+type operation struct {
+	s     *instrumentedStorage
+	name  string
+	span  trace.Span
+	start time.Time
+}
+
+func (s *instrumentedStorage) start(ctx context.Context, name, folder, key string) (context.Context, *operation) {
+	ctx, span := s.tracer.Start(ctx, "storage."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("storage.operation", name),
+			s.provider,
+			attribute.String("storage.folder", folder),
+			attribute.String("storage.key", key),
+		))
+	return ctx, &operation{s: s, name: name, span: span, start: time.Now()}
+}
+
+// end records the outcome of the operation, bytes is the transferred size
+// in the given direction ("upload" or "download").
+func (o *operation) end(ctx context.Context, direction string, bytes int64, err error) {
+	attrs := []attribute.KeyValue{attribute.String("storage.operation", o.name), o.s.provider}
+	o.s.duration.Record(ctx, time.Since(o.start).Seconds(), metric.WithAttributes(attrs...))
+	if direction != "" && bytes > 0 {
+		o.span.SetAttributes(attribute.Int64("storage.bytes", bytes))
+		o.s.transferred.Add(ctx, bytes, metric.WithAttributes(append(attrs, attribute.String("storage.direction", direction))...))
+	}
+	if err != nil {
+		o.span.RecordError(err)
+		o.span.SetStatus(codes.Error, err.Error())
+		o.s.errors.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("error.type", o.s.errorType(err)))...))
+	}
+	o.span.End()
+}
+
+// errorType classifies errors with a low cardinality for metrics
+func (s *instrumentedStorage) errorType(err error) string {
+	switch {
+	case s.storage.IsNotFoundErr(err):
+		return "not_found"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, ErrAlreadyExists):
+		return "already_exists"
+	case errors.Is(err, ErrPreconditionFailed):
+		return "precondition_failed"
+	case errors.Is(err, ErrPermissionDenied):
+		return "permission_denied"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum_mismatch"
+	case errors.Is(err, ErrInvalidKey):
+		return "invalid_key"
+	}
+	return "other"
+}
+
+func (s *instrumentedStorage) Download(ctx context.Context, options *DownloadOptions) ([]byte, error) {
+	folder, key := downloadTarget(options)
+	ctx, op := s.start(ctx, "Download", folder, key)
+	data, err := s.storage.Download(ctx, options)
+	op.end(ctx, "download", int64(len(data)), err)
+	return data, err
+}
+
+func (s *instrumentedStorage) Upload(ctx context.Context, options *UploadOptions, r io.Reader) error {
+	var folder, key string
+	if options != nil {
+		folder, key = options.Folder, options.Key
+	}
+	ctx, op := s.start(ctx, "Upload", folder, key)
+	r, uploaded := measureUpload(r)
+	err := s.storage.Upload(ctx, options, r)
+	var size int64
+	if err == nil {
+		size = uploaded()
+	}
+	op.end(ctx, "upload", size, err)
+	return err
+}
+
+func (s *instrumentedStorage) Exists(ctx context.Context, options *ListOptions) (bool, error) {
+	folder, key := listTarget(options)
+	ctx, op := s.start(ctx, "Exists", folder, key)
+	exists, err := s.storage.Exists(ctx, options)
+	op.end(ctx, "", 0, err)
+	return exists, err
+}
+
+func (s *instrumentedStorage) ListKeys(ctx context.Context, options *ListOptions) ([]string, error) {
+	folder, prefix := listTarget(options)
+	ctx, op := s.start(ctx, "ListKeys", folder, prefix)
+	keys, err := s.storage.ListKeys(ctx, options)
+	op.span.SetAttributes(attribute.Int("storage.keys", len(keys)))
+	op.end(ctx, "", 0, err)
+	return keys, err
+}
+
+func (s *instrumentedStorage) GetTempTokenForDownload(ctx context.Context, options *DownloadOptions) (string, error) {
+	folder, key := downloadTarget(options)
+	ctx, op := s.start(ctx, "GetTempTokenForDownload", folder, key)
+	token, err := s.storage.GetTempTokenForDownload(ctx, options)
+	op.end(ctx, "", 0, err)
+	return token, err
+}
+
+func (s *instrumentedStorage) DownloadFromCdn(ctx context.Context, options *DownloadOptions) ([]byte, error) {
+	folder, key := downloadTarget(options)
+	ctx, op := s.start(ctx, "DownloadFromCdn", folder, key)
+	data, err := s.storage.DownloadFromCdn(ctx, options)
+	op.end(ctx, "download", int64(len(data)), err)
+	return data, err
+}
+
+func (s *instrumentedStorage) Delete(ctx context.Context, options *DeleteOptions) error {
+	var folder, key string
+	if options != nil {
+		folder, key = options.Folder, options.Key
+	}
+	ctx, op := s.start(ctx, "Delete", folder, key)
+	err := s.storage.Delete(ctx, options)
+	op.end(ctx, "", 0, err)
+	return err
+}
+
+func (s *instrumentedStorage) IsNotFoundErr(err error) bool {
+	return s.storage.IsNotFoundErr(err)
+}
+
+func (s *instrumentedStorage) ListObjects(ctx context.Context, options *ListOptions) ([]ObjectInfo, error) {
+	folder, prefix := listTarget(options)
+	ctx, op := s.start(ctx, "ListObjects", folder, prefix)
+	objects, err := s.storage.(ObjectLister).ListObjects(ctx, options)
+	op.span.SetAttributes(attribute.Int("storage.keys", len(objects)))
+	op.end(ctx, "", 0, err)
+	return objects, err
+}
+
+func (s *instrumentedStorage) StatObject(ctx context.Context, options *ListOptions) (ObjectInfo, error) {
+	folder, key := listTarget(options)
+	ctx, op := s.start(ctx, "StatObject", folder, key)
+	info, err := s.storage.(ObjectLister).StatObject(ctx, options)
+	op.end(ctx, "", 0, err)
+	return info, err
+}
+
+// NewRangeReader ends the operation when the returned reader is closed
+func (s *instrumentedStorage) NewRangeReader(ctx context.Context, options *DownloadOptions, offset, length int64) (io.ReadCloser, error) {
+	folder, key := downloadTarget(options)
+	ctx, op := s.start(ctx, "NewRangeReader", folder, key)
+	op.span.SetAttributes(attribute.Int64("storage.offset", offset), attribute.Int64("storage.length", length))
+	r, err := s.storage.(ObjectReader).NewRangeReader(ctx, options, offset, length)
+	if err != nil {
+		op.end(ctx, "", 0, err)
+		return nil, err
+	}
+	return &instrumentedReadCloser{ctx: ctx, reader: r, op: op}, nil
+}
+
+// instrumentedReadCloser counts the bytes read and ends its operation on Close
+type instrumentedReadCloser struct {
+	ctx    context.Context
+	reader io.ReadCloser
+	op     *operation
+	count  int64
+	err    error
+}
+
+func (r *instrumentedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *instrumentedReadCloser) Close() error {
+	err := r.reader.Close()
+	if r.op != nil {
+		if r.err == nil {
+			r.err = err
+		}
+		r.op.end(r.ctx, "download", r.count, r.err)
+		r.op = nil
+	}
+	return err
+}
+
+func (s *instrumentedStorage) GrantRead(ctx context.Context, options *ACLOptions) error {
+	folder, key := aclTarget(options)
+	ctx, op := s.start(ctx, "GrantRead", folder, key)
+	err := s.storage.(Admin).GrantRead(ctx, options)
+	op.end(ctx, "", 0, err)
+	return err
+}
+
+func (s *instrumentedStorage) RevokeRead(ctx context.Context, options *ACLOptions) error {
+	folder, key := aclTarget(options)
+	ctx, op := s.start(ctx, "RevokeRead", folder, key)
+	err := s.storage.(Admin).RevokeRead(ctx, options)
+	op.end(ctx, "", 0, err)
+	return err
+}
+
+func (s *instrumentedStorage) MakePublic(ctx context.Context, options *DownloadOptions) (string, error) {
+	folder, key := downloadTarget(options)
+	ctx, op := s.start(ctx, "MakePublic", folder, key)
+	url, err := s.storage.(Admin).MakePublic(ctx, options)
+	op.end(ctx, "", 0, err)
+	return url, err
+}
+
+func (s *instrumentedStorage) PublicURL(options *DownloadOptions) (string, error) {
+	folder, key := downloadTarget(options)
+	ctx, op := s.start(context.Background(), "PublicURL", folder, key)
+	url, err := s.storage.(Admin).PublicURL(options)
+	op.end(ctx, "", 0, err)
+	return url, err
+}
+
+func (s *instrumentedStorage) BucketPolicy(ctx context.Context) (*BucketPolicy, error) {
+	ctx, op := s.start(ctx, "BucketPolicy", "", "")
+	policy, err := s.storage.(Admin).BucketPolicy(ctx)
+	op.end(ctx, "", 0, err)
+	return policy, err
+}
+
+func downloadTarget(options *DownloadOptions) (folder, key string) {
+	if options == nil {
+		return "", ""
+	}
+	return options.Folder, options.Key
+}
+
+func listTarget(options *ListOptions) (folder, key string) {
+	if options == nil {
+		return "", ""
+	}
+	if options.Key != "" {
+		return options.Folder, options.Key
+	}
+	return options.Folder, options.Prefix
+}
+
+func aclTarget(options *ACLOptions) (folder, key string) {
+	if options == nil {
+		return "", ""
+	}
+	if options.Key != "" {
+		return options.Folder, options.Key
+	}
+	return options.Folder, options.Prefix
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// maxLimiterBurst bounds the bytes read at once by throttled transfers so
+// that concurrent transfers share the bandwidth smoothly.
+const maxLimiterBurst = 64 << 10
+
+// Progress is called during a transfer with the bytes transferred so far and
+// the total size of the transfer, or -1 if unknown. Retried transfers restart
+// from zero.
+type Progress func(transferred, total int64)
+
+// BandwidthLimiter caps the throughput of all the transfers sharing it
+type BandwidthLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewBandwidthLimiter returns a limiter allowing bytesPerSecond across its transfers
+func NewBandwidthLimiter(bytesPerSecond int) *BandwidthLimiter {
+	l := &BandwidthLimiter{limiter: rate.NewLimiter(rate.Inf, maxLimiterBurst)}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the allowed bytesPerSecond, zero or less means unlimited
+func (l *BandwidthLimiter) SetLimit(bytesPerSecond int) {
+	if bytesPerSecond <= 0 {
+		l.limiter.SetLimit(rate.Inf)
+		return
+	}
+	burst := bytesPerSecond
+	if burst > maxLimiterBurst {
+		burst = maxLimiterBurst
+	}
+	l.limiter.SetBurst(burst)
+	l.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// wait blocks until n bytes can be transferred
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := n
+		if burst := l.limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := l.limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// transfer holds the progress and throttling settings of a single transfer
+type transfer struct {
+	progress Progress
+	limiter  *BandwidthLimiter
+}
+
+// newTransfer returns nil if the transfer needs neither progress nor throttling
+func newTransfer(progress Progress, limiter, defaultLimiter *BandwidthLimiter) *transfer {
+	if limiter == nil {
+		limiter = defaultLimiter
+	}
+	if progress == nil && limiter == nil {
+		return nil
+	}
+	return &transfer{progress: progress, limiter: limiter}
+}
+
+// reader wraps r to report progress and throttle reads, total is -1 if unknown
+func (t *transfer) reader(ctx context.Context, r io.Reader, total int64) io.Reader {
+	if t == nil {
+		return r
+	}
+	if t.progress != nil {
+		t.progress(0, total)
+	}
+	return &transferReader{ctx: ctx, reader: r, transfer: t, total: total}
+}
+
+type transferReader struct {
+	ctx         context.Context
+	reader      io.Reader
+	transfer    *transfer
+	total       int64
+	transferred int64
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if r.transfer.limiter != nil && len(p) > maxLimiterBurst {
+		p = p[:maxLimiterBurst]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if r.transfer.limiter != nil {
+			if waitErr := r.transfer.limiter.wait(r.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+		r.transferred += int64(n)
+		if r.transfer.progress != nil {
+			r.transfer.progress(r.transferred, r.total)
+		}
+	}
+	return n, err
+}
+
+// transferReadCloser closes the reader wrapped by a transferReader
+type transferReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r transferReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// readerSize returns the remaining bytes of r if they can be known upfront
+func readerSize(r io.Reader) (int64, bool) {
+	switch reader := r.(type) {
+	case interface{ Len() int }:
+		return int64(reader.Len()), true
+	case io.Seeker:
+		current, err := reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := reader.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := reader.Seek(current, io.SeekStart); err != nil {
+			return 0, false
+		}
+		return end - current, true
+	}
+	return 0, false
+}
+
+// countingReader counts the bytes read from reader
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// measureUpload returns the reader to upload in place of r and a function
+// returning the bytes uploaded once done. Readers of known size are passed as
+// is so that uploads can be retried, other ones are counted.
+func measureUpload(r io.Reader) (io.Reader, func() int64) {
+	if size, ok := readerSize(r); ok {
+		return r, func() int64 { return size }
+	}
+	counter := &countingReader{reader: r}
+	return counter, func() int64 { return counter.count }
+}
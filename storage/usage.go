@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultUsageTTL = 10 * time.Minute
+
+// Usage is the number of objects and total bytes stored under a folder
+type Usage struct {
+	Objects int64
+	Bytes   int64
+}
+
+type usageEntry struct {
+	usage     Usage
+	refreshed time.Time
+}
+
+// UsageTracker computes and caches the usage of folders. Cached values are
+// kept up to date with Add and recomputed by listing once older than the TTL.
+type UsageTracker struct {
+	lister ObjectLister
+	ttl    time.Duration
+	mutex  sync.Mutex
+	usages map[string]*usageEntry
+	// generations count the changes of every folder, so that a listing
+	// racing with Add doesn't overwrite the usage it was applied to
+	generations map[string]uint64
+}
+
+// NewUsageTracker returns a tracker for the given storage, which must
+// implement ObjectLister. A zero ttl defaults to 10 minutes.
+func NewUsageTracker(s Storage, ttl time.Duration) (*UsageTracker, error) {
+	lister, ok := s.(ObjectLister)
+	if !ok {
+		return nil, errors.New("storage client doesn't support listing object attributes")
+	}
+	if ttl <= 0 {
+		ttl = defaultUsageTTL
+	}
+	return &UsageTracker{
+		lister:      lister,
+		ttl:         ttl,
+		usages:      make(map[string]*usageEntry),
+		generations: make(map[string]uint64),
+	}, nil
+}
+
+// Usage returns the usage of folder, served from cache while it is fresh
+func (u *UsageTracker) Usage(ctx context.Context, folder string) (Usage, error) {
+	folder, err := JoinKey(folder)
+	if err != nil {
+		return Usage{}, err
+	}
+	u.mutex.Lock()
+	entry, ok := u.usages[folder]
+	if ok && time.Since(entry.refreshed) < u.ttl {
+		usage := entry.usage
+		u.mutex.Unlock()
+		return usage, nil
+	}
+	u.mutex.Unlock()
+
+	return u.Refresh(ctx, folder)
+}
+
+// Refresh recomputes the usage of folder by listing all its objects. If the
+// folder changed during the listing, which may or may not include the
+// change, the cached usage is kept and returned instead.
+func (u *UsageTracker) Refresh(ctx context.Context, folder string) (Usage, error) {
+	folder, err := JoinKey(folder)
+	if err != nil {
+		return Usage{}, err
+	}
+	u.mutex.Lock()
+	generation := u.generations[folder]
+	u.mutex.Unlock()
+
+	objects, err := u.lister.ListObjects(ctx, &ListOptions{
+		Folder:    folder,
+		Recursive: true,
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var usage Usage
+	for _, object := range objects {
+		if object.IsDir {
+			continue
+		}
+		usage.Objects++
+		usage.Bytes += object.Size
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.generations[folder] != generation {
+		if entry, ok := u.usages[folder]; ok {
+			return entry.usage, nil
+		}
+		return usage, nil
+	}
+	u.usages[folder] = &usageEntry{usage: usage, refreshed: time.Now()}
+	return usage, nil
+}
+
+// Add applies an incremental change to the cached usage of folder. It is a
+// no-op if the folder's usage hasn't been computed yet.
+func (u *UsageTracker) Add(folder string, objects, bytes int64) {
+	folder, err := JoinKey(folder)
+	if err != nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.generations[folder]++
+	if entry, ok := u.usages[folder]; ok {
+		entry.usage.Objects += objects
+		entry.usage.Bytes += bytes
+	}
+}
+
+// Invalidate drops the cached usage of folder
+func (u *UsageTracker) Invalidate(folder string) {
+	folder, err := JoinKey(folder)
+	if err != nil {
+		return
+	}
+	u.mutex.Lock()
+	delete(u.usages, folder)
+	u.generations[folder]++
+	u.mutex.Unlock()
+}